@@ -55,6 +55,25 @@ func Remove(url string, key [32]byte) error {
 	}
 }
 
+/* Runs the transaction on the server at url,
+ * using the kvstore protocol */
+func Transaction(url string, tx *api.Transaction) error {
+	value, err := tx.Bytes()
+	if err != nil {
+		return err
+	}
+	msg, err := api.SendRecv(url, func(addr *net.UDPAddr) api.Message {
+		return api.NewValueDgram(api.NewMessageUID(addr), api.CmdTransaction, value)
+	})
+	if err != nil {
+		return err
+	} else if cmdErr := api.ResponseError(msg); cmdErr != nil {
+		return cmdErr
+	} else {
+		return nil
+	}
+}
+
 /* Removes the value from the server at url,
  * using the kvstore protocol */
 func Kill(url string) error {
@@ -70,6 +89,21 @@ func Kill(url string) error {
 	}
 }
 
+/* Starts decommissioning the server at url. It hands its keys off
+ * to the other nodes, and then exits */
+func Decommission(url string) error {
+	msg, err := api.SendRecv(url, func(addr *net.UDPAddr) api.Message {
+		return api.NewKeyDgram(api.NewMessageUID(addr), api.CmdDecommission, [32]byte{})
+	})
+	if err != nil {
+		return err
+	} else if cmdErr := api.ResponseError(msg); cmdErr != nil {
+		return cmdErr
+	} else {
+		return nil
+	}
+}
+
 /* Runs a set of tests on the server at url,
  * using the kvstore protocol */
 func Test(url string, args []string) error {
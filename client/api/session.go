@@ -0,0 +1,102 @@
+package api
+
+import (
+	"errors"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/util"
+	"net"
+)
+
+/* Retrieves the value from the server at url, refusing any version older
+ * than token. Returns the value and the updated session token, which is
+ * updated even if the key is absent */
+func SessionGet(url string, key [32]byte, token int64) ([]byte, int64, error) {
+	return sendSessionCmd(url, api.CmdSessionGet, key, token, nil)
+}
+
+/* Sets the value on the server at url, with a version newer than token.
+ * Returns the updated session token */
+func SessionPut(url string, key [32]byte, value []byte, token int64) (int64, error) {
+	_, newToken, err := sendSessionCmd(url, api.CmdSessionPut, key, token, value)
+	return newToken, err
+}
+
+/* Removes the value from the server at url, with a version newer than token.
+ * Returns the updated session token, which is updated even if the key
+ * is absent */
+func SessionRemove(url string, key [32]byte, token int64) (int64, error) {
+	_, newToken, err := sendSessionCmd(url, api.CmdSessionRemove, key, token, nil)
+	return newToken, err
+}
+
+/* Sends the session command, returning the value and updated token of the
+ * reply. Replies for absent keys carry a token as well as their error.
+ * Returns token unchanged if the reply carries none */
+func sendSessionCmd(url string, cmd byte, key [32]byte, token int64,
+	value []byte) ([]byte, int64, error) {
+	msg, err := api.SendRecv(url, func(addr *net.UDPAddr) api.Message {
+		return api.NewKeyValueDgram(api.NewMessageUID(addr), cmd, key,
+			api.NewSessionValue(token, value))
+	})
+	if err != nil {
+		return nil, token, err
+	}
+	cmdErr := api.ResponseError(msg)
+	vmsg, ok := msg.(*api.ValueDgram)
+	if !ok {
+		if cmdErr == nil {
+			cmdErr = errors.New("Invalid dgram for session command")
+		}
+		return nil, token, cmdErr
+	}
+	newToken, value, err := api.ParseSessionValue(vmsg.Value)
+	if err != nil {
+		return nil, token, err
+	}
+	return value, newToken, cmdErr
+}
+
+// Session tracks the newest version seen of each key, so that its reads
+// never go back in time (read your writes, and monotonic reads), whichever
+// server they are sent to.
+type Session struct {
+	tokens map[[32]byte]int64
+	lock   util.Semaphore
+}
+
+func NewSession() *Session {
+	return &Session{tokens: map[[32]byte]int64{}, lock: util.NewSemaphore()}
+}
+
+// Returns the session token for the key
+func (s *Session) Token(key [32]byte) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.tokens[key]
+}
+
+func (s *Session) update(key [32]byte, token int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if token > s.tokens[key] {
+		s.tokens[key] = token
+	}
+}
+
+func (s *Session) Get(url string, key [32]byte) ([]byte, error) {
+	value, token, err := SessionGet(url, key, s.Token(key))
+	s.update(key, token)
+	return value, err
+}
+
+func (s *Session) Put(url string, key [32]byte, value []byte) error {
+	token, err := SessionPut(url, key, value, s.Token(key))
+	s.update(key, token)
+	return err
+}
+
+func (s *Session) Remove(url string, key [32]byte) error {
+	token, err := SessionRemove(url, key, s.Token(key))
+	s.update(key, token)
+	return err
+}
@@ -7,6 +7,7 @@ import (
 	clientapi "github.com/tsiemens/kvstore/client/api"
 	"github.com/tsiemens/kvstore/shared/api"
 	"github.com/tsiemens/kvstore/shared/log"
+	"strconv"
 )
 
 func KeyFromString(keystr string) [32]byte {
@@ -21,8 +22,12 @@ func New(cmdstr string) (cmd Command, err error) {
 		cmd = newPutCommand()
 	case "remove":
 		cmd = newRemoveCommand()
+	case "tx":
+		cmd = newTransactionCommand()
 	case "kill":
 		cmd = newKillCommand()
+	case "decommission":
+		cmd = newDecommissionCommand()
 	case "status":
 		cmd = newStatusUpdateCommand()
 	case "adhoc":
@@ -35,6 +40,21 @@ func New(cmdstr string) (cmd Command, err error) {
 	return
 }
 
+const sessionTokenArg = "[TOKEN] (Optional session token from a previous command. " +
+	"Older versions of the key are refused)"
+
+func parseSessionToken(arg string) (int64, error) {
+	token, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || token < 0 {
+		return 0, errors.New("Invalid session token \"" + arg + "\"")
+	}
+	return token, nil
+}
+
+func printSessionToken(token int64) {
+	log.Out.Printf("Session token: %d\n", token)
+}
+
 type Command interface {
 	Name() string
 	Desc() string
@@ -68,7 +88,7 @@ func newGetCommand() *GetCommand {
 	return &GetCommand{BaseCommand{
 		name: "get",
 		desc: "Gets the value for a key.",
-		args: []string{"KEY (string)"},
+		args: []string{"KEY (string)", sessionTokenArg},
 	}}
 }
 
@@ -79,7 +99,19 @@ func (c *GetCommand) Run(url string, args []string) error {
 
 	key := KeyFromString(args[0])
 
-	val, err := clientapi.Get(url, key)
+	var val []byte
+	var err error
+	if len(args) > 1 {
+		token, tokenErr := parseSessionToken(args[1])
+		if tokenErr != nil {
+			return tokenErr
+		}
+		// Printed even if the key is absent, since its removal updates the token
+		val, token, err = clientapi.SessionGet(url, key, token)
+		printSessionToken(token)
+	} else {
+		val, err = clientapi.Get(url, key)
+	}
 	if err != nil {
 		return err
 	}
@@ -98,7 +130,8 @@ func newPutCommand() *PutCommand {
 		name: "put",
 		desc: "Sets the value for a key.",
 		args: []string{"KEY (string)",
-			"VALUE (Defaults to ascii. Other format flags may be added later)"},
+			"VALUE (Defaults to ascii. Other format flags may be added later)",
+			sessionTokenArg},
 	}}
 }
 
@@ -110,7 +143,19 @@ func (c *PutCommand) Run(url string, args []string) error {
 	key := KeyFromString(args[0])
 
 	value := args[1]
-	err := clientapi.Put(url, key, []byte(value))
+	var err error
+	if len(args) > 2 {
+		token, tokenErr := parseSessionToken(args[2])
+		if tokenErr != nil {
+			return tokenErr
+		}
+		token, err = clientapi.SessionPut(url, key, []byte(value), token)
+		if err == nil {
+			printSessionToken(token)
+		}
+	} else {
+		err = clientapi.Put(url, key, []byte(value))
+	}
 	if err != nil {
 		return err
 	}
@@ -127,7 +172,7 @@ func newRemoveCommand() *RemoveCommand {
 	return &RemoveCommand{BaseCommand{
 		name: "remove",
 		desc: "Deletes the value for a key.",
-		args: []string{"KEY (string)"},
+		args: []string{"KEY (string)", sessionTokenArg},
 	}}
 }
 
@@ -138,7 +183,17 @@ func (c *RemoveCommand) Run(url string, args []string) error {
 
 	key := KeyFromString(args[0])
 
-	err := clientapi.Remove(url, key)
+	var err error
+	if len(args) > 1 {
+		token, tokenErr := parseSessionToken(args[1])
+		if tokenErr != nil {
+			return tokenErr
+		}
+		token, err = clientapi.SessionRemove(url, key, token)
+		printSessionToken(token)
+	} else {
+		err = clientapi.Remove(url, key)
+	}
 	if err != nil {
 		return err
 	}
@@ -147,6 +202,61 @@ func (c *RemoveCommand) Run(url string, args []string) error {
 	return nil
 }
 
+type TransactionCommand struct {
+	BaseCommand
+}
+
+func newTransactionCommand() *TransactionCommand {
+	return &TransactionCommand{BaseCommand{
+		name: "tx",
+		desc: "Atomically runs a sequence of ops. Nothing is written if a check fails.",
+		args: []string{"OPS... (any of: put KEY VALUE, remove KEY, equals KEY VALUE, " +
+			"exists KEY, absent KEY)"},
+	}}
+}
+
+func (c *TransactionCommand) Run(url string, args []string) error {
+	tx := &api.Transaction{}
+	for len(args) > 0 {
+		var op byte
+		argCount := 2
+		switch args[0] {
+		case "put":
+			op, argCount = api.TxOpPut, 3
+		case "remove":
+			op = api.TxOpRemove
+		case "equals":
+			op, argCount = api.TxOpCheckEquals, 3
+		case "exists":
+			op = api.TxOpCheckExists
+		case "absent":
+			op = api.TxOpCheckAbsent
+		default:
+			return errors.New("Unknown transaction op \"" + args[0] + "\"")
+		}
+		if len(args) < argCount {
+			return errors.New(args[0] + " is missing arguments")
+		}
+		var value []byte
+		if argCount == 3 {
+			value = []byte(args[2])
+		}
+		tx.Ops = append(tx.Ops, api.NewTxOp(op, KeyFromString(args[1]), value))
+		args = args[argCount:]
+	}
+	if len(tx.Ops) == 0 {
+		return errors.New("tx requires at least one op")
+	}
+
+	err := clientapi.Transaction(url, tx)
+	if err != nil {
+		return err
+	}
+
+	log.Out.Println("Committed transaction")
+	return nil
+}
+
 //sdfsdf
 
 type KillCommand struct {
@@ -171,13 +281,37 @@ func (c *KillCommand) Run(url string, args []string) error {
 	return nil
 }
 
+type DecommissionCommand struct {
+	BaseCommand
+}
+
+func newDecommissionCommand() *DecommissionCommand {
+	return &DecommissionCommand{BaseCommand{
+		name: "decommission",
+		desc: "Removes the node from the cluster. It hands off its keys, then exits.",
+		args: []string{},
+	}}
+}
+
+func (c *DecommissionCommand) Run(url string, args []string) error {
+	err := clientapi.Decommission(url)
+	if err != nil {
+		return err
+	}
+
+	log.Out.Println("Decommissioning node")
+	return nil
+}
+
 //sdfsdf
 
 func PrintCommands() {
 	printCommandHelp(newGetCommand())
 	printCommandHelp(newPutCommand())
 	printCommandHelp(newRemoveCommand())
+	printCommandHelp(newTransactionCommand())
 	printCommandHelp(newKillCommand())
+	printCommandHelp(newDecommissionCommand())
 	printCommandHelp(newTestCommand())
 }
 
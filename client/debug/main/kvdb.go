@@ -74,7 +74,7 @@ func getCommandLine() *KVDBCommandLine {
 
 func printHelp() {
 	log.Out.Println("Debug client for the KVStore Key Value Store. Sends a configurable message.\n\n" +
-		"Usage:\n    client [OPTIONS]\n")
+		"Usage:\n    client [OPTIONS]")
 	log.Out.Println("\nOptions:")
 	flag.PrintDefaults()
 }
@@ -1,26 +1,57 @@
 package cache
 
 import (
+	"container/list"
 	"github.com/tsiemens/kvstore/shared/api"
 	//"github.com/tsiemens/kvstore/shared/log"
 	"net"
+	"sync"
 	"time"
 )
 
 const garbageCollectionInterval = time.Millisecond * 2000
 const maxCacheLife = time.Millisecond * 5000
 
+// Bytes counted for each entry, besides its reply
+const entryOverhead = 64
+
 type CacheEntry struct {
 	Time  time.Time
 	Reply api.Message
+	uid   [16]byte
+	size  int
 }
 
+/* Cache remembers the messages handled recently, and their replies, so that
+ * a retried request is answered without being handled again.
+ * It holds at most maxEntries entries and maxBytes bytes, evicting the least
+ * recently used first. Safe to use from several goroutines.
+ */
 type Cache struct {
-	M map[[16]byte]*CacheEntry
+	entries    map[[16]byte]*list.Element
+	lru        *list.List // Of *CacheEntry, most recently used first
+	bytes      int
+	maxEntries int
+	maxBytes   int
+	stats      Stats
+	lock       sync.Mutex
 }
 
-func New() *Cache {
-	c := &Cache{map[[16]byte]*CacheEntry{}}
+type Stats struct {
+	Hits      int // Messages received again
+	Misses    int // New messages
+	Evictions int // Entries dropped to stay within the bounds, before they expired
+	Entries   int
+	Bytes     int
+}
+
+func New(maxEntries int, maxBytes int) *Cache {
+	c := &Cache{
+		entries:    map[[16]byte]*list.Element{},
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
 	go c.garbageCollectionLoop()
 	return c
 }
@@ -28,28 +59,88 @@ func New() *Cache {
 /* Returns if the message was already handled and cached,
  * and a (possibly nil) reply message */
 func (cache *Cache) StoreAndGetReply(msg api.Message) (bool, api.Message) {
-	entry, ok := cache.M[msg.UID()]
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	elem, ok := cache.entries[msg.UID()]
 	if !ok {
-		cache.M[msg.UID()] = &CacheEntry{
+		cache.stats.Misses++
+		entry := &CacheEntry{
 			Time: time.Now(),
+			uid:  msg.UID(),
+			size: entryOverhead,
 		}
+		cache.entries[entry.uid] = cache.lru.PushFront(entry)
+		cache.bytes += entry.size
+		cache.evict()
 		return false, nil
 	} else {
-		return true, entry.Reply
+		cache.stats.Hits++
+		cache.lru.MoveToFront(elem)
+		return true, elem.Value.(*CacheEntry).Reply
 	}
 }
 
 /* Sends the message as a reply. This sets the message as a reply to
- * the incoming message with the same UID
+ * the incoming message with the same UID, to be sent again to duplicates.
+ * Overload replies are not final, since they ask the client to try again,
+ * so they are not cached, and the incoming message is forgotten so that
+ * its retries are handled.
  * cache may be nil
  */
 func (cache *Cache) SendReply(conn *net.UDPConn, msg api.Message, addr net.Addr) (int, error) {
-	if cache != nil && msg.Command() == api.RespOk {
-		if entry, ok := cache.M[msg.UID()]; ok {
-			entry.Reply = msg
-		}
+	data := msg.Bytes()
+	if cache != nil && msg.Command() == api.RespSysOverload {
+		cache.forget(msg.UID())
+	} else if cache != nil {
+		cache.setReply(msg, len(data))
 	}
-	return conn.WriteTo(msg.Bytes(), addr)
+	return conn.WriteTo(data, addr)
+}
+
+func (cache *Cache) forget(uid [16]byte) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if elem, ok := cache.entries[uid]; ok {
+		cache.remove(elem)
+	}
+}
+
+func (cache *Cache) setReply(msg api.Message, size int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if elem, ok := cache.entries[msg.UID()]; ok {
+		entry := elem.Value.(*CacheEntry)
+		entry.Reply = msg
+		cache.bytes += entryOverhead + size - entry.size
+		entry.size = entryOverhead + size
+		cache.lru.MoveToFront(elem)
+		cache.evict()
+	}
+}
+
+// Drops the least recently used entries until the cache is within its bounds.
+// The caller must hold the lock.
+func (cache *Cache) evict() {
+	for cache.lru.Len() > 0 && (cache.lru.Len() > cache.maxEntries || cache.bytes > cache.maxBytes) {
+		cache.remove(cache.lru.Back())
+		cache.stats.Evictions++
+	}
+}
+
+func (cache *Cache) remove(elem *list.Element) {
+	entry := cache.lru.Remove(elem).(*CacheEntry)
+	delete(cache.entries, entry.uid)
+	cache.bytes -= entry.size
+}
+
+// Returns the hit, miss and eviction counts, and the current size
+func (cache *Cache) Stats() Stats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	stats := cache.stats
+	stats.Entries = cache.lru.Len()
+	stats.Bytes = cache.bytes
+	return stats
 }
 
 func (cache *Cache) garbageCollectionLoop() {
@@ -60,10 +151,14 @@ func (cache *Cache) garbageCollectionLoop() {
 }
 
 func (cache *Cache) Clean() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
 	now := time.Now()
-	for uid, entry := range cache.M {
-		if entry.Time.Add(maxCacheLife).Before(now) {
-			delete(cache.M, uid)
+	for elem := cache.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*CacheEntry).Time.Add(maxCacheLife).Before(now) {
+			cache.remove(elem)
 		}
+		elem = next
 	}
 }
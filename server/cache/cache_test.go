@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/tsiemens/kvstore/shared/api"
+)
+
+func msgWithUID(i int) api.Message {
+	return api.NewBaseDgram([16]byte{byte(i), byte(i >> 8)}, api.CmdGet)
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New(2, 1024*1024)
+	c.StoreAndGetReply(msgWithUID(1))
+	c.StoreAndGetReply(msgWithUID(2))
+	if cached, _ := c.StoreAndGetReply(msgWithUID(1)); !cached {
+		t.Fatal("Message not cached")
+	}
+	c.StoreAndGetReply(msgWithUID(3))
+
+	stats := c.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 || stats.Hits != 1 || stats.Misses != 3 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	if cached, _ := c.StoreAndGetReply(msgWithUID(1)); !cached {
+		t.Fatal("Recently used message evicted")
+	}
+	if cached, _ := c.StoreAndGetReply(msgWithUID(2)); cached {
+		t.Fatal("Least recently used message not evicted")
+	}
+}
+
+func TestCacheBoundedByBytes(t *testing.T) {
+	c := New(100, 3*entryOverhead)
+	for i := 0; i < 10; i++ {
+		c.StoreAndGetReply(msgWithUID(i))
+	}
+	if stats := c.Stats(); stats.Entries != 3 || stats.Bytes > 3*entryOverhead {
+		t.Fatalf("Cache over its byte bound: %+v", stats)
+	}
+}
+
+func TestCacheConcurrentUse(t *testing.T) {
+	c := New(100, 1024*1024)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				msg := msgWithUID(g*1000 + i)
+				c.StoreAndGetReply(msg)
+				c.SendReply(conn, api.NewValueDgram(msg.UID(), api.RespOk, []byte("v")), addr)
+				c.Clean()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if stats := c.Stats(); stats.Entries > 100 {
+		t.Fatal("Cache over its entry bound")
+	}
+}
+
+func TestCacheReplaysErrorReplies(t *testing.T) {
+	c := New(100, 1024*1024)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := msgWithUID(1)
+	c.StoreAndGetReply(msg)
+	c.SendReply(conn, api.NewBaseDgram(msg.UID(), api.RespInvalidKey), conn.LocalAddr())
+	if _, reply := c.StoreAndGetReply(msg); reply == nil || reply.Command() != api.RespInvalidKey {
+		t.Fatal("Error reply not cached")
+	}
+
+	msg = msgWithUID(2)
+	c.StoreAndGetReply(msg)
+	c.SendReply(conn, api.NewOverloadDgram(msg.UID(), 0), conn.LocalAddr())
+	if wasCached, _ := c.StoreAndGetReply(msg); wasCached {
+		t.Fatal("Message answered with an overload not handled again")
+	}
+}
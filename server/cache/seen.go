@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"container/list"
+	"github.com/tsiemens/kvstore/shared/util"
+	"sync"
+	"time"
+)
+
+/* SeenSet remembers the UIDs of gossiped messages, and whether this node
+ * still passes each on. UIDs are forgotten after retention, or sooner once
+ * there are more than maxEntries, oldest first. Safe to use from several
+ * goroutines.
+ */
+type SeenSet struct {
+	entries    map[[16]byte]*list.Element
+	order      *list.List // Of *seenEntry, oldest first
+	retention  time.Duration
+	maxEntries int
+	lock       sync.Mutex
+}
+
+type seenEntry struct {
+	uid    [16]byte
+	time   time.Time
+	gossip bool
+}
+
+func NewSeenSet(retention time.Duration, maxEntries int) *SeenSet {
+	return &SeenSet{
+		entries:    map[[16]byte]*list.Element{},
+		order:      list.New(),
+		retention:  retention,
+		maxEntries: maxEntries,
+	}
+}
+
+// Returns whether the message with uid has not been seen
+func (s *SeenSet) IsNew(uid [16]byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire(time.Now())
+	_, ok := s.entries[uid]
+	return !ok
+}
+
+/* Records the message with uid as seen. Returns whether it had not been
+ * seen before, and whether it should be gossiped on, in one step so that
+ * only one of several copies received at once is taken as new.
+ * A new message is always gossiped. A message seen before is gossiped again
+ * until, with a chance of 1 in k each time, it stops for good.
+ */
+func (s *SeenSet) See(uid [16]byte, k int) (isNew bool, gossip bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	s.expire(now)
+	elem, ok := s.entries[uid]
+	if !ok {
+		s.entries[uid] = s.order.PushBack(&seenEntry{uid: uid, time: now, gossip: true})
+		for s.order.Len() > s.maxEntries {
+			s.remove(s.order.Front())
+		}
+		return true, true
+	}
+	entry := elem.Value.(*seenEntry)
+	if entry.gossip && util.Rand.Intn(k) == k-1 {
+		entry.gossip = false
+	}
+	return false, entry.gossip
+}
+
+// Records the message with uid as seen, and returns whether it should be
+// gossiped on. See See.
+func (s *SeenSet) ShouldGossip(uid [16]byte, k int) bool {
+	_, gossip := s.See(uid, k)
+	return gossip
+}
+
+// Returns the number of UIDs remembered
+func (s *SeenSet) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.order.Len()
+}
+
+// Forgets the UIDs seen longer than retention ago.
+// The caller must hold the lock.
+func (s *SeenSet) expire(now time.Time) {
+	for elem := s.order.Front(); elem != nil; elem = s.order.Front() {
+		if now.Sub(elem.Value.(*seenEntry).time) < s.retention {
+			return
+		}
+		s.remove(elem)
+	}
+}
+
+func (s *SeenSet) remove(elem *list.Element) {
+	delete(s.entries, s.order.Remove(elem).(*seenEntry).uid)
+}
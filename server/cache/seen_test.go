@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSeenSetBounded(t *testing.T) {
+	s := NewSeenSet(time.Hour, 2)
+	for i := 0; i < 3; i++ {
+		if !s.ShouldGossip([16]byte{byte(i)}, 4) {
+			t.Fatal("New message not gossiped")
+		}
+	}
+	if s.Len() != 2 || !s.IsNew([16]byte{0}) || s.IsNew([16]byte{2}) {
+		t.Fatal("Oldest message not forgotten first")
+	}
+
+	s = NewSeenSet(time.Millisecond, 10)
+	s.ShouldGossip([16]byte{1}, 4)
+	time.Sleep(2 * time.Millisecond)
+	if !s.IsNew([16]byte{1}) || s.Len() != 0 {
+		t.Fatal("Message not forgotten after the retention")
+	}
+}
+
+func TestSeenSetStopsGossiping(t *testing.T) {
+	s := NewSeenSet(time.Hour, 10)
+	uid := [16]byte{1}
+	s.ShouldGossip(uid, 1)
+	// With k of 1, a message seen before always stops
+	if s.ShouldGossip(uid, 1) || s.ShouldGossip(uid, 1) {
+		t.Fatal("Message gossiped again")
+	}
+}
+
+func TestSeenSetNewOnlyOnce(t *testing.T) {
+	s := NewSeenSet(time.Hour, 100)
+	uid := [16]byte{1}
+	news := make(chan bool, 50)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			isNew, _ := s.See(uid, 4)
+			news <- isNew
+		}()
+	}
+	wg.Wait()
+	close(news)
+	count := 0
+	for isNew := range news {
+		if isNew {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("Message taken as new %d times", count)
+	}
+}
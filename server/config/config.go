@@ -14,14 +14,29 @@ import (
 
 var config *Config
 
+// Values for ConsistencyMode
+const ConsistencyQuorum = "quorum"
+const ConsistencyRaft = "raft"
+
+// Defaults of the reply cache and seen gossip set sizes
+const DefaultReplyCacheEntries = 10000
+const DefaultReplyCacheBytes = 16 * 1024 * 1024
+const DefaultGossipRetention = time.Minute
+const DefaultGossipMaxSeen = 10000
+
 type Config struct {
 	UseLoopback          bool
-	NotifyCount          int          // number of nodes notified using the gossip protocol
-	K                    int          // K factor in gossip protocol
-	PeerList             []string     // hostnames of all other nodes in network
-	DefaultLocalhostPort int          // default ports to communicate on
-	StatusServer         string       // hostname of status server
-	StatusServerAddr     *net.UDPAddr // addr of status server
+	NotifyCount          int           // number of nodes notified using the gossip protocol
+	K                    int           // K factor in gossip protocol
+	PeerList             []string      // hostnames of all other nodes in network
+	SeedDNS              []string      // DNS names of seed nodes. Names starting with _ are SRV records
+	SeedPath             string        // file, or directory of files, listing seed nodes
+	SeedRefreshInterval  time.Duration // how often seeds are resolved again
+	JoinTimeout          time.Duration // how long a new node waits for peers to push it keys before serving
+	Bootstrap            bool          // start a new cluster if no seed answers, instead of asking again
+	DefaultLocalhostPort int           // default ports to communicate on
+	StatusServer         string        // hostname of status server
+	StatusServerAddr     *net.UDPAddr  // addr of status server
 	StatusServerPort     int
 	StatusServerHttpPort int
 	UpdateFrequency      time.Duration // how often the status server requests node updates
@@ -30,6 +45,26 @@ type Config struct {
 	DialTimeout          time.Duration
 	Hostname             string // this servers hostname
 	MaxReplicas          int
+	TwoPhaseWrites       bool          // query replica timestamps before each write, instead of using the node clock
+	SloppyQuorum         bool          // substitute unreachable replicas with the next healthy nodes on the ring
+	ConsistencyMode      string        // ConsistencyQuorum (default) or ConsistencyRaft
+	ProbeInterval        time.Duration // how often the failure detector pings a random peer
+	IndirectProbes       int           // number of peers asked to ping a peer which missed a ping
+	SuspectTimeout       time.Duration // how long a suspected peer has to refute before it is marked offline
+	VirtualNodes         int           // number of ring tokens per unit of weight. Must be the same on all nodes
+	Weight               float64       // this node's share of the keyspace, relative to other nodes
+	Zone                 string        // label of this node's rack or datacenter
+	MigrationRate        int           // bytes per second a node may spend copying keys to others. 0 is unlimited
+	Workers              int           // number of goroutines handling received messages
+	QueueSize            int           // number of received messages which may wait for a worker
+	ClientRateLimit      float64       // client requests per second allowed from each IP. 0 is unlimited
+	ClientRateBurst      int           // client requests an IP may send at once, above ClientRateLimit
+	ReplyCacheEntries    int           // number of recent messages remembered, to answer retries
+	ReplyCacheBytes      int           // bytes of recent messages and their replies remembered
+	GossipRetention      time.Duration // how long the UIDs of gossiped messages are remembered, to not gossip them again
+	GossipMaxSeen        int           // number of gossiped message UIDs remembered
+	RaftDir              string        // directory the raft term, vote and log of each group are saved in
+	TxnDir               string        // directory the decisions of transactions this node coordinates are saved in
 }
 
 func Init(configPath string, useloopback bool) {
@@ -59,7 +94,7 @@ func Init(configPath string, useloopback bool) {
 	// get host name
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.E.Printf("Error getting hostname:", err)
+		log.E.Println("Error getting hostname:", err)
 	}
 	config.Hostname = hostname
 	config.UseLoopback = useloopback
@@ -69,9 +104,54 @@ func Init(configPath string, useloopback bool) {
 	}
 	addr, err := net.ResolveUDPAddr("udp", config.StatusServer+":"+strconv.Itoa(config.StatusServerPort))
 	if err != nil {
-		log.E.Printf("Error resolving status server:", err)
+		log.E.Println("Error resolving status server:", err)
 	}
 	config.StatusServerAddr = addr
+	if config.ProbeInterval == 0 {
+		config.ProbeInterval = time.Second
+	}
+	if config.IndirectProbes == 0 {
+		config.IndirectProbes = 3
+	}
+	if config.SuspectTimeout == 0 {
+		config.SuspectTimeout = time.Second * 5
+	}
+	if config.SeedRefreshInterval == 0 {
+		config.SeedRefreshInterval = time.Second * 30
+	}
+	if config.JoinTimeout == 0 {
+		config.JoinTimeout = time.Minute
+	}
+	if config.VirtualNodes < 1 {
+		config.VirtualNodes = 1
+	}
+	if config.Weight <= 0 {
+		config.Weight = 1
+	}
+	if config.Workers < 1 {
+		config.Workers = 64
+	}
+	if config.QueueSize < 1 {
+		config.QueueSize = 1024
+	}
+	if config.ReplyCacheEntries < 1 {
+		config.ReplyCacheEntries = DefaultReplyCacheEntries
+	}
+	if config.ReplyCacheBytes < 1 {
+		config.ReplyCacheBytes = DefaultReplyCacheBytes
+	}
+	if config.GossipRetention <= 0 {
+		config.GossipRetention = DefaultGossipRetention
+	}
+	if config.GossipMaxSeen < 1 {
+		config.GossipMaxSeen = DefaultGossipMaxSeen
+	}
+	if config.RaftDir == "" {
+		config.RaftDir = "raft"
+	}
+	if config.TxnDir == "" {
+		config.TxnDir = "txn"
+	}
 	log.D.Println(config.PeerList)
 }
 
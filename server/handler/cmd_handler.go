@@ -13,6 +13,8 @@ import (
 	"github.com/tsiemens/kvstore/shared/exec"
 	"github.com/tsiemens/kvstore/shared/log"
 	"net"
+	"os"
+	"time"
 )
 
 func convertClientKey(clientKey [32]byte) [32]byte {
@@ -36,19 +38,24 @@ func printReplicaKeyHandleMsg(key [32]byte, thisNode *node.Node) {
 	for _, k := range replicas {
 		s += fmt.Sprintf("\t%s\n", k.String())
 	}
-	log.I.Printf(s)
+	log.I.Print(s)
 }
 
 type replicaData struct {
-	Val *store.StoreVal
-	Err error
+	Val         *store.StoreVal
+	Err         error
+	Unreachable bool // The replica timed out or is known to be offline
 }
 
 type replicaVersionData struct {
-	Version int
+	Version int64
 	Err     error
 }
 
+func isRaftMode() bool {
+	return config.GetConfig().ConsistencyMode == config.ConsistencyRaft
+}
+
 func minSuccessfulOps(attempts int) int {
 	return int((float32(attempts) / 2) + 1)
 }
@@ -59,7 +66,12 @@ func HandleGet(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr)
 		keyMsg.Key = convertClientKey(keyMsg.Key)
 	}
 	printReplicaKeyHandleMsg(keyMsg.Key, node.GetProcessNode())
-	storeval := execQuorum(api.CmdGet, keyMsg, handler, -1 /*timestamp not used*/)
+	var storeval *store.StoreVal
+	if isRaftMode() {
+		storeval = execRaft(api.CmdGet, keyMsg.Key, nil, 0)
+	} else {
+		storeval = execQuorum(api.CmdGet, keyMsg, handler, -1 /*timestamp not used*/)
+	}
 
 	if storeval != nil {
 		var replyMsg api.Message
@@ -68,7 +80,7 @@ func HandleGet(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr)
 		} else {
 			replyMsg = api.NewValueDgram(msg.UID(), api.RespOk, storeval.Val)
 		}
-		protocol.ReplyToGet(handler.Conn, recvAddr, replyMsg)
+		protocol.ReplyToGet(handler.Conn, recvAddr, handler.Cache, replyMsg)
 	}
 	// Otherwise, we didn't get enough data to make a decision.
 	// Force timeout
@@ -94,7 +106,7 @@ func HandleIntraGet(handler *MessageHandler, msg api.Message, recvAddr *net.UDPA
 			replyMsg = api.NewValueDgram(msg.UID(), api.RespOk, valuedata)
 		}
 	}
-	protocol.ReplyToGet(handler.Conn, recvAddr, replyMsg)
+	protocol.ReplyToGet(handler.Conn, recvAddr, handler.Cache, replyMsg)
 }
 
 func HandlePut(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
@@ -105,13 +117,17 @@ func HandlePut(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr)
 
 	printReplicaKeyHandleMsg(keyValMsg.Key, node.GetProcessNode())
 
-	mostUpToDate := execQuorum(api.CmdGetTimestamp, msg, handler, -1 /*timestamp not used */)
-	if mostUpToDate == nil {
-		// timeout
-		return
+	var mostUpToDate *store.StoreVal
+	if isRaftMode() {
+		mostUpToDate = execRaft(api.CmdPut, keyValMsg.Key, keyValMsg.Value, 0)
+	} else {
+		timestamp, _ := writeTimestamp(msg, handler)
+		if timestamp < 0 {
+			// timeout
+			return
+		}
+		mostUpToDate = execQuorum(api.CmdPut, msg, handler, timestamp)
 	}
-
-	mostUpToDate = execQuorum(api.CmdPut, msg, handler, mostUpToDate.Timestamp)
 	var replyMsg api.Message
 	if mostUpToDate != nil {
 		replyMsg = api.NewValueDgram(msg.UID(), api.RespOk, make([]byte, 0, 0))
@@ -131,27 +147,80 @@ func HandleRemove(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAdd
 		keyMsg.Key = convertClientKey(keyMsg.Key)
 	}
 	printReplicaKeyHandleMsg(keyMsg.Key, node.GetProcessNode())
-	mostUpToDate := execQuorum(api.CmdGetTimestamp, keyMsg, handler, -1 /*timestamp not used */)
-	if !mostUpToDate.Active {
-		replyMsg := api.NewBaseDgram(msg.UID(), api.RespInvalidKey)
-		protocol.ReplyToRemove(handler.Conn, recvAddr, handler.Cache, replyMsg)
-		return
+	var mostUpToDate *store.StoreVal
+	if isRaftMode() {
+		mostUpToDate = execRaft(api.CmdRemove, keyMsg.Key, nil, 0)
+	} else {
+		var timestamp int64
+		timestamp, mostUpToDate = writeTimestamp(keyMsg, handler)
+		if timestamp < 0 {
+			// timeout
+			return
+		}
+		if mostUpToDate != nil && !mostUpToDate.Active {
+			replyMsg := api.NewBaseDgram(msg.UID(), api.RespInvalidKey)
+			protocol.ReplyToRemove(handler.Conn, recvAddr, handler.Cache, replyMsg)
+			return
+		}
+		mostUpToDate = execQuorum(api.CmdRemove, keyMsg, handler, timestamp)
 	}
-
-	mostUpToDate = execQuorum(api.CmdRemove, keyMsg, handler, mostUpToDate.Timestamp)
 	if mostUpToDate != nil {
-		replyMsg := api.NewValueDgram(msg.UID(), api.RespOk, make([]byte, 0, 0))
+		var replyMsg api.Message
+		if mostUpToDate.Active {
+			replyMsg = api.NewValueDgram(msg.UID(), api.RespOk, make([]byte, 0, 0))
+		} else {
+			// None of the replicas had the key
+			replyMsg = api.NewBaseDgram(msg.UID(), api.RespInvalidKey)
+		}
 		protocol.ReplyToRemove(handler.Conn, recvAddr, handler.Cache, replyMsg)
 	}
 }
 
+/* Returns the timestamp to write msg's key with, or -1 on timeout.
+ * By default this is a new timestamp from this node's clock.
+ * With TwoPhaseWrites configured, the replicas are first queried for their
+ * timestamps, and the most up to date value found is also returned.
+ */
+func writeTimestamp(msg api.Message, handler *MessageHandler) (int64, *store.StoreVal) {
+	if !config.GetConfig().TwoPhaseWrites {
+		return node.GetProcessNode().Clock.Now(), nil
+	}
+	mostUpToDate := execQuorum(api.CmdGetTimestamp, msg, handler, -1 /*timestamp not used */)
+	if mostUpToDate == nil {
+		return -1, nil
+	}
+	return mostUpToDate.Timestamp, mostUpToDate
+}
+
+// Handles a put or remove sent to this node while standing in for an
+// unreachable replica. The key is recorded, to be handed off to the replica later.
+func HandleIntraHintedWrite(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	keyValueMsg := msg.(*api.KeyValueDgram)
+	owner, err := protocol.ParseHintOwner(keyValueMsg.Value)
+	if err != nil {
+		log.E.Println(err)
+		replyMsg := api.NewBaseDgram(msg.UID(), api.RespMalformedDatagram)
+		protocol.ReplyCached(handler.Conn, recvAddr, handler.Cache, replyMsg)
+		return
+	}
+	node.GetProcessNode().Hints.Add(owner, keyValueMsg.Key)
+	intraDataWrite(handler, msg, recvAddr, true)
+}
+
 func HandleIntraRemove(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
 	//this is a wrapper function that calls intraDataWrite
 	IntraDataWrite(handler, msg, recvAddr)
 }
 
-//handle internal writting, called by HandleInternalPut and HandleInternalRemove
+// handle internal writting, called by HandleInternalPut and HandleInternalRemove
 func IntraDataWrite(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	intraDataWrite(handler, msg, recvAddr, false)
+}
+
+// A hinted remove stores a tombstone even if this node does not have the key,
+// so that the removal is handed off to the key's replica.
+func intraDataWrite(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr,
+	hinted bool) {
 	keyValueMsg := msg.(*api.KeyValueDgram)
 	thisNode := node.GetProcessNode()
 
@@ -169,14 +238,37 @@ func IntraDataWrite(handler *MessageHandler, msg api.Message, recvAddr *net.UDPA
 		return
 	}
 	putData := storeVal.Active
+	thisNode.Clock.Update(storeVal.Timestamp)
 
-	if putData == true {
-		log.I.Printf("Putting value with key %v\n", keyValueMsg.Key)
-		err = thisNode.Store.Put(keyValueMsg.Key, storeVal.Val, storeVal.Timestamp)
-	} else {
-		log.I.Printf("Removing value with key %v\n", keyValueMsg.Key)
-		err = thisNode.Store.Remove(keyValueMsg.Key, storeVal.Timestamp)
-		storeVal = &store.StoreVal{Val: make([]byte, 0), Active: false, Timestamp: storeVal.Timestamp}
+	write := func() {
+		if putData == true {
+			log.I.Printf("Putting value with key %v\n", keyValueMsg.Key)
+			err = thisNode.Store.Put(keyValueMsg.Key, storeVal.Val, storeVal.Timestamp)
+		} else {
+			log.I.Printf("Removing value with key %v\n", keyValueMsg.Key)
+			if hinted {
+				thisNode.Store.Tombstone(keyValueMsg.Key, storeVal.Timestamp)
+			} else {
+				err = thisNode.Store.Remove(keyValueMsg.Key, storeVal.Timestamp)
+			}
+		}
+	}
+	if hinted {
+		// Stand-ins are not transaction participants, so hold no locks
+		write()
+	} else if !writeUnlocked(keyValueMsg.Key, write) {
+		log.I.Printf("Key %v locked by a transaction\n", keyValueMsg.Key)
+		replyMsg := api.NewOverloadDgram(msg.UID(), txLockWait)
+		if putData == true {
+			protocol.ReplyToPut(handler.Conn, recvAddr, handler.Cache, replyMsg)
+		} else {
+			protocol.ReplyToRemove(handler.Conn, recvAddr, handler.Cache, replyMsg)
+		}
+		return
+	}
+	if putData != true {
+		// we return Active: True to signal to the routing node that the write was successful.
+		storeVal = &store.StoreVal{Val: make([]byte, 0), Active: true, Timestamp: storeVal.Timestamp}
 	}
 
 	var replyMsg api.Message
@@ -205,7 +297,29 @@ func IntraDataWrite(handler *MessageHandler, msg api.Message, recvAddr *net.UDPA
 
 }
 
-func execQuorum(cmd byte, msg api.Message, handler *MessageHandler, timestamp int) *store.StoreVal {
+// How long a plain write waits for a prepared transaction holding a lock on
+// its key to finish, before failing
+const txLockWait = time.Millisecond * 200
+
+var errKeyLocked = errors.New("Key locked by a transaction")
+
+// Runs the put or remove of key on this node, unless a transaction holds it.
+// Returns false if it did not run.
+func writeUnlocked(key store.Key, write func()) bool {
+	return node.GetProcessNode().Txns.WriteUnlocked(key, txLockWait, write)
+}
+
+func execQuorum(cmd byte, msg api.Message, handler *MessageHandler, timestamp int64) *store.StoreVal {
+	return execQuorumAtLeast(cmd, msg, handler, timestamp, 0)
+}
+
+/* Runs the command on the key's replicas, and returns the most up to date
+ * value once a quorum has answered, or nil if no quorum answers.
+ * While the newest value received is older than minVersion, the remaining
+ * replicas are waited for too. The caller must check the returned version.
+ */
+func execQuorumAtLeast(cmd byte, msg api.Message, handler *MessageHandler, timestamp int64,
+	minVersion int64) *store.StoreVal {
 	var key store.Key
 	if msg.Command() == api.CmdPut {
 		key = msg.(*api.KeyValueDgram).Key
@@ -213,26 +327,49 @@ func execQuorum(cmd byte, msg api.Message, handler *MessageHandler, timestamp in
 		key = msg.(*api.KeyDgram).Key
 	}
 	thisNode := node.GetProcessNode()
-	replicaIds := thisNode.GetReplicaIdsForKey(key)
-	respChan := make(chan *replicaData, config.GetConfig().MaxReplicas)
+	// Route against one ring, even if the membership changes meanwhile
+	ring := thisNode.Ring()
+	var replicaIds []store.Key
+	if config.GetConfig().SloppyQuorum {
+		replicaIds = ring.PreferredReplicas(key, config.GetConfig().MaxReplicas)
+	} else {
+		replicaIds = ring.Replicas(key, config.GetConfig().MaxReplicas)
+	}
+	respChan := make(chan *replicaData, len(replicaIds))
 	receivedCount := 0
-	for _, replica := range replicaIds {
-		if replica == thisNode.ID {
-			go channeledLocalCommand(respChan, cmd, msg, timestamp)
-		} else {
-			go channeledRemoteCommand(respChan, cmd, handler, replica, msg, timestamp)
+	if config.GetConfig().SloppyQuorum {
+		standInIds := ring.StandIns(key, replicaIds)
+		standIns := make(chan store.Key, len(standInIds))
+		for _, standIn := range standInIds {
+			standIns <- standIn
+		}
+		for _, replica := range replicaIds {
+			go channeledSloppyCommand(respChan, standIns, cmd, handler, replica, key, msg, timestamp)
+		}
+	} else {
+		for _, replica := range replicaIds {
+			if replica == thisNode.ID {
+				go channeledLocalCommand(respChan, cmd, msg, timestamp, false)
+			} else {
+				go channeledRemoteCommand(respChan, cmd, handler, replica, nil, msg, timestamp)
+			}
 		}
 	}
 
 	receivedStoreVals := make([]*store.StoreVal, 0, len(replicaIds))
 	minOps := minSuccessfulOps(len(replicaIds))
-	for receivedCount < len(replicaIds) && len(receivedStoreVals) < minOps {
+	newest := int64(-1)
+	for receivedCount < len(replicaIds) &&
+		(len(receivedStoreVals) < minOps || newest < minVersion) {
 		data := <-respChan
 		if data.Err != nil {
 			log.I.Printf("Failed get from %s: %s", keyString(replicaIds[receivedCount]), data.Err)
 		} else {
 			log.I.Println("Receive successful")
 			receivedStoreVals = append(receivedStoreVals, data.Val)
+			if data.Val.Timestamp > newest {
+				newest = data.Val.Timestamp
+			}
 		}
 		receivedCount++
 	}
@@ -256,7 +393,11 @@ func execQuorum(cmd byte, msg api.Message, handler *MessageHandler, timestamp in
 
 }
 
-func channeledLocalCommand(channel chan *replicaData, cmd byte, msg api.Message, timestamp int) {
+/* Runs the command on this node's store.
+ * A hinted write is one this node holds as a stand-in for another replica.
+ */
+func channeledLocalCommand(channel chan *replicaData, cmd byte, msg api.Message, timestamp int64,
+	hinted bool) {
 	var key store.Key
 	if msg.Command() == api.CmdPut {
 		key = msg.(*api.KeyValueDgram).Key
@@ -276,12 +417,28 @@ func channeledLocalCommand(channel chan *replicaData, cmd byte, msg api.Message,
 		channel <- &replicaData{Val: value, Err: nil}
 	case api.CmdPut:
 		log.I.Printf("Putting value with key %v\n", key)
-		err := node.GetProcessNode().Store.Put(key, msg.(*api.KeyValueDgram).Value, timestamp)
+		var err error
+		if !writeUnlocked(key, func() {
+			err = node.GetProcessNode().Store.Put(key, msg.(*api.KeyValueDgram).Value, timestamp)
+		}) {
+			channel <- &replicaData{Err: errKeyLocked}
+			return
+		}
 		value, _ := node.GetProcessNode().Store.Get(key)
 		channel <- &replicaData{Val: value, Err: err}
 	case api.CmdRemove:
 		log.I.Printf("Removing value with key %v\n", key)
-		err := node.GetProcessNode().Store.Remove(key, timestamp)
+		var err error
+		if hinted {
+			// The stand-in may not hold the key, but must keep the delete
+			// to hand it back. Stand-ins are not transaction participants.
+			node.GetProcessNode().Store.Tombstone(key, timestamp)
+		} else if !writeUnlocked(key, func() {
+			err = node.GetProcessNode().Store.Remove(key, timestamp)
+		}) {
+			channel <- &replicaData{Err: errKeyLocked}
+			return
+		}
 		if err != nil {
 			// Simulate an absent key with no priority
 			// This way, it is a valid response, to differentiate between
@@ -306,19 +463,79 @@ func channeledLocalCommand(channel chan *replicaData, cmd byte, msg api.Message,
 
 }
 
+/* Runs the command on the replica, for a sloppy quorum.
+ * If the replica is unreachable, the command is retried on the next
+ * stand-in node taken from standIns. Writes to a stand-in are hinted with the
+ * replica's id, so that they can be handed back to it once it returns.
+ */
+func channeledSloppyCommand(channel chan *replicaData, standIns chan store.Key, cmd byte,
+	handler *MessageHandler, replica store.Key, key store.Key, msg api.Message, timestamp int64) {
+	thisNode := node.GetProcessNode()
+	var hintOwner *store.Key
+	target := replica
+	for {
+		attempt := make(chan *replicaData, 1)
+		if target == thisNode.ID {
+			channeledLocalCommand(attempt, cmd, msg, timestamp, hintOwner != nil)
+		} else if peer, ok := thisNode.GetPeer(target); !ok || !peer.Online {
+			attempt <- &replicaData{Unreachable: true,
+				Err: errors.New(fmt.Sprintf("Node %s is offline", target.String()))}
+		} else {
+			channeledRemoteCommand(attempt, cmd, handler, target, hintOwner, msg, timestamp)
+		}
+		data := <-attempt
+
+		if data.Err == nil && hintOwner != nil && target == thisNode.ID &&
+			(cmd == api.CmdPut || cmd == api.CmdRemove) {
+			thisNode.Hints.Add(*hintOwner, key)
+		}
+		if !data.Unreachable {
+			channel <- data
+			return
+		}
+		select {
+		case standIn := <-standIns:
+			log.I.Printf("Replica %s unreachable. Trying stand-in %s\n",
+				replica.String(), standIn.String())
+			target = standIn
+			hintOwner = &replica
+		default:
+			// No stand-ins left
+			channel <- data
+			return
+		}
+	}
+}
+
+/* Runs the command on the remote replica.
+ * If hintOwner is not nil, the replica is standing in for hintOwner.
+ */
 func channeledRemoteCommand(channel chan *replicaData, cmd byte, handler *MessageHandler,
-	remotePeerKey store.Key, msg api.Message, timestamp int) {
+	remotePeerKey store.Key, hintOwner *store.Key, msg api.Message, timestamp int64) {
 	thisNode := node.GetProcessNode()
-	peer := thisNode.KnownPeers[remotePeerKey]
+	peer, ok := thisNode.GetPeer(remotePeerKey)
+	if !ok {
+		channel <- &replicaData{Unreachable: true,
+			Err: errors.New(fmt.Sprintf("Node %s is unknown", remotePeerKey.String()))}
+		return
+	}
 	var storeVal *store.StoreVal
 	var replyMsg api.Message
 	switch cmd {
 	case api.CmdGet:
 		replyMsg = protocol.IntraNodeGet(peer.Addr.String(), msg)
 	case api.CmdPut:
-		replyMsg = protocol.IntraNodePut(peer.Addr.String(), msg, timestamp)
+		if hintOwner != nil {
+			replyMsg = protocol.IntraNodeHintedPut(peer.Addr.String(), msg, timestamp, *hintOwner)
+		} else {
+			replyMsg = protocol.IntraNodePut(peer.Addr.String(), msg, timestamp)
+		}
 	case api.CmdRemove:
-		replyMsg = protocol.IntraNodeRemove(peer.Addr.String(), msg, timestamp)
+		if hintOwner != nil {
+			replyMsg = protocol.IntraNodeHintedRemove(peer.Addr.String(), msg, timestamp, *hintOwner)
+		} else {
+			replyMsg = protocol.IntraNodeRemove(peer.Addr.String(), msg, timestamp)
+		}
 	case api.CmdGetTimestamp:
 		replyMsg = protocol.IntraNodeGetTimestamp(peer.Addr.String(), msg)
 	default:
@@ -329,6 +546,9 @@ func channeledRemoteCommand(channel chan *replicaData, cmd byte, handler *Messag
 		if replyMsg.Command() == api.RespOk || replyMsg.Command() == api.RespOkTimestamp {
 			valMsg := replyMsg.(*api.ValueDgram)
 			retErr = json.Unmarshal(valMsg.Value, &storeVal)
+			if retErr == nil {
+				thisNode.Clock.Update(storeVal.Timestamp)
+			}
 		} else if replyMsg.Command() == api.RespInvalidKey {
 			// Simulate an absent key with no priority
 			// This way, it is a valid response, to differentiate between
@@ -340,10 +560,15 @@ func channeledRemoteCommand(channel chan *replicaData, cmd byte, handler *Messag
 				replyMsg.Command(), remotePeerKey.String()))
 		}
 	} else { // Timeout occured
-		thisNode.SetPeerOffline(remotePeerKey)
-		protocol.InitMembershipGossip(handler.Conn, &remotePeerKey, peer)
+		// A single timeout may just be a dropped packet.
+		// The failure detector decides whether the peer really failed
+		if update := thisNode.SuspectPeer(remotePeerKey); update != nil {
+			protocol.GossipSwimUpdate(handler.Conn, update, peer.Addr)
+		}
 		retErr = errors.New(fmt.Sprintf("Timeout on node %s",
 			remotePeerKey.String()))
+		channel <- &replicaData{Err: retErr, Unreachable: true}
+		return
 	}
 	channel <- &replicaData{Val: storeVal, Err: retErr}
 
@@ -370,7 +595,7 @@ func HandleGetTimestamp(handler *MessageHandler, msg api.Message, recvAddr *net.
 			replyMsg = api.NewValueDgram(msg.UID(), api.RespOkTimestamp, valuedata)
 		}
 	}
-	protocol.ReplyToGetTimestamp(handler.Conn, recvAddr, replyMsg)
+	protocol.ReplyToGetTimestamp(handler.Conn, recvAddr, handler.Cache, replyMsg)
 
 }
 
@@ -378,7 +603,8 @@ func HandleStatusUpdate(handler *MessageHandler, msg api.Message, recvAddr *net.
 	conf := config.GetConfig()
 	log.D.Println("Status Update handle called")
 	keyValMsg := msg.(*api.KeyValueDgram)
-	if handler.IsNewMessage(keyValMsg.UID()) {
+	isNew, gossip := handler.SeeMessage(keyValMsg.UID())
+	if isNew {
 		dataDelimiter := "\t\n\t\n"
 		// TODO handle failures properly
 		// Commented out all the identifiers because it was easier to create the html
@@ -391,10 +617,18 @@ func HandleStatusUpdate(handler *MessageHandler, msg api.Message, recvAddr *net.
 		//uptime = "Uptime:\n" + uptime
 		success, currentload := exec.CurrentLoad()
 		//currentload = "Current load:\n" + currentload
-		protocol.ReplyToStatusUpdateServer(handler.Conn, conf.StatusServerAddr, handler.Cache, msg, []byte(deploymentSpace+dataDelimiter+diskSpace+dataDelimiter+uptime+dataDelimiter+currentload), success)
+		queueDepth := ""
+		if pool := protocol.GetWorkerPool(); pool != nil {
+			queueDepth = fmt.Sprintf("%d/%d, %d peer messages dropped",
+				pool.QueueDepth(), pool.QueueSize(), pool.PeerDropped())
+		}
+		stats := handler.Cache.Stats()
+		replyCache := fmt.Sprintf("%d hits, %d misses, %d evictions",
+			stats.Hits, stats.Misses, stats.Evictions)
+		protocol.ReplyToStatusUpdateServer(handler.Conn, conf.StatusServerAddr, handler.Cache, msg, []byte(deploymentSpace+dataDelimiter+diskSpace+dataDelimiter+uptime+dataDelimiter+currentload+dataDelimiter+queueDepth+dataDelimiter+replyCache), success)
 	}
 
-	if handler.ShouldGossip(keyValMsg.UID()) {
+	if gossip {
 		protocol.Gossip(handler.Conn, keyValMsg)
 	}
 }
@@ -402,12 +636,15 @@ func HandleStatusUpdate(handler *MessageHandler, msg api.Message, recvAddr *net.
 func HandleAdhocUpdate(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
 	conf := config.GetConfig()
 	keyValMsg := msg.(*api.KeyValueDgram)
-	if handler.IsNewMessage(keyValMsg.UID()) {
+	// Checked and recorded at once, so that the command runs only once
+	// however many copies of the message arrive together
+	isNew, gossip := handler.SeeMessage(keyValMsg.UID())
+	if isNew {
 		success, status := exec.RunCommand(string(keyValMsg.Value))
 		protocol.ReplyToStatusUpdateServer(handler.Conn, conf.StatusServerAddr, handler.Cache, msg, []byte(status), success)
 	}
 
-	if handler.ShouldGossip(keyValMsg.UID()) {
+	if gossip {
 		protocol.Gossip(handler.Conn, keyValMsg)
 	}
 }
@@ -415,8 +652,12 @@ func HandleAdhocUpdate(handler *MessageHandler, msg api.Message, recvAddr *net.U
 func HandleMembershipMsgExchange(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
 	handleMembership(msg, recvAddr)
 	thisNode := node.GetProcessNode()
-	protocol.SendMembershipMsg(handler.Conn, recvAddr,
-		thisNode.ID, thisNode.KnownPeers, api.CmdMembership)
+	if thisNode.IsLeaving() {
+		// Replying would bring this node back online for the sender
+		return
+	}
+	senderId := store.Key(msg.(*api.KeyValueDgram).Key)
+	protocol.SendMembershipMsg(handler.Conn, recvAddr, &senderId, api.CmdMembership)
 }
 
 func HandleMembershipMsg(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
@@ -432,7 +673,7 @@ func HandleMembershipFailureGossip(handler *MessageHandler, msg api.Message, rec
 
 func HandleMembershipQuery(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
 	err := protocol.ReplyToMembershipQuery(handler.Conn, recvAddr, handler.Cache,
-		msg, node.GetProcessNode().ID, node.GetProcessNode().KnownPeers)
+		msg, node.GetProcessNode().ID)
 	if err != nil {
 		log.E.Println(err)
 	}
@@ -447,9 +688,15 @@ func handleMembership(msg api.Message, recvAddr *net.UDPAddr) {
 			log.E.Println(err)
 		} else {
 			thisNode := node.GetProcessNode()
-			thisNode.UpdatePeers(peers.PointerMap(), nodeId, recvAddr)
+			sender := &node.Peer{Addr: recvAddr, Incarnation: peers.Incarnation,
+				Weight: peers.Weight, Zone: peers.Zone,
+				SeenVersion: peers.Version, AckedVersion: peers.Ack}
+			refutation := thisNode.UpdatePeers(peers.PointerMap(), nodeId, sender)
+			if refutation != nil {
+				protocol.GossipSwimUpdate(thisNode.Conn, refutation, recvAddr)
+			}
 			//log.D.Printf("Currently known peers: [\n%s\n]\n",
-			//	node.PeerListString(thisNode.KnownPeers))
+			//	thisNode.PeerListString())
 		}
 	} else {
 		log.E.Println("Received invalid membership datagram")
@@ -462,20 +709,56 @@ func HandleShutdown(handler *MessageHandler, msg api.Message, recvAddr *net.UDPA
 	log.I.Fatal("Shutdown Command recieved, aborting program")
 }
 
+// Hands this node's keys off to the nodes taking over its ranges, then exits.
+// Replies as soon as the decommission starts. The hand off runs in the background.
+func HandleDecommission(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	replyMsg := api.NewValueDgram(msg.UID(), api.RespOk, make([]byte, 0, 0))
+	protocol.ReplyCached(handler.Conn, recvAddr, handler.Cache, replyMsg)
+	decommission(handler)
+}
+
+func decommission(handler *MessageHandler) {
+	thisNode := node.GetProcessNode()
+	update, wasLeaving := thisNode.StartDecommission()
+	log.I.Println("Decommissioning node")
+	// Tell every peer directly, so that they stop routing to this node
+	peers := thisNode.OnlinePeers()
+	if err := protocol.BroadcastSwimUpdate(handler.Conn, update, peers); err != nil {
+		log.E.Println(err)
+	}
+
+	if wasLeaving {
+		// Already handing off. Only announced again
+		return
+	}
+	go thisNode.Decommission(func() {
+		log.I.Println("Handed off all keys. Exiting")
+		os.Exit(0)
+	})
+}
+
 func HandleStorePush(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
 	valueMsg := msg.(*api.ValueDgram)
-	keyVals, err := protocol.ParseStorePushMsgValue(valueMsg.Value)
+	keyVals, cursor, err := protocol.ParseStorePushMsgValue(valueMsg.Value)
 	if err != nil {
 		log.E.Println("Failed to parse incoming store push data")
 		return
 	}
 
-	// for now, receiving this message will just cause this node to store all the contents regardless of key range. Key overflow is not an issue now
-	nodeStore := node.GetProcessNode().Store
+	// Only keep keys this node is a replica for, and never overwrite newer versions
+	thisNode := node.GetProcessNode()
+	rejected := []store.Key{}
 	for key, val := range keyVals {
-		nodeStore.PutDirect(key, val)
+		if thisNode.IsReplicaForKey(key) {
+			thisNode.Store.Merge(key, val)
+		} else {
+			rejected = append(rejected, key)
+		}
+	}
+	if len(rejected) > 0 {
+		log.I.Printf("Rejected %d pushed keys this node is not a replica for\n", len(rejected))
 	}
-	protocol.ReplyToStorePush(handler.Conn, recvAddr, handler.Cache, msg)
+	protocol.ReplyToStorePush(handler.Conn, recvAddr, handler.Cache, msg, cursor, rejected)
 }
 
 // Do nothing. Need to avoid unknown command cyles.
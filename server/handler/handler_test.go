@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/tsiemens/kvstore/server/config"
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/server/protocol"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"github.com/tsiemens/kvstore/shared/util"
+)
+
+func init() {
+	log.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard)
+}
+
+const testConfig = `{
+  "K": 4,
+  "MaxReplicas": 3,
+  "NodeTimeout": 300000000000,
+  "StatusServerPort": 6667
+}`
+
+var testNodeOnce sync.Once
+var testNodeAddr string
+
+/* Starts this process's node, alone in its cluster, receiving on a localhost
+ * socket. Returns the address to send it messages at.
+ * The node is shared by all tests.
+ */
+func startTestNode(t *testing.T) string {
+	testNodeOnce.Do(func() {
+		dir, err := ioutil.TempDir("", "kvstore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "config.json")
+		if err := ioutil.WriteFile(path, []byte(testConfig), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config.Init(path, true)
+		os.RemoveAll(dir)
+
+		conn, localAddr, err := util.CreateUDPSocket(true, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.Init(localAddr, conn, store.New(), protocol.SendKeyValuesToNode)
+		go protocol.LoopReceiver(conn, NewDefaultMessageHandler(conn, 0))
+		testNodeAddr = conn.LocalAddr().(*net.UDPAddr).String()
+	})
+	if testNodeAddr == "" {
+		t.Fatal("Test node failed to start")
+	}
+	return testNodeAddr
+}
+
+func newTestUID() [16]byte {
+	return api.NewMessageUID(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+}
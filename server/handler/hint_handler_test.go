@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/server/protocol"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+)
+
+func TestHintedRemoveStoresTombstone(t *testing.T) {
+	addr := startTestNode(t)
+	thisNode := node.GetProcessNode()
+	owner := store.Key{0x10}
+	key := store.Key{0x42, 0x01}
+
+	msg := api.NewKeyDgram(newTestUID(), api.CmdRemove, key)
+	reply := protocol.IntraNodeHintedRemove(addr, msg, 7, owner)
+	if reply == nil || reply.Command() != api.RespOk {
+		t.Fatal("Hinted remove of a missing key failed")
+	}
+	if v, err := thisNode.Store.Get(key); err != nil || v.Active || v.Timestamp != 7 {
+		t.Fatal("No tombstone stored for the hinted remove")
+	}
+	held := thisNode.Hints.Take(owner)
+	if len(held) != 1 || held[0] != key {
+		t.Fatal("Hinted key not recorded for its owner")
+	}
+}
+
+func TestLocalStandInRemoveStoresTombstone(t *testing.T) {
+	startTestNode(t)
+	thisNode := node.GetProcessNode()
+	key := store.Key{0x42, 0x03}
+
+	result := make(chan *replicaData, 1)
+	channeledLocalCommand(result, api.CmdRemove, api.NewKeyDgram(newTestUID(), api.CmdRemove, key), 9, true)
+	if data := <-result; data.Err != nil || !data.Val.Active {
+		t.Fatal("Stand-in remove of a missing key failed")
+	}
+	if v, err := thisNode.Store.Get(key); err != nil || v.Active || v.Timestamp != 9 {
+		t.Fatal("No tombstone stored for the stand-in remove")
+	}
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/server/protocol"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"net"
+)
+
+// Adds the joining node to the ring, and pushes it the keys it now replicates.
+// Replies straight away. The keys are found and pushed in a new goroutine,
+// which reports to the joiner once they are sent.
+func HandleJoinSync(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	keyValMsg := msg.(*api.KeyValueDgram)
+	joiner, err := protocol.ParseJoinMsg(keyValMsg)
+	if err != nil || joiner.Addr == nil {
+		log.E.Println("Received invalid join datagram")
+		return
+	}
+	protocol.ReplyToJoinMsg(handler.Conn, recvAddr, handler.Cache, msg)
+
+	joinerId := store.Key(keyValMsg.Key)
+	log.I.Printf("Peer %s is joining\n", joinerId.String())
+	go pushKeysToJoiner(joinerId, joiner)
+}
+
+func pushKeysToJoiner(joinerId store.Key, joiner *protocol.JoinMsg) {
+	thisNode := node.GetProcessNode()
+	values := thisNode.AddJoiningPeer(joinerId,
+		&node.Peer{Addr: joiner.Addr, Incarnation: joiner.Incarnation, Weight: joiner.Weight,
+			Zone: joiner.Zone})
+	if len(values) > 0 {
+		if _, err := protocol.SendKeyValuesToNode(joinerId, values); err != nil {
+			log.E.Println(err)
+		}
+	}
+	if err := protocol.SendJoinSyncDone(joiner.Addr.String(), thisNode.ID); err != nil {
+		log.E.Println(err)
+	}
+}
+
+func HandleJoinSyncDone(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	protocol.ReplyToJoinMsg(handler.Conn, recvAddr, handler.Cache, msg)
+	node.GetProcessNode().JoinSyncDone(store.Key(msg.(*api.KeyDgram).Key))
+}
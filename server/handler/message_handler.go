@@ -16,11 +16,12 @@ type CmdHandler func(mh *MessageHandler, msg api.Message,
 
 // Implements protocol.MessageHandler (to avoid import loops)
 type MessageHandler struct {
-	Conn              *net.UDPConn
-	cmdHandlers       map[byte]CmdHandler
-	PacketLossPercent int
-	GossipKeyMap      map[string]bool
-	Cache             *cache.Cache
+	Conn        *net.UDPConn
+	cmdHandlers map[byte]CmdHandler
+	chain       CmdHandler     // The middlewares, then dispatch
+	Seen        *cache.SeenSet // UIDs of gossiped messages
+	Cache       *cache.Cache
+	Limiter     *util.RateLimiter // Limits client commands per client IP
 }
 
 func NewDefaultCmdHandlerSet() map[byte]CmdHandler {
@@ -28,10 +29,16 @@ func NewDefaultCmdHandlerSet() map[byte]CmdHandler {
 		api.CmdPut:                     HandlePut,
 		api.CmdGet:                     HandleGet,
 		api.CmdRemove:                  HandleRemove,
+		api.CmdTransaction:             HandleTransaction,
+		api.CmdSessionGet:              HandleSessionGet,
+		api.CmdSessionPut:              HandleSessionPut,
+		api.CmdSessionRemove:           HandleSessionRemove,
 		api.CmdShutdown:                HandleShutdown,
+		api.CmdDecommission:            HandleDecommission,
 		api.CmdIntraPut:                HandleIntraPut,
 		api.CmdIntraGet:                HandleIntraGet,
 		api.CmdIntraRemove:             HandleIntraRemove,
+		api.CmdIntraHintedWrite:        HandleIntraHintedWrite,
 		api.CmdGetTimestamp:            HandleGetTimestamp,
 		api.CmdStatusUpdate:            HandleStatusUpdate,
 		api.CmdAdhocUpdate:             HandleAdhocUpdate,
@@ -41,71 +48,82 @@ func NewDefaultCmdHandlerSet() map[byte]CmdHandler {
 		api.CmdMembershipFailure:       HandleMembershipMsg,
 		api.CmdMembershipFailureGossip: HandleMembershipFailureGossip,
 		api.CmdStorePush:               HandleStorePush,
+		api.CmdRaftRequestVote:         HandleRaftRequestVote,
+		api.CmdRaftAppendEntries:       HandleRaftAppendEntries,
+		api.CmdRaftPropose:             HandleRaftPropose,
+		api.CmdRaftInstallSnapshot:     HandleRaftInstallSnapshot,
+		api.CmdIntraTxPrepare:          HandleIntraTxPrepare,
+		api.CmdIntraTxDecision:         HandleIntraTxDecision,
+		api.CmdIntraTxStatus:           HandleIntraTxStatus,
+		api.CmdPing:                    HandlePing,
+		api.CmdPingReq:                 HandlePingReq,
+		api.CmdSwimUpdate:              HandleSwimUpdate,
+		api.CmdJoinSync:                HandleJoinSync,
+		api.CmdJoinSyncDone:            HandleJoinSyncDone,
 		api.RespUnknownCommand:         HandleUnknownCommand,
 	}
 }
 
-func (handler *MessageHandler) IsNewMessage(key [16]byte) bool {
-	if _, ok := handler.GossipKeyMap[string(key[:])]; ok {
-		return false
-	}
-	return true
+// Client commands, which this node only coordinates once it has joined
+var coordinatorCmds = map[byte]bool{
+	api.CmdPut:           true,
+	api.CmdGet:           true,
+	api.CmdRemove:        true,
+	api.CmdTransaction:   true,
+	api.CmdSessionGet:    true,
+	api.CmdSessionPut:    true,
+	api.CmdSessionRemove: true,
+}
+
+// Records the gossiped message with key as seen. Returns whether it is new,
+// and whether to gossip it on
+func (handler *MessageHandler) SeeMessage(key [16]byte) (bool, bool) {
+	return handler.Seen.See(key, config.GetConfig().K)
 }
 
 func (handler *MessageHandler) ShouldGossip(key [16]byte) bool {
-	conf := config.GetConfig()
-	if shouldGossip, ok := handler.GossipKeyMap[string(key[:])]; ok {
-		if shouldGossip {
-			if util.Rand.Intn(conf.K) == conf.K-1 {
-				handler.GossipKeyMap[string(key[:])] = false
-				return false
-			} else {
-				return true
-			}
-		} else {
-			return false
-		}
-	} else {
-		handler.GossipKeyMap[string(key[:])] = true
-		return true
-	}
+	return handler.Seen.ShouldGossip(key, config.GetConfig().K)
 }
 
 func NewDefaultMessageHandler(conn *net.UDPConn, lossPercent int) *MessageHandler {
 	return NewMessageHandler(conn,
-		NewDefaultCmdHandlerSet(), lossPercent)
+		NewDefaultCmdHandlerSet(), DefaultMiddlewares(lossPercent)...)
 }
 
+// Builds a handler which runs each message through the middlewares,
+// in order, before dispatching it to its command's handler.
 func NewMessageHandler(conn *net.UDPConn,
-	cmdHandlers map[byte]CmdHandler, lossPercent int) *MessageHandler {
+	cmdHandlers map[byte]CmdHandler, middlewares ...Middleware) *MessageHandler {
+	limiter := util.NewRateLimiter(0, 0)
+	cacheEntries, cacheBytes := config.DefaultReplyCacheEntries, config.DefaultReplyCacheBytes
+	seen := cache.NewSeenSet(config.DefaultGossipRetention, config.DefaultGossipMaxSeen)
+	if conf := config.GetConfig(); conf != nil {
+		limiter = util.NewRateLimiter(conf.ClientRateLimit, conf.ClientRateBurst)
+		cacheEntries, cacheBytes = conf.ReplyCacheEntries, conf.ReplyCacheBytes
+		seen = cache.NewSeenSet(conf.GossipRetention, conf.GossipMaxSeen)
+	}
+	// Built once, since each cache collects its garbage in a goroutine of its own
+	replyCache := cache.New(cacheEntries, cacheBytes)
 	return &MessageHandler{
-		Conn:              conn,
-		cmdHandlers:       cmdHandlers,
-		PacketLossPercent: lossPercent % 101,
-		GossipKeyMap:      make(map[string]bool, 0),
-		Cache:             cache.New(),
+		Conn:        conn,
+		cmdHandlers: cmdHandlers,
+		chain:       Chain(dispatch, middlewares...),
+		Seen:        seen,
+		Cache:       replyCache,
+		Limiter:     limiter,
 	}
 }
 
-func (handler *MessageHandler) isPacketLost() bool {
-	return util.Rand.Int()%100 < handler.PacketLossPercent
-}
-
 func (handler *MessageHandler) HandleMessage(msg api.Message, recvAddr *net.UDPAddr) {
-	if handler.PacketLossPercent != 0 && handler.isPacketLost() {
-		log.D.Println("Opps! Packet dropped!")
-		return
-	}
+	handler.chain(handler, msg, recvAddr)
+}
 
-	if wasCached, cachedReply := handler.Cache.StoreAndGetReply(msg); wasCached {
-		log.D.Println("Cached message received")
-		if cachedReply != nil {
-			log.D.Println("Replying with cached reply")
-			handler.Conn.WriteTo(cachedReply.Bytes(), recvAddr)
-		}
-		return
-	}
+func (handler *MessageHandler) IsClientCommand(cmd byte) bool {
+	return coordinatorCmds[cmd]
+}
 
+// Runs the handler of msg's command
+func dispatch(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
 	log.D.Println("Handling!")
 	if cmdHandler, ok := handler.cmdHandlers[msg.Command()]; ok {
 		cmdHandler(handler, msg, recvAddr)
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"github.com/tsiemens/kvstore/shared/util"
+	"net"
+)
+
+/* Middleware wraps the handling of every received message, before it is
+ * dispatched to its command's handler. It may observe the message, answer or
+ * drop it itself, or pass it on to next.
+ */
+type Middleware func(next CmdHandler) CmdHandler
+
+// Returns handler wrapped in the middlewares. The first is run first.
+func Chain(handler CmdHandler, middlewares ...Middleware) CmdHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// The middlewares of a node: fault injection, the join gate, the reply
+// cache and rate limiting, in that order. Retries of answered requests get
+// their cached reply without counting against the rate limit.
+func DefaultMiddlewares(lossPercent int) []Middleware {
+	return []Middleware{
+		PacketLoss(lossPercent),
+		WaitForJoin,
+		ReplyCache,
+		RateLimit,
+	}
+}
+
+// Drops percent of the messages at random, to simulate a lossy network
+func PacketLoss(percent int) Middleware {
+	percent = percent % 101
+	return func(next CmdHandler) CmdHandler {
+		return func(mh *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+			if percent != 0 && util.Rand.Int()%100 < percent {
+				log.D.Println("Opps! Packet dropped!")
+				return
+			}
+			next(mh, msg, recvAddr)
+		}
+	}
+}
+
+// Drops client commands until this node has joined the cluster
+func WaitForJoin(next CmdHandler) CmdHandler {
+	return func(mh *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+		if coordinatorCmds[msg.Command()] && !node.GetProcessNode().IsReady() {
+			// Not cached, so that the client's retries are handled once joined
+			log.D.Println("Not joined yet. Dropping client request")
+			return
+		}
+		next(mh, msg, recvAddr)
+	}
+}
+
+// Replies to client commands over mh.Limiter's rate with an overload reply
+func RateLimit(next CmdHandler) CmdHandler {
+	return func(mh *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+		if coordinatorCmds[msg.Command()] {
+			// Clients send each request from a new port, so only the IP identifies them
+			if ok, retryAfter := mh.Limiter.Allow(recvAddr.IP.String()); !ok {
+				log.D.Printf("Rate limiting %v. Retry after %v\n", recvAddr, retryAfter)
+				// Forgets the message in the cache, so that its retry is handled
+				mh.Cache.SendReply(mh.Conn, api.NewOverloadDgram(msg.UID(), retryAfter), recvAddr)
+				return
+			}
+		}
+		next(mh, msg, recvAddr)
+	}
+}
+
+// Handles each message once. Duplicates get the cached reply,
+// or are dropped if the message is still being handled.
+func ReplyCache(next CmdHandler) CmdHandler {
+	return func(mh *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+		if wasCached, cachedReply := mh.Cache.StoreAndGetReply(msg); wasCached {
+			log.D.Println("Cached message received")
+			if cachedReply != nil {
+				log.D.Println("Replying with cached reply")
+				mh.Conn.WriteTo(cachedReply.Bytes(), recvAddr)
+			}
+			return
+		}
+		next(mh, msg, recvAddr)
+	}
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"net"
+	"testing"
+
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/util"
+)
+
+func recordingMiddleware(name string, calls *[]string, pass bool) Middleware {
+	return func(next CmdHandler) CmdHandler {
+		return func(mh *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+			*calls = append(*calls, name)
+			if pass {
+				next(mh, msg, recvAddr)
+			}
+		}
+	}
+}
+
+func TestMiddlewaresRunInOrder(t *testing.T) {
+	calls := []string{}
+	cmdHandlers := map[byte]CmdHandler{
+		api.CmdGet: func(mh *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+			calls = append(calls, "handler")
+		},
+	}
+	msg := api.NewKeyDgram([16]byte{}, api.CmdGet, [32]byte{})
+
+	h := NewMessageHandler(nil, cmdHandlers,
+		recordingMiddleware("a", &calls, true), recordingMiddleware("b", &calls, true))
+	h.HandleMessage(msg, nil)
+	if len(calls) != 3 || calls[0] != "a" || calls[1] != "b" || calls[2] != "handler" {
+		t.Fatal("Unexpected calls", calls)
+	}
+
+	calls = []string{}
+	h = NewMessageHandler(nil, cmdHandlers,
+		recordingMiddleware("a", &calls, false), recordingMiddleware("b", &calls, true))
+	h.HandleMessage(msg, nil)
+	if len(calls) != 1 {
+		t.Fatal("Message passed on by a middleware which stopped it", calls)
+	}
+}
+
+func TestCachedReplyNotRateLimited(t *testing.T) {
+	startTestNode(t)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	handled := 0
+	cmdHandlers := map[byte]CmdHandler{
+		api.CmdGet: func(mh *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+			handled++
+			reply := api.NewValueDgram(msg.UID(), api.RespOk, []byte("v"))
+			mh.Cache.SendReply(mh.Conn, reply, recvAddr)
+		},
+	}
+	h := NewMessageHandler(conn, cmdHandlers, ReplyCache, RateLimit)
+	h.Limiter = util.NewRateLimiter(0.001, 1)
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	msg := api.NewKeyDgram(newTestUID(), api.CmdGet, [32]byte{})
+	h.HandleMessage(msg, addr)
+	limited := api.NewKeyDgram(newTestUID(), api.CmdGet, [32]byte{})
+	h.HandleMessage(limited, addr)
+	if handled != 1 {
+		t.Fatal("Request over the rate limit handled")
+	}
+	// The retry of the answered request gets its reply, though the client is limited
+	before := h.Cache.Stats().Hits
+	h.HandleMessage(msg, addr)
+	if handled != 1 || h.Cache.Stats().Hits != before+1 {
+		t.Fatal("Retry not answered from the cache")
+	}
+	// The limited request is handled once the client may send again
+	h.Limiter = util.NewRateLimiter(1000, 1)
+	h.HandleMessage(limited, addr)
+	if handled != 2 {
+		t.Fatal("Retry of a rate limited request not handled")
+	}
+}
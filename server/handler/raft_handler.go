@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/server/protocol"
+	"github.com/tsiemens/kvstore/server/raft"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"net"
+)
+
+/* Runs a get, put or remove through the raft group of the key's range.
+ * The proposal goes to this node if it is a member, otherwise to each member
+ * in turn, following leader hints.
+ * Writes are committed with a version newer than minVersion.
+ * Returns nil if no leader could commit the entry.
+ */
+func execRaft(op byte, key store.Key, value []byte, minVersion int64) *store.StoreVal {
+	thisNode := node.GetProcessNode()
+	groupId := thisNode.Ring().RangeID(key)
+	members := thisNode.GetReplicaIdsForKey(groupId)
+	args := &raft.ProposeArgs{
+		Group: groupId,
+		Entry: raft.Entry{Op: op, Key: key, Val: value, Timestamp: minVersion},
+	}
+
+	targets := make([]store.Key, 0, len(members))
+	for _, member := range members {
+		if member == thisNode.ID {
+			targets = append([]store.Key{member}, targets...)
+		} else {
+			targets = append(targets, member)
+		}
+	}
+
+	for attempts := 0; len(targets) > 0 && attempts < len(members)+2; attempts++ {
+		target := targets[0]
+		targets = targets[1:]
+		var reply *raft.ProposeReply
+		if target == thisNode.ID {
+			reply = proposeLocal(args)
+		} else if peer, ok := thisNode.GetPeer(target); ok {
+			var err error
+			reply, err = protocol.SendRaftPropose(peer.Addr.String(), args)
+			if err != nil {
+				log.I.Printf("Failed raft proposal to %s: %s\n", target.String(), err)
+				continue
+			}
+		} else {
+			continue
+		}
+
+		if reply.Ok {
+			return reply.Val
+		} else if reply.Leader != nil {
+			targets = append([]store.Key{*reply.Leader}, targets...)
+		}
+	}
+	return nil
+}
+
+// Returns this node's member of the group with id, or nil if it is not a
+// member, or is not running raft
+func raftGroup(id store.Key) *raft.Group {
+	if raft.GetGroups() == nil {
+		return nil
+	}
+	return raft.GetGroups().Group(id)
+}
+
+// Returns this node's member of the group with id, for a message from
+// another member, or nil if it is not running raft
+func raftMember(id store.Key) *raft.Group {
+	if raft.GetGroups() == nil {
+		return nil
+	}
+	return raft.GetGroups().Join(id)
+}
+
+func proposeLocal(args *raft.ProposeArgs) *raft.ProposeReply {
+	group := raftGroup(args.Group)
+	if group == nil {
+		return &raft.ProposeReply{Ok: false}
+	}
+	val, leader, err := group.Propose(args.Entry)
+	if err != nil {
+		log.D.Println(err)
+	}
+	return &raft.ProposeReply{Ok: err == nil, Leader: leader, Val: val}
+}
+
+// Applies a committed raft entry to this node's store.
+// Implements raft.Applier
+func ApplyRaftEntry(entry raft.Entry) *store.StoreVal {
+	nodeStore := node.GetProcessNode().Store
+	switch entry.Op {
+	case api.CmdGet:
+		value, err := nodeStore.Get(entry.Key)
+		if err != nil {
+			return &store.StoreVal{Active: false, Timestamp: 0}
+		}
+		return value
+	case api.CmdPut:
+		nodeStore.Put(entry.Key, entry.Val, entry.Timestamp)
+		return &store.StoreVal{Val: entry.Val, Active: true, Timestamp: entry.Timestamp}
+	case api.CmdRemove:
+		err := nodeStore.Remove(entry.Key, entry.Timestamp)
+		// Active signals whether there was a value to remove
+		return &store.StoreVal{Active: err == nil, Timestamp: entry.Timestamp}
+	default:
+		log.E.Printf("Unknown raft entry op %x\n", entry.Op)
+		return nil
+	}
+}
+
+func HandleRaftPropose(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	args := &raft.ProposeArgs{}
+	if !parseRaftMsg(handler, msg, recvAddr, args) {
+		return
+	}
+	replyToRaftMsg(handler, msg, recvAddr, proposeLocal(args))
+}
+
+func HandleRaftRequestVote(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	args := &raft.RequestVoteArgs{}
+	if !parseRaftMsg(handler, msg, recvAddr, args) {
+		return
+	}
+	group := raftMember(msg.(*api.KeyValueDgram).Key)
+	if group == nil {
+		replyToRaftMsg(handler, msg, recvAddr, &raft.RequestVoteReply{Term: args.Term})
+		return
+	}
+	replyToRaftMsg(handler, msg, recvAddr, group.HandleRequestVote(args))
+}
+
+func HandleRaftAppendEntries(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	args := &raft.AppendEntriesArgs{}
+	if !parseRaftMsg(handler, msg, recvAddr, args) {
+		return
+	}
+	group := raftMember(msg.(*api.KeyValueDgram).Key)
+	if group == nil {
+		replyToRaftMsg(handler, msg, recvAddr, &raft.AppendEntriesReply{Term: args.Term})
+		return
+	}
+	replyToRaftMsg(handler, msg, recvAddr, group.HandleAppendEntries(args))
+}
+
+func HandleRaftInstallSnapshot(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	args := &raft.InstallSnapshotArgs{}
+	if !parseRaftMsg(handler, msg, recvAddr, args) {
+		return
+	}
+	group := raftMember(msg.(*api.KeyValueDgram).Key)
+	if group == nil {
+		replyToRaftMsg(handler, msg, recvAddr, &raft.InstallSnapshotReply{Term: args.Term})
+		return
+	}
+	replyToRaftMsg(handler, msg, recvAddr, group.HandleInstallSnapshot(args))
+}
+
+// Parses the message's value into args.
+// Replies with an error and returns false if it is invalid
+func parseRaftMsg(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr,
+	args interface{}) bool {
+	err := json.Unmarshal(msg.(*api.KeyValueDgram).Value, args)
+	if err != nil {
+		log.E.Println(err)
+		replyMsg := api.NewBaseDgram(msg.UID(), api.RespMalformedDatagram)
+		protocol.ReplyCached(handler.Conn, recvAddr, handler.Cache, replyMsg)
+		return false
+	}
+	return true
+}
+
+func replyToRaftMsg(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr,
+	reply interface{}) {
+	err := protocol.ReplyToRaftMsg(handler.Conn, recvAddr, handler.Cache, msg, reply)
+	if err != nil {
+		log.E.Println(err)
+	}
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/server/protocol"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"net"
+)
+
+// Session commands carry the newest version of the key the client has seen
+// (its session token). Reads never return anything older than the token,
+// and writes are always newer than it. Replies carry the updated token, even
+// those for absent keys, whose removal is a version the client has seen.
+
+func newSessionReply(uid [16]byte, cmd byte, token int64, value []byte) api.Message {
+	return api.NewValueDgram(uid, cmd, api.NewSessionValue(token, value))
+}
+
+// Parses the session token and value of msg.
+// Replies with an error and returns false if it is invalid
+func parseSessionMsg(handler *MessageHandler, msg api.Message,
+	recvAddr *net.UDPAddr) (store.Key, int64, []byte, bool) {
+	keyValMsg := msg.(*api.KeyValueDgram)
+	token, value, err := api.ParseSessionValue(keyValMsg.Value)
+	if err != nil {
+		log.E.Println(err)
+		replyMsg := api.NewBaseDgram(msg.UID(), api.RespMalformedDatagram)
+		protocol.ReplyCached(handler.Conn, recvAddr, handler.Cache, replyMsg)
+		return store.Key{}, 0, nil, false
+	}
+	key := store.Key(convertClientKey(keyValMsg.Key))
+	printReplicaKeyHandleMsg(key, node.GetProcessNode())
+	return key, token, value, true
+}
+
+func HandleSessionGet(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	key, token, _, ok := parseSessionMsg(handler, msg, recvAddr)
+	if !ok {
+		return
+	}
+	var storeval *store.StoreVal
+	if isRaftMode() {
+		storeval = execRaft(api.CmdGet, key, nil, 0)
+	} else {
+		getMsg := api.NewKeyDgram(msg.UID(), api.CmdGet, key)
+		storeval = execQuorumAtLeast(api.CmdGet, getMsg, handler, -1, token)
+	}
+	if storeval == nil {
+		// Force timeout
+		return
+	}
+
+	var replyMsg api.Message
+	if storeval.Timestamp < token {
+		log.I.Printf("No replica of %s has version %d\n", key.String(), token)
+		replyMsg = api.NewBaseDgram(msg.UID(), api.RespStale)
+	} else if !storeval.Active {
+		replyMsg = newSessionReply(msg.UID(), api.RespInvalidKey, storeval.Timestamp, nil)
+	} else {
+		replyMsg = newSessionReply(msg.UID(), api.RespOk, storeval.Timestamp, storeval.Val)
+	}
+	protocol.ReplyToGet(handler.Conn, recvAddr, handler.Cache, replyMsg)
+}
+
+func HandleSessionPut(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	key, token, value, ok := parseSessionMsg(handler, msg, recvAddr)
+	if !ok {
+		return
+	}
+	node.GetProcessNode().Clock.Update(token)
+	putMsg := api.NewKeyValueDgram(msg.UID(), api.CmdPut, key, value)
+
+	var timestamp int64
+	if isRaftMode() {
+		storeval := execRaft(api.CmdPut, key, value, token)
+		if storeval == nil {
+			return
+		}
+		timestamp = storeval.Timestamp
+	} else {
+		timestamp = sessionWriteTimestamp(putMsg, handler, token)
+		if timestamp < 0 || execQuorum(api.CmdPut, putMsg, handler, timestamp) == nil {
+			return
+		}
+	}
+	replyMsg := newSessionReply(msg.UID(), api.RespOk, timestamp, nil)
+	protocol.ReplyToPut(handler.Conn, recvAddr, handler.Cache, replyMsg)
+}
+
+func HandleSessionRemove(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	key, token, _, ok := parseSessionMsg(handler, msg, recvAddr)
+	if !ok {
+		return
+	}
+	node.GetProcessNode().Clock.Update(token)
+	removeMsg := api.NewKeyDgram(msg.UID(), api.CmdRemove, key)
+
+	var storeval *store.StoreVal
+	var timestamp int64
+	if isRaftMode() {
+		storeval = execRaft(api.CmdRemove, key, nil, token)
+		if storeval != nil {
+			timestamp = storeval.Timestamp
+		}
+	} else {
+		timestamp = sessionWriteTimestamp(removeMsg, handler, token)
+		if timestamp < 0 {
+			return
+		}
+		storeval = execQuorum(api.CmdRemove, removeMsg, handler, timestamp)
+	}
+	if storeval == nil {
+		return
+	}
+
+	var replyMsg api.Message
+	if storeval.Active {
+		replyMsg = newSessionReply(msg.UID(), api.RespOk, timestamp, nil)
+	} else {
+		// The key is absent as of the removal's version
+		replyMsg = newSessionReply(msg.UID(), api.RespInvalidKey, timestamp, nil)
+	}
+	protocol.ReplyToRemove(handler.Conn, recvAddr, handler.Cache, replyMsg)
+}
+
+// Returns a write timestamp newer than token, or -1 on timeout.
+// The clock is already past the token, but replica timestamps may not be
+func sessionWriteTimestamp(msg api.Message, handler *MessageHandler, token int64) int64 {
+	timestamp, _ := writeTimestamp(msg, handler)
+	if timestamp >= 0 && timestamp <= token {
+		timestamp = token + 1
+	}
+	return timestamp
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"net"
+	"testing"
+
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/shared/api"
+)
+
+func sendSessionCmd(t *testing.T, addr string, cmd byte, key [32]byte,
+	token int64, value []byte) api.Message {
+	reply, err := api.SendRecv(addr, func(addr *net.UDPAddr) api.Message {
+		return api.NewKeyValueDgram(api.NewMessageUID(addr), cmd, key,
+			api.NewSessionValue(token, value))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func sessionToken(t *testing.T, reply api.Message) int64 {
+	if reply.Command() != api.RespOk {
+		t.Fatalf("Session command failed with %x", reply.Command())
+	}
+	token, _, err := api.ParseSessionValue(reply.(*api.ValueDgram).Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestSessionTokenAdvances(t *testing.T) {
+	addr := startTestNode(t)
+	node.GetProcessNode().FinishJoin()
+	key := [32]byte{0x53, 0x01}
+
+	token := sessionToken(t, sendSessionCmd(t, addr, api.CmdSessionPut, key, 0, []byte("a")))
+	if token <= 0 {
+		t.Fatal("Put did not return a session token")
+	}
+
+	// A token from another node's clock, far ahead of this one's
+	ahead := token + 1000000
+	token = sessionToken(t, sendSessionCmd(t, addr, api.CmdSessionPut, key, ahead, []byte("b")))
+	if token <= ahead {
+		t.Fatalf("Put returned token %d, not newer than %d", token, ahead)
+	}
+
+	reply := sendSessionCmd(t, addr, api.CmdSessionGet, key, token, nil)
+	if got := sessionToken(t, reply); got != token {
+		t.Fatalf("Get returned token %d, expected %d", got, token)
+	}
+	if _, value, _ := api.ParseSessionValue(reply.(*api.ValueDgram).Value); string(value) != "b" {
+		t.Fatal("Get returned the wrong value")
+	}
+}
+
+func TestSessionGetRejectsStaleValue(t *testing.T) {
+	addr := startTestNode(t)
+	node.GetProcessNode().FinishJoin()
+	key := [32]byte{0x53, 0x02}
+
+	token := sessionToken(t, sendSessionCmd(t, addr, api.CmdSessionPut, key, 0, []byte("a")))
+	// The session has seen a newer version, written somewhere this node never heard of
+	reply := sendSessionCmd(t, addr, api.CmdSessionGet, key, token+1, nil)
+	if reply.Command() != api.RespStale {
+		t.Fatalf("Get older than the session token returned %x", reply.Command())
+	}
+}
+
+func TestSessionRepliesForRemovedKeyCarryToken(t *testing.T) {
+	addr := startTestNode(t)
+	node.GetProcessNode().FinishJoin()
+	key := [32]byte{0x53, 0x03}
+
+	token := sessionToken(t, sendSessionCmd(t, addr, api.CmdSessionPut, key, 0, []byte("a")))
+	token = sessionToken(t, sendSessionCmd(t, addr, api.CmdSessionRemove, key, token, nil))
+
+	for _, cmd := range []byte{api.CmdSessionGet, api.CmdSessionRemove} {
+		reply := sendSessionCmd(t, addr, cmd, key, token, nil)
+		if reply.Command() != api.RespInvalidKey {
+			t.Fatalf("Command %x on a removed key returned %x", cmd, reply.Command())
+		}
+		vmsg, ok := reply.(*api.ValueDgram)
+		if !ok {
+			t.Fatalf("Command %x on a removed key returned no token", cmd)
+		}
+		got, _, err := api.ParseSessionValue(vmsg.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got < token {
+			t.Fatalf("Command %x returned token %d, older than %d", cmd, got, token)
+		}
+		token = got
+	}
+}
@@ -29,6 +29,8 @@ type Status struct {
 	DiskSpace        []*DiskSpaceEntry
 	Uptime           string
 	CurrentLoad      string
+	QueueDepth       string // Received messages waiting for a worker, of the most which may
+	ReplyCache       string // Hits, misses and evictions of the reply cache
 }
 
 type DiskSpaceEntry struct {
@@ -86,6 +88,8 @@ func (handler *StatusHandler) UpdateStatusMap(peers map[store.Key]*node.Peer) {
 				[]*DiskSpaceEntry{},
 				"", /*uptime*/
 				"", /*current load*/
+				"", /*queue depth*/
+				"", /*reply cache*/
 			}
 		}
 	}
@@ -107,6 +111,12 @@ func (handler *StatusHandler) HandleStatusMessage(msg api.Message, recvAddr *net
 		status.DiskSpace = parseDiskSpace(strings.TrimSpace(data[1]))
 		status.Uptime = strings.TrimSpace(data[2])
 		status.CurrentLoad = strings.TrimSpace(data[3])
+		if len(data) > 4 { // Not sent by older nodes
+			status.QueueDepth = strings.TrimSpace(data[4])
+		}
+		if len(data) > 5 {
+			status.ReplyCache = strings.TrimSpace(data[5])
+		}
 	}
 }
 
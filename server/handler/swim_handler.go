@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/server/protocol"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"net"
+)
+
+func HandlePing(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	args := &protocol.PingMsg{}
+	if !parseSwimMsg(handler, msg, recvAddr, args) {
+		return
+	}
+	thisNode := node.GetProcessNode()
+	thisNode.PeerAcked(msg.(*api.KeyValueDgram).Key, args.Incarnation)
+	replyToSwimMsg(handler, msg, recvAddr,
+		&protocol.PingMsg{Incarnation: thisNode.CurrentIncarnation()})
+}
+
+// Probes the target on behalf of the sender
+func HandlePingReq(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	args := &protocol.PingReqMsg{}
+	if !parseSwimMsg(handler, msg, recvAddr, args) {
+		return
+	}
+	thisNode := node.GetProcessNode()
+	target := msg.(*api.KeyValueDgram).Key
+	incarnation, err := protocol.SendPing(args.Addr, thisNode.ID, thisNode.CurrentIncarnation())
+	if err == nil {
+		thisNode.PeerAcked(target, incarnation)
+	}
+	replyToSwimMsg(handler, msg, recvAddr, &protocol.PingReqReply{Acked: err == nil})
+}
+
+func HandleSwimUpdate(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	keyValMsg := msg.(*api.KeyValueDgram)
+	update, err := protocol.ParseSwimUpdateMsg(keyValMsg)
+	if err != nil {
+		log.E.Println(err)
+		return
+	}
+	if refutation := node.GetProcessNode().ApplySwimUpdate(update); refutation != nil {
+		err = protocol.GossipSwimUpdate(handler.Conn, refutation, recvAddr)
+		if err != nil {
+			log.E.Println(err)
+		}
+	}
+	if handler.ShouldGossip(keyValMsg.UID()) {
+		protocol.Gossip(handler.Conn, keyValMsg)
+	}
+}
+
+// Parses the message's value into args.
+// Replies with an error and returns false if it is invalid
+func parseSwimMsg(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr,
+	args interface{}) bool {
+	err := json.Unmarshal(msg.(*api.KeyValueDgram).Value, args)
+	if err != nil {
+		log.E.Println(err)
+		replyMsg := api.NewBaseDgram(msg.UID(), api.RespMalformedDatagram)
+		protocol.ReplyCached(handler.Conn, recvAddr, handler.Cache, replyMsg)
+		return false
+	}
+	return true
+}
+
+func replyToSwimMsg(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr,
+	reply interface{}) {
+	err := protocol.ReplyToSwimMsg(handler.Conn, recvAddr, handler.Cache, msg, reply)
+	if err != nil {
+		log.E.Println(err)
+	}
+}
@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/server/protocol"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/server/txn"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"net"
+)
+
+type txVote struct {
+	Participant store.Key
+	Reply       *txn.PrepareReply
+	Err         error
+}
+
+/* Coordinates a client's transaction with two-phase commit.
+ * Every replica of every key in the transaction is a participant, and must
+ * vote to commit. Checks are evaluated against the newest values the
+ * participants hold while their keys are locked.
+ * Transactions are not supported in raft mode, since their writes would not
+ * go through the groups' logs.
+ */
+func HandleTransaction(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	if isRaftMode() {
+		replyMsg := api.NewBaseDgram(msg.UID(), api.RespUnknownCommand)
+		protocol.ReplyCached(handler.Conn, recvAddr, handler.Cache, replyMsg)
+		return
+	}
+	tx, err := api.ParseTransaction(msg.(*api.ValueDgram).Value)
+	if err != nil || len(tx.Ops) == 0 {
+		replyMsg := api.NewBaseDgram(msg.UID(), api.RespMalformedDatagram)
+		protocol.ReplyCached(handler.Conn, recvAddr, handler.Cache, replyMsg)
+		return
+	}
+
+	thisNode := node.GetProcessNode()
+	id := txn.ID(msg.UID())
+	recs, err := splitTransaction(thisNode, id, tx)
+	if err != nil {
+		log.E.Println(err)
+		replyMsg := api.NewBaseDgram(msg.UID(), api.RespMalformedDatagram)
+		protocol.ReplyCached(handler.Conn, recvAddr, handler.Cache, replyMsg)
+		return
+	}
+
+	participants := make([]store.Key, 0, len(recs))
+	for participant := range recs {
+		participants = append(participants, participant)
+	}
+	if err := thisNode.Txns.Begin(id, participants); err != nil {
+		log.E.Println(err)
+		replyMsg := api.NewBaseDgram(msg.UID(), api.RespInternalError)
+		protocol.ReplyCached(handler.Conn, recvAddr, handler.Cache, replyMsg)
+		return
+	}
+	commit := prepareTransaction(thisNode, recs)
+	// Taken after the prepare replies updated the clock, so the commit
+	// is newer than every version the participants hold for the keys
+	timestamp := thisNode.Clock.Now()
+	commit = thisNode.Txns.Decide(id, commit, timestamp) == txn.Committed
+	sendTxDecisions(thisNode, recs, &txn.DecisionArgs{ID: id, Commit: commit,
+		Timestamp: timestamp})
+
+	var replyMsg api.Message
+	if commit {
+		log.I.Printf("Committed transaction %x\n", id)
+		replyMsg = api.NewValueDgram(msg.UID(), api.RespOk, []byte{})
+	} else {
+		log.I.Printf("Aborted transaction %x\n", id)
+		replyMsg = api.NewBaseDgram(msg.UID(), api.RespTxAborted)
+	}
+	protocol.ReplyCached(handler.Conn, recvAddr, handler.Cache, replyMsg)
+}
+
+// Splits the transaction's ops into a record for each replica of their keys
+func splitTransaction(thisNode *node.Node, id txn.ID,
+	tx *api.Transaction) (map[store.Key]*txn.Record, error) {
+	recs := map[store.Key]*txn.Record{}
+	participants := []store.Key{}
+	for _, txOp := range tx.Ops {
+		switch txOp.Op {
+		case api.TxOpPut, api.TxOpRemove, api.TxOpCheckEquals,
+			api.TxOpCheckExists, api.TxOpCheckAbsent:
+		default:
+			return nil, errors.New("Unknown transaction op")
+		}
+		clientKey, err := api.KeyFromHex(txOp.Key)
+		if err != nil {
+			return nil, err
+		}
+		op := txn.Op{Op: txOp.Op, Key: convertClientKey(clientKey), Value: txOp.Value}
+		for _, replica := range thisNode.GetReplicaIdsForKey(op.Key) {
+			rec, ok := recs[replica]
+			if !ok {
+				rec = &txn.Record{ID: id, Coordinator: thisNode.ID}
+				recs[replica] = rec
+				participants = append(participants, replica)
+			}
+			rec.Ops = append(rec.Ops, op)
+		}
+	}
+	for _, rec := range recs {
+		rec.Participants = participants
+	}
+	return recs, nil
+}
+
+// Prepares the transaction on all participants.
+// Returns whether all voted to commit, and all checks hold
+func prepareTransaction(thisNode *node.Node, recs map[store.Key]*txn.Record) bool {
+	votes := make(chan *txVote, len(recs))
+	for participant, rec := range recs {
+		go func(participant store.Key, rec *txn.Record) {
+			vote := &txVote{Participant: participant}
+			if participant == thisNode.ID {
+				vote.Reply = prepareLocal(thisNode, rec)
+			} else if peer, ok := thisNode.GetPeer(participant); ok {
+				vote.Reply, vote.Err = protocol.SendTxPrepare(peer.Addr.String(), rec)
+			} else {
+				vote.Err = errors.New("Unknown participant")
+			}
+			votes <- vote
+		}(participant, rec)
+	}
+
+	latest := map[store.Key]*store.StoreVal{}
+	for range recs {
+		vote := <-votes
+		if vote.Err != nil || !vote.Reply.Vote {
+			log.I.Printf("Participant %s voted to abort: %v\n",
+				vote.Participant.String(), vote.Err)
+			return false
+		}
+		for keyHex, val := range vote.Reply.Values {
+			key, err := api.KeyFromHex(keyHex)
+			if err != nil || val == nil {
+				continue
+			}
+			thisNode.Clock.Update(val.Timestamp)
+			if current, ok := latest[key]; !ok || val.Timestamp > current.Timestamp {
+				latest[key] = val
+			}
+		}
+	}
+
+	for _, rec := range recs {
+		for _, op := range rec.Ops {
+			if !txn.CheckHolds(op, latest[op.Key]) {
+				log.I.Printf("Check %x failed on key %s\n", op.Op, op.Key.String())
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Prepares the record on this node, and returns its vote
+func prepareLocal(thisNode *node.Node, rec *txn.Record) *txn.PrepareReply {
+	reply := &txn.PrepareReply{Values: map[string]*store.StoreVal{}}
+	if err := thisNode.Txns.Prepare(rec); err != nil {
+		log.I.Printf("Could not prepare transaction %x: %s\n", rec.ID, err)
+		return reply
+	}
+	reply.Vote = true
+	for _, op := range rec.Ops {
+		if val, err := thisNode.Store.Get(op.Key); err == nil {
+			reply.Values[api.KeyHex(op.Key)] = val
+		}
+	}
+	return reply
+}
+
+// Sends the decision to all participants, and waits for them to acknowledge.
+// The decision is sent again later to those which did not, until they do
+func sendTxDecisions(thisNode *node.Node, recs map[store.Key]*txn.Record,
+	args *txn.DecisionArgs) {
+	participants := make([]store.Key, 0, len(recs))
+	for participant := range recs {
+		participants = append(participants, participant)
+	}
+	protocol.SendTxDecisions(participants, args)
+}
+
+func HandleIntraTxPrepare(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	rec := &txn.Record{}
+	if !parseTxMsg(handler, msg, recvAddr, rec) {
+		return
+	}
+	thisNode := node.GetProcessNode()
+	replyToTxMsg(handler, msg, recvAddr, prepareLocal(thisNode, rec))
+}
+
+func HandleIntraTxDecision(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	args := &txn.DecisionArgs{}
+	if !parseTxMsg(handler, msg, recvAddr, args) {
+		return
+	}
+	node.GetProcessNode().FinishTransaction(args.ID, args.Commit, args.Timestamp)
+	replyToTxMsg(handler, msg, recvAddr, struct{}{})
+}
+
+func HandleIntraTxStatus(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr) {
+	args := &txn.StatusArgs{}
+	if !parseTxMsg(handler, msg, recvAddr, args) {
+		return
+	}
+	thisNode := node.GetProcessNode()
+	reply := &txn.StatusReply{}
+	if args.AsCoordinator {
+		reply.State, reply.Timestamp = thisNode.Txns.CoordinatorState(args.ID)
+		if reply.State == txn.Committed || reply.State == txn.Aborted {
+			thisNode.Txns.Acknowledge(args.ID, args.From)
+		}
+	} else {
+		reply.State, reply.Timestamp = thisNode.Txns.ParticipantState(args.ID)
+	}
+	replyToTxMsg(handler, msg, recvAddr, reply)
+}
+
+// Parses the message's value into args.
+// Replies with an error and returns false if it is invalid
+func parseTxMsg(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr,
+	args interface{}) bool {
+	err := json.Unmarshal(msg.(*api.ValueDgram).Value, args)
+	if err != nil {
+		log.E.Println(err)
+		replyMsg := api.NewBaseDgram(msg.UID(), api.RespMalformedDatagram)
+		protocol.ReplyCached(handler.Conn, recvAddr, handler.Cache, replyMsg)
+		return false
+	}
+	return true
+}
+
+func replyToTxMsg(handler *MessageHandler, msg api.Message, recvAddr *net.UDPAddr,
+	reply interface{}) {
+	err := protocol.ReplyToTxMsg(handler.Conn, recvAddr, handler.Cache, msg, reply)
+	if err != nil {
+		log.E.Println(err)
+	}
+}
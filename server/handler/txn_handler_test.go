@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/server/protocol"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/server/txn"
+	"github.com/tsiemens/kvstore/shared/api"
+)
+
+/* Runs a transaction which this node coordinates and takes part in, through
+ * its handlers. The decision is lost on the way, so the participant has to
+ * ask the coordinator for it, as recovery does.
+ */
+func TestTransactionPrepareDecisionAndRecovery(t *testing.T) {
+	addr := startTestNode(t)
+	thisNode := node.GetProcessNode()
+	key := store.Key{0x42, 0x02}
+	id := txn.ID(newTestUID())
+	rec := &txn.Record{
+		ID:           id,
+		Coordinator:  thisNode.ID,
+		Participants: []store.Key{thisNode.ID},
+		Ops:          []txn.Op{{Op: api.TxOpPut, Key: key, Value: []byte("tx")}},
+	}
+	thisNode.Txns.Begin(id, rec.Participants)
+
+	vote, err := protocol.SendTxPrepare(addr, rec)
+	if err != nil || !vote.Vote {
+		t.Fatal("Participant did not vote to commit")
+	}
+
+	// Plain writes may not slip in between the prepare and the decision
+	put := api.NewKeyValueDgram(newTestUID(), api.CmdPut, key, []byte("plain"))
+	reply := protocol.IntraNodePut(addr, put, 1)
+	if reply == nil || reply.Command() != api.RespSysOverload {
+		t.Fatal("Plain write to a locked key was not rejected")
+	}
+
+	timestamp := thisNode.Clock.Now()
+	if thisNode.Txns.Decide(id, true, timestamp) != txn.Committed {
+		t.Fatal("Failed to decide")
+	}
+	// The decision never reaches the participant, which is still prepared
+	status, err := protocol.SendTxStatusQuery(addr, &txn.StatusArgs{ID: id})
+	if err != nil || status.State != txn.Prepared {
+		t.Fatal("Participant should still be prepared")
+	}
+	if len(thisNode.Txns.Unacknowledged(0)) == 0 {
+		t.Fatal("Unacknowledged decision not kept to be resent")
+	}
+
+	// Recovery asks the coordinator for its decision, and applies it
+	status, err = protocol.SendTxStatusQuery(addr,
+		&txn.StatusArgs{ID: id, AsCoordinator: true, From: thisNode.ID})
+	if err != nil || status.State != txn.Committed || status.Timestamp != timestamp {
+		t.Fatal("Coordinator did not answer with its decision")
+	}
+	err = protocol.SendTxDecision(addr, &txn.DecisionArgs{ID: id, Commit: true,
+		Timestamp: timestamp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := thisNode.Store.Get(key); err != nil || string(v.Val) != "tx" {
+		t.Fatal("Committed transaction not applied")
+	}
+	for _, pending := range thisNode.Txns.Unacknowledged(0) {
+		if pending.Args.ID == id {
+			t.Fatal("Decision still pending after the participant asked for it")
+		}
+	}
+
+	put = api.NewKeyValueDgram(newTestUID(), api.CmdPut, key, []byte("plain"))
+	reply = protocol.IntraNodePut(addr, put, timestamp+1)
+	if reply == nil || reply.Command() != api.RespOk {
+		t.Fatal("Plain write still rejected after the transaction finished")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 
 	"github.com/tsiemens/kvstore/server/config"
@@ -12,6 +13,8 @@ import (
 	"github.com/tsiemens/kvstore/server/loop"
 	"github.com/tsiemens/kvstore/server/node"
 	"github.com/tsiemens/kvstore/server/protocol"
+	"github.com/tsiemens/kvstore/server/raft"
+	"github.com/tsiemens/kvstore/server/seeds"
 	"github.com/tsiemens/kvstore/server/store"
 	"github.com/tsiemens/kvstore/shared/log"
 	"github.com/tsiemens/kvstore/shared/util"
@@ -27,6 +30,9 @@ func main() {
 		log.Init(os.Stdout, os.Stdout, os.Stderr)
 	}
 	config.Init(cl.ConfigPath, cl.UseLoopback)
+	if cl.Bootstrap {
+		config.GetConfig().Bootstrap = true
+	}
 
 	var port int
 	if cl.StatusServer {
@@ -51,8 +57,25 @@ func main() {
 		err = protocol.StatusReceiver(conn, statusHandler)
 
 	} else {
+		seeds.Init()
 		store := store.New()
 		node.Init(localAddr, conn, store, protocol.SendKeyValuesToNode)
+		thisNode := node.GetProcessNode()
+		err = thisNode.Txns.Restore(
+			filepath.Join(config.GetConfig().TxnDir, thisNode.ID.String()+".json"))
+		if err != nil {
+			log.E.Fatal(err)
+		}
+		if config.GetConfig().ConsistencyMode == config.ConsistencyRaft {
+			var raftStorage raft.Storage
+			raftStorage, err = raft.NewFileStorage(
+				filepath.Join(config.GetConfig().RaftDir, thisNode.ID.String()))
+			if err != nil {
+				log.E.Fatal(err)
+			}
+			raft.Init(thisNode.ID, thisNode.Clock, protocol.SendRaftMsg, handler.ApplyRaftEntry,
+				thisNode.GetRangeReplicaIds, raftStorage)
+		}
 		loop.GoAll()
 		msgHandler := handler.NewDefaultMessageHandler(conn, cl.PacketLossPct)
 		err = protocol.LoopReceiver(conn, msgHandler)
@@ -67,6 +90,7 @@ type ServerCommandLine struct {
 	Port          int
 	StatusServer  bool
 	ConfigPath    string
+	Bootstrap     bool
 }
 
 func getCommandLine() *ServerCommandLine {
@@ -81,6 +105,8 @@ func getCommandLine() *ServerCommandLine {
 	portPtr := flag.Int("port", 5555, "Port to run server on.")
 	packetLossPtr := flag.Int("lossy", 0, "This percent of packets will be randomly dropped.")
 	configPathPtr := flag.String("config", "config.json", "Path to the config file")
+	bootstrapPtr := flag.Bool("bootstrap", false,
+		"Start a new cluster if no seed answers. Use on the first node only")
 
 	statusServerPtr := flag.Bool("statsrv", false, "Use this node as a status server")
 	flag.Parse()
@@ -97,6 +123,7 @@ func getCommandLine() *ServerCommandLine {
 		Port:          *portPtr,
 		StatusServer:  *statusServerPtr,
 		ConfigPath:    *configPathPtr,
+		Bootstrap:     *bootstrapPtr,
 	}
 }
 
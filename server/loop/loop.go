@@ -1,11 +1,17 @@
 package loop
 
 import (
+	"errors"
 	"github.com/tsiemens/kvstore/server/config"
 	"github.com/tsiemens/kvstore/server/node"
 	"github.com/tsiemens/kvstore/server/protocol"
+	"github.com/tsiemens/kvstore/server/seeds"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/server/txn"
 	"github.com/tsiemens/kvstore/shared/api"
 	"github.com/tsiemens/kvstore/shared/log"
+	"github.com/tsiemens/kvstore/shared/util"
+	"net"
 	"time"
 )
 
@@ -17,7 +23,150 @@ func GoAll() {
 	if node.GetProcessNode().Conn == nil {
 		log.E.Fatal("Process node Connection has not been initialized!")
 	}
-	go MembershipUpdateLoop()
+	go func() {
+		// Gossiping before joining would announce this node before it
+		// asked its peers for its keys
+		JoinCluster()
+		MembershipUpdateLoop()
+	}()
+	go TransactionRecoveryLoop()
+	go FailureDetectionLoop()
+	go SeedRefreshLoop()
+}
+
+/* Joins the cluster through the first seed to answer. This node learns the
+ * membership from the seed, then announces itself to each online peer, which
+ * pushes it the keys it now replicates. Once all of them have, or JoinTimeout
+ * passes, this node starts coordinating client requests.
+ * If no seed answers, this node starts a new cluster if configured to
+ * Bootstrap, and otherwise keeps asking the seeds.
+ */
+func JoinCluster() {
+	thisNode := node.GetProcessNode()
+	peers := querySeeds()
+	for peers == nil {
+		if config.GetConfig().Bootstrap {
+			log.I.Println("No seed answered. Starting a new cluster")
+			thisNode.FinishJoin()
+			return
+		}
+		log.I.Printf("No seed answered. Retrying in %v\n", joinRetryInterval)
+		time.Sleep(joinRetryInterval)
+		peers = querySeeds()
+	}
+	if refutation := thisNode.ApplyMembership(peers); refutation != nil {
+		protocol.GossipSwimUpdate(thisNode.Conn, refutation, nil)
+	}
+
+	online := thisNode.RandomOnlinePeers(len(peers), thisNode.ID)
+	peerIds := make([]store.Key, 0, len(online))
+	for id := range online {
+		peerIds = append(peerIds, id)
+	}
+	done := thisNode.StartJoinSync(peerIds)
+	joiner := &protocol.JoinMsg{
+		Addr:        thisNode.Conn.LocalAddr().(*net.UDPAddr),
+		Incarnation: thisNode.CurrentIncarnation(),
+		Weight:      thisNode.Weight,
+		Zone:        thisNode.Zone,
+	}
+	for id, peer := range online {
+		go func(id store.Key, peer *node.Peer) {
+			if err := protocol.SendJoinSync(peer.Addr.String(), thisNode.ID, joiner); err != nil {
+				log.E.Printf("Peer %s did not answer join: %s\n", id.String(), err)
+				thisNode.JoinSyncDone(id)
+			}
+		}(id, peer)
+	}
+	select {
+	case <-done:
+	case <-time.After(config.GetConfig().JoinTimeout):
+		log.E.Println("Timed out waiting for peers to push keys")
+	}
+	thisNode.FinishJoin()
+}
+
+// How long a joining node waits before asking the seeds again
+const joinRetryInterval = time.Second * 5
+
+// Returns the membership known by the first seed to answer, including
+// the seed itself, or nil if none does
+func querySeeds() map[store.Key]*node.Peer {
+	seedAddrs := node.WellKnownPeers()
+	for _, i := range util.Rand.Perm(len(seedAddrs)) {
+		peers, err := protocol.SendMembershipQuery(seedAddrs[i].String())
+		if err == nil {
+			return peers
+		}
+		log.D.Printf("Seed %s did not answer: %s\n", seedAddrs[i].String(), err)
+	}
+	return nil
+}
+
+// Resolves the seed nodes again each SeedRefreshInterval,
+// so that seeds may be added or moved while the node runs
+func SeedRefreshLoop() {
+	interval := config.GetConfig().SeedRefreshInterval
+	for {
+		time.Sleep(interval)
+		seeds.GetSeeds().Refresh()
+	}
+}
+
+/* Probes a random peer each ProbeInterval, SWIM style.
+ * If the peer does not acknowledge a ping, IndirectProbes other peers are
+ * asked to ping it. If none of them get an acknowledgement either, the peer
+ * is suspected. Suspects which don't refute the suspicion within
+ * SuspectTimeout are marked offline.
+ */
+func FailureDetectionLoop() {
+	conf := config.GetConfig()
+	thisNode := node.GetProcessNode()
+	for {
+		time.Sleep(conf.ProbeInterval)
+		for _, update := range thisNode.ConfirmExpiredSuspects(conf.SuspectTimeout) {
+			protocol.GossipSwimUpdate(thisNode.Conn, update, nil)
+		}
+
+		targetId, target := thisNode.RandomProbeTarget()
+		if target == nil {
+			continue
+		}
+		if probe(thisNode, *targetId, target, conf.IndirectProbes) {
+			continue
+		}
+		log.I.Printf("Peer %s failed probes\n", targetId.String())
+		if update := thisNode.SuspectPeer(*targetId); update != nil {
+			protocol.GossipSwimUpdate(thisNode.Conn, update, target.Addr)
+		}
+	}
+}
+
+// Returns whether the target acknowledged a direct or indirect ping
+func probe(thisNode *node.Node, targetId store.Key, target *node.Peer,
+	indirectProbes int) bool {
+	incarnation, err := protocol.SendPing(target.Addr.String(), thisNode.ID,
+		thisNode.CurrentIncarnation())
+	if err == nil {
+		thisNode.PeerAcked(targetId, incarnation)
+		return true
+	}
+
+	helpers := thisNode.RandomOnlinePeers(indirectProbes, targetId)
+	acks := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper *node.Peer) {
+			acked, err := protocol.SendPingReq(helper.Addr.String(), targetId,
+				target.Addr.String())
+			acks <- err == nil && acked
+		}(helper)
+	}
+	for range helpers {
+		if <-acks {
+			return true
+		}
+	}
+	return false
 }
 
 func MembershipUpdateLoop() {
@@ -25,19 +174,117 @@ func MembershipUpdateLoop() {
 	thisNode := node.GetProcessNode()
 	for {
 		randPeer, peerId := thisNode.RandomPeer()
-		if randPeer != nil {
-			err := protocol.SendMembershipMsg(thisNode.Conn, randPeer.Addr,
-				thisNode.ID, thisNode.KnownPeers, api.CmdMembershipExchange)
+		if randPeer != nil && !thisNode.IsLeaving() {
+			err := protocol.SendMembershipMsg(thisNode.Conn, randPeer.Addr, peerId,
+				api.CmdMembershipExchange)
 			if err != nil {
 				log.E.Println(err)
 				if peerId != nil {
-					thisNode.SetPeerOffline(*peerId)
+					if update := thisNode.SuspectPeer(*peerId); update != nil {
+						protocol.GossipSwimUpdate(thisNode.Conn, update, randPeer.Addr)
+					}
 				}
-
 			}
 		}
+		// Retry handing off any keys still held for peers which are back,
+		// and copying keys which failed to copy to their new replicas
+		thisNode.HandOffHints()
+		thisNode.RetryRereplication()
 		log.D.Printf("Currently known peers: [\n%s\n]\n",
-			node.PeerListString(thisNode.KnownPeers))
+			thisNode.PeerListString())
 		time.Sleep(MembershipSendFreq)
 	}
 }
+
+const txRecoveryInterval = time.Second * 5
+
+// How long a participant waits for a decision before asking for it
+const txInDoubtTimeout = time.Second * 10
+
+// How long finished transactions are remembered, to answer status queries.
+// Decisions are remembered until every participant has acknowledged them
+const txRetention = time.Minute * 10
+
+func TransactionRecoveryLoop() {
+	thisNode := node.GetProcessNode()
+	for {
+		time.Sleep(txRecoveryInterval)
+		thisNode.Txns.Clean(txRetention)
+		for _, pending := range thisNode.Txns.Unacknowledged(txRecoveryInterval) {
+			protocol.SendTxDecisions(pending.Participants, &pending.Args)
+		}
+		for _, rec := range thisNode.Txns.InDoubt(txInDoubtTimeout) {
+			resolveInDoubtTx(thisNode, &rec)
+		}
+	}
+}
+
+/* Tries to learn the outcome of a transaction prepared here, whose decision
+ * never arrived. Asks the coordinator first. If it does not know the
+ * transaction (it lost its saved decisions), asks the other participants
+ * whether they committed or aborted it.
+ * A prepared transaction is never presumed aborted: it is only aborted if
+ * the coordinator or a participant aborted it. If nobody can tell, it stays
+ * prepared (and its keys locked) until the next attempt, since the
+ * coordinator may have decided to commit it before it restarted.
+ */
+func resolveInDoubtTx(thisNode *node.Node, rec *txn.Record) {
+	coordReply, coordErr := queryTxState(thisNode, rec.Coordinator, rec.ID, true)
+	if coordErr == nil {
+		switch coordReply.State {
+		case txn.Committed:
+			thisNode.FinishTransaction(rec.ID, true, coordReply.Timestamp)
+			return
+		case txn.Aborted:
+			thisNode.FinishTransaction(rec.ID, false, 0)
+			return
+		case txn.Pending:
+			return
+		}
+		// Unknown: the coordinator lost the transaction. It was committed
+		// only if a participant applied it
+	}
+
+	for _, participant := range rec.Participants {
+		if participant == thisNode.ID {
+			continue
+		}
+		reply, err := queryTxState(thisNode, participant, rec.ID, false)
+		if err != nil {
+			continue
+		}
+		switch reply.State {
+		case txn.Committed:
+			thisNode.FinishTransaction(rec.ID, true, reply.Timestamp)
+			return
+		case txn.Aborted:
+			thisNode.FinishTransaction(rec.ID, false, 0)
+			return
+		}
+		// Unknown: the participant never prepared it, or committed it and
+		// forgot, so it can't tell
+	}
+	log.I.Printf("Transaction %x still in doubt\n", rec.ID)
+}
+
+func queryTxState(thisNode *node.Node, target store.Key, id txn.ID,
+	asCoordinator bool) (*txn.StatusReply, error) {
+	if target == thisNode.ID {
+		reply := &txn.StatusReply{}
+		if asCoordinator {
+			reply.State, reply.Timestamp = thisNode.Txns.CoordinatorState(id)
+			if reply.State == txn.Committed || reply.State == txn.Aborted {
+				thisNode.Txns.Acknowledge(id, thisNode.ID)
+			}
+		} else {
+			reply.State, reply.Timestamp = thisNode.Txns.ParticipantState(id)
+		}
+		return reply, nil
+	}
+	peer, ok := thisNode.GetPeer(target)
+	if !ok {
+		return nil, errors.New("Unknown node " + target.String())
+	}
+	return protocol.SendTxStatusQuery(peer.Addr.String(),
+		&txn.StatusArgs{ID: id, AsCoordinator: asCoordinator, From: thisNode.ID})
+}
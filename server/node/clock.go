@@ -0,0 +1,82 @@
+package node
+
+import (
+	"github.com/tsiemens/kvstore/shared/util"
+)
+
+// Number of low bits of a timestamp used for the logical counter
+const logicalBits = 16
+const logicalMask = (1 << logicalBits) - 1
+
+// Clock is a hybrid logical clock (HLC).
+// Timestamps it produces are packed into an int64 as
+// [wall time ms | logical counter (16 bits)], so they compare with plain
+// integer comparison, and are always larger than the old purely logical
+// timestamps.
+type Clock struct {
+	wallTime int64 // highest wall time (ms) seen so far
+	logical  int64
+	lock     util.Semaphore
+	now      func() int64
+}
+
+func NewClock() *Clock {
+	return &Clock{
+		lock: util.NewSemaphore(),
+		now:  util.UnixMilliTimestamp,
+	}
+}
+
+// Returns a new timestamp, greater than any issued or observed before
+func (c *Clock) Now() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pt := c.now()
+	if pt > c.wallTime {
+		c.wallTime = pt
+		c.logical = 0
+	} else {
+		c.tick()
+	}
+	return c.timestamp()
+}
+
+// Merges a timestamp received from another node into the clock,
+// so that any following call to Now() returns a later timestamp.
+func (c *Clock) Update(remote int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	remoteWall := remote >> logicalBits
+	remoteLogical := remote & logicalMask
+	pt := c.now()
+
+	if pt > c.wallTime && pt > remoteWall {
+		c.wallTime = pt
+		c.logical = 0
+	} else if remoteWall > c.wallTime {
+		c.wallTime = remoteWall
+		c.logical = remoteLogical
+		c.tick()
+	} else if remoteWall == c.wallTime {
+		if remoteLogical > c.logical {
+			c.logical = remoteLogical
+		}
+		c.tick()
+	} else {
+		c.tick()
+	}
+}
+
+// Must be called with the lock held
+func (c *Clock) tick() {
+	c.logical++
+	if c.logical > logicalMask {
+		// Counter overflowed. Borrow from the next millisecond
+		c.wallTime++
+		c.logical = 0
+	}
+}
+
+func (c *Clock) timestamp() int64 {
+	return c.wallTime<<logicalBits | c.logical
+}
@@ -0,0 +1,63 @@
+package node
+
+import (
+	"testing"
+)
+
+func newTestClock(wallTime *int64) *Clock {
+	c := NewClock()
+	c.now = func() int64 { return *wallTime }
+	return c
+}
+
+func TestClockMonotonic(t *testing.T) {
+	wallTime := int64(1000)
+	c := newTestClock(&wallTime)
+
+	t1 := c.Now()
+	t2 := c.Now()
+	if t2 <= t1 {
+		t.Fatal("Timestamps within the same ms not increasing")
+	}
+
+	// Wall clock going backwards must not affect the timestamps
+	wallTime = 900
+	t3 := c.Now()
+	if t3 <= t2 {
+		t.Fatal("Timestamps decreased with wall clock")
+	}
+
+	wallTime = 2000
+	t4 := c.Now()
+	if t4 <= t3 || t4>>logicalBits != 2000 {
+		t.Fatal("Timestamp did not advance with wall clock")
+	}
+}
+
+func TestClockUpdate(t *testing.T) {
+	wallTime := int64(1000)
+	c := newTestClock(&wallTime)
+
+	remote := int64(5000<<logicalBits | 7)
+	c.Update(remote)
+	if c.Now() <= remote {
+		t.Fatal("Timestamp not after remote timestamp")
+	}
+
+	// Old, purely logical timestamps are always behind the clock
+	c.Update(42)
+	if c.Now() <= remote {
+		t.Fatal("Timestamp moved backwards")
+	}
+}
+
+func TestClockLogicalOverflow(t *testing.T) {
+	wallTime := int64(1000)
+	c := newTestClock(&wallTime)
+
+	c.Update((1000 << logicalBits) | logicalMask)
+	ts := c.Now()
+	if ts>>logicalBits != 1001 {
+		t.Fatal("Logical counter overflow not carried into wall time")
+	}
+}
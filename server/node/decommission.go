@@ -0,0 +1,149 @@
+package node
+
+import (
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/log"
+	"time"
+)
+
+// How long a leaving node waits between hand off passes.
+// Values written since the previous pass are handed off by the next.
+var decommissionInterval = time.Second
+
+/* Marks this node as leaving the cluster.
+ * Returns the update announcing it, with a new incarnation so that it
+ * overrides any other rumor about this node, and whether the node was
+ * already leaving.
+ */
+func (n *Node) StartDecommission() (*SwimUpdate, bool) {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	wasLeaving := n.Leaving
+	n.Leaving = true
+	n.Incarnation++
+	return &SwimUpdate{Subject: n.ID, State: SwimLeft, Incarnation: n.Incarnation}, wasLeaving
+}
+
+func (n *Node) IsLeaving() bool {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+	return n.Leaving
+}
+
+/* Hands this node's values off to the nodes taking over its ranges, then
+ * calls done. The node keeps accepting writes while leaving, so passes are
+ * repeated until one finds no value newer than those already handed off.
+ * Transfers which failed, and keys which were rejected, are routed again by
+ * the next pass, against the ring as it is then, so the node only leaves
+ * once every value was accepted by a new replica.
+ */
+func (n *Node) Decommission(done func()) {
+	// The version of each value each node acknowledged
+	sent := map[store.Key]map[store.Key]int64{}
+	for {
+		transfers := n.decommissionTransfers(sent)
+		if len(transfers) == 0 {
+			done()
+			return
+		}
+		for peerId, values := range n.sendTransfers(transfers) {
+			if sent[peerId] == nil {
+				sent[peerId] = map[store.Key]int64{}
+			}
+			for key, val := range values {
+				sent[peerId][key] = val.Timestamp
+			}
+		}
+		time.Sleep(decommissionInterval)
+	}
+}
+
+/* Returns the values this node must hand off before leaving, grouped by
+ * the node to send them to. These are the nodes which become replicas of
+ * this node's keys once it is gone from the ring.
+ * Values of the versions in sent are skipped.
+ */
+func (n *Node) decommissionTransfers(
+	sent map[store.Key]map[store.Key]int64) map[store.Key]map[store.Key]*store.StoreVal {
+	n.Lock.RLock()
+	ring := n.Ring()
+	others := []store.Key{}
+	for _, id := range ring.Nodes() {
+		if id != n.ID {
+			others = append(others, id)
+		}
+	}
+	ringAfter := buildRing(others, n.tokensFor)
+	zonesAfter := countZones(others, n.zoneOf)
+	zones := map[store.Key]string{}
+	for _, id := range others {
+		zones[id] = n.zoneOf(id)
+	}
+	n.Lock.RUnlock()
+	zoneOf := func(id store.Key) string { return zones[id] }
+
+	transfers := map[store.Key]map[store.Key]*store.StoreVal{}
+	for _, key := range n.Store.GetKeys() {
+		replicas := ring.Replicas(key, maxReplicas())
+		if !containsKey(replicas, n.ID) {
+			continue
+		}
+		val, err := n.Store.Get(key)
+		if err != nil {
+			continue
+		}
+		for _, newReplica := range zoneAwareWalk(ringAfter, key, maxReplicas(), zonesAfter, zoneOf) {
+			if containsKey(replicas, newReplica) {
+				continue
+			}
+			if version, ok := sent[newReplica][key]; ok && version == val.Timestamp {
+				continue
+			}
+			if transfers[newReplica] == nil {
+				transfers[newReplica] = map[store.Key]*store.StoreVal{}
+			}
+			transfers[newReplica][key] = val
+		}
+	}
+	return transfers
+}
+
+/* Sends the values to their nodes, and waits for all of them to answer.
+ * Returns the values each node accepted. Keys a node rejected, as it does
+ * not see itself as their replica, are left out, so they are sent again
+ * once the views of the ring agree.
+ */
+func (n *Node) sendTransfers(
+	transfers map[store.Key]map[store.Key]*store.StoreVal) map[store.Key]map[store.Key]*store.StoreVal {
+	type result struct {
+		peerId   store.Key
+		rejected []store.Key
+		err      error
+	}
+	results := make(chan result, len(transfers))
+	for peerId, values := range transfers {
+		go func(peerId store.Key, values map[store.Key]*store.StoreVal) {
+			rejected, err := n.sendKeyValuesToNode(peerId, values)
+			results <- result{peerId, rejected, err}
+		}(peerId, values)
+	}
+	accepted := map[store.Key]map[store.Key]*store.StoreVal{}
+	for range transfers {
+		r := <-results
+		if r.err != nil {
+			log.E.Printf("Failed to copy keys to %s: %s\n", r.peerId.String(), r.err)
+			continue
+		}
+		if len(r.rejected) > 0 {
+			log.I.Printf("%s rejected %d keys, routing them again\n",
+				r.peerId.String(), len(r.rejected))
+		}
+		accepted[r.peerId] = map[store.Key]*store.StoreVal{}
+		for key, val := range transfers[r.peerId] {
+			if !containsKey(r.rejected, key) {
+				accepted[r.peerId][key] = val
+			}
+		}
+	}
+	return accepted
+}
@@ -0,0 +1,81 @@
+package node
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tsiemens/kvstore/server/store"
+)
+
+func init() {
+	decommissionInterval = time.Millisecond
+}
+
+// Returns keys this node replicates, and which another node takes over once it leaves
+func keysHandedOff(n *Node, count int) []store.Key {
+	keys := []store.Key{}
+	for i := 0; i < 256 && len(keys) < count; i++ {
+		key := store.Key{byte(i), 0x44}
+		n.Store.Put(key, []byte{1}, 1)
+		if len(n.decommissionTransfers(nil)) > 0 {
+			keys = append(keys, key)
+		}
+		n.Store.Delete(key)
+	}
+	return keys
+}
+
+func TestDecommissionHandsOffLaterWrites(t *testing.T) {
+	n := newTestNode(store.Key{0x10}, store.Key{0x20}, store.Key{0x30}, store.Key{0x40})
+	n.Leaving = true
+	keys := keysHandedOff(n, 2)
+	if len(keys) != 2 {
+		t.Fatal("No keys to hand off")
+	}
+	n.Store.Put(keys[0], []byte{1}, 1)
+
+	var lock sync.Mutex
+	received := map[store.Key]int64{}
+	failures := 1
+	rejections := 1
+	n.sendKeyValuesToNode = func(peer store.Key,
+		values map[store.Key]*store.StoreVal) ([]store.Key, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			// Written while the first pass was being handed off
+			n.Store.Put(keys[1], []byte{2}, 2)
+			return nil, errors.New("unreachable")
+		}
+		rejected := []store.Key{}
+		for key, val := range values {
+			if key == keys[1] && rejections > 0 {
+				// Until the new replica's view of the ring catches up
+				rejections--
+				rejected = append(rejected, key)
+			} else {
+				received[key] = val.Timestamp
+			}
+		}
+		return rejected, nil
+	}
+
+	done := make(chan bool)
+	go n.Decommission(func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Decommission never finished")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if received[keys[0]] != 1 {
+		t.Fatal("Key not handed off again after a failed transfer")
+	}
+	if received[keys[1]] != 2 {
+		t.Fatal("Key written while leaving not handed off after it was rejected")
+	}
+}
@@ -0,0 +1,56 @@
+package node
+
+import (
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/util"
+)
+
+// Hints records the keys this node stores on behalf of other nodes,
+// which were unreachable when the keys were written (sloppy quorum).
+// The values themselves are kept in the node's store.
+type Hints struct {
+	m    map[store.Key]map[store.Key]bool // owner id -> keys
+	lock util.Semaphore
+}
+
+func NewHints() *Hints {
+	return &Hints{
+		m:    map[store.Key]map[store.Key]bool{},
+		lock: util.NewSemaphore(),
+	}
+}
+
+// Records that key is being held for owner
+func (h *Hints) Add(owner store.Key, key store.Key) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	keys, ok := h.m[owner]
+	if !ok {
+		keys = map[store.Key]bool{}
+		h.m[owner] = keys
+	}
+	keys[key] = true
+}
+
+// Removes and returns all keys held for owner
+func (h *Hints) Take(owner store.Key) []store.Key {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	keys := make([]store.Key, 0, len(h.m[owner]))
+	for key := range h.m[owner] {
+		keys = append(keys, key)
+	}
+	delete(h.m, owner)
+	return keys
+}
+
+// Returns the ids of all nodes which have keys held for them
+func (h *Hints) Owners() []store.Key {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	owners := make([]store.Key, 0, len(h.m))
+	for owner := range h.m {
+		owners = append(owners, owner)
+	}
+	return owners
+}
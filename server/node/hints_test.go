@@ -0,0 +1,132 @@
+package node
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tsiemens/kvstore/server/config"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/log"
+)
+
+func init() {
+	log.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	initTestConfig()
+}
+
+// Loads a config keeping 3 replicas of each key
+func initTestConfig() {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	conf := []byte(`{"MaxReplicas": 3, "StatusServerPort": 6667}`)
+	if err := ioutil.WriteFile(path, conf, 0644); err != nil {
+		panic(err)
+	}
+	config.Init(path, true)
+}
+
+// Returns keys this node is not a preferred replica of
+func keysNotReplicated(n *Node, count int) []store.Key {
+	keys := []store.Key{}
+	for i := 0; i < 256 && len(keys) < count; i++ {
+		key := store.Key{byte(i), 0x33}
+		if !containsKey(n.GetPreferredReplicaIdsForKey(key), n.ID) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestHandOffKeepsNewerWrites(t *testing.T) {
+	owner := store.Key{0x10}
+	n := newTestNode(owner, store.Key{0x20}, store.Key{0x30})
+	n.Hints = NewHints()
+	keys := keysNotReplicated(n, 2)
+	if len(keys) != 2 {
+		t.Fatal("No keys to hold for other nodes")
+	}
+	for _, key := range keys {
+		n.Store.Put(key, []byte{1}, 1)
+		n.Hints.Add(owner, key)
+	}
+	sent := make(chan map[store.Key]*store.StoreVal, 1)
+	n.sendKeyValuesToNode = func(peer store.Key,
+		values map[store.Key]*store.StoreVal) ([]store.Key, error) {
+		// Written again while being handed off
+		n.Store.Put(keys[1], []byte{2}, 2)
+		sent <- values
+		return nil, nil
+	}
+
+	n.handOffHints([]store.Key{owner})
+	if values := <-sent; len(values) != 2 || values[keys[1]].Timestamp != 1 {
+		t.Fatal("Hinted values not sent as they were")
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		if _, err := n.Store.Get(keys[0]); err != nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Handed off key not deleted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v, err := n.Store.Get(keys[1]); err != nil || v.Timestamp != 2 {
+		t.Fatal("Newer write deleted after hand off")
+	}
+}
+
+func TestFailedHandOffKeepsHints(t *testing.T) {
+	owner := store.Key{0x10}
+	n := newTestNode(owner)
+	n.Hints = NewHints()
+	key := store.Key{0x42}
+	n.Store.Put(key, []byte{1}, 1)
+	n.sendKeyValuesToNode = func(peer store.Key,
+		values map[store.Key]*store.StoreVal) ([]store.Key, error) {
+		return nil, errors.New("unreachable")
+	}
+
+	val, _ := n.Store.Get(key)
+	n.handOff(owner, []store.Key{key}, map[store.Key]*store.StoreVal{key: val})
+	if held := n.Hints.Take(owner); len(held) != 1 || held[0] != key {
+		t.Fatal("Keys not held again after a failed hand off")
+	}
+}
+
+func TestRejectedHandOffNotHeldAgain(t *testing.T) {
+	owner := store.Key{0x10}
+	n := newTestNode(owner, store.Key{0x20}, store.Key{0x30})
+	n.Hints = NewHints()
+	keys := keysNotReplicated(n, 2)
+	if len(keys) != 2 {
+		t.Fatal("No keys to hold for other nodes")
+	}
+	values := map[store.Key]*store.StoreVal{}
+	for _, key := range keys {
+		n.Store.Put(key, []byte{1}, 1)
+		values[key], _ = n.Store.Get(key)
+	}
+	n.sendKeyValuesToNode = func(peer store.Key,
+		values map[store.Key]*store.StoreVal) ([]store.Key, error) {
+		return []store.Key{keys[1]}, nil
+	}
+
+	n.handOff(owner, keys, values)
+	if held := n.Hints.Take(owner); len(held) != 0 {
+		t.Fatal("Keys held again after the owner answered")
+	}
+	if _, err := n.Store.Get(keys[0]); err == nil {
+		t.Fatal("Handed off key not deleted")
+	}
+	if _, err := n.Store.Get(keys[1]); err != nil {
+		t.Fatal("Rejected key deleted")
+	}
+}
@@ -0,0 +1,122 @@
+package node
+
+import (
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/log"
+	"time"
+)
+
+// A new node joins the cluster by asking a seed for the membership, then
+// announcing itself to every online peer. Each peer pushes it the keys it
+// now replicates, and reports when it is done. The node only coordinates
+// client requests once all of them have, or the join times out.
+
+// Returns whether this node has joined the cluster,
+// and may coordinate client requests
+func (n *Node) IsReady() bool {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+	return n.Ready
+}
+
+/* Merges the membership received from a seed into KnownPeers.
+ * If it includes a rumor that this node failed, such as from before it
+ * restarted, returns the update refuting it. Otherwise returns nil.
+ */
+func (n *Node) ApplyMembership(peers map[store.Key]*Peer) *SwimUpdate {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	var refutation *SwimUpdate
+	for id, peer := range peers {
+		if id != n.ID {
+			n.updateKnownPeer(id, peer)
+		} else {
+			refutation = n.refuteEntry(peer)
+		}
+	}
+	n.updateRing()
+	return refutation
+}
+
+/* Records that this node is waiting for each of peerIds to push its keys.
+ * Returns a channel which is closed once all of them are done.
+ */
+func (n *Node) StartJoinSync(peerIds []store.Key) <-chan bool {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	n.joinPending = map[store.Key]bool{}
+	for _, id := range peerIds {
+		n.joinPending[id] = true
+	}
+	n.joinDone = make(chan bool)
+	if len(n.joinPending) == 0 {
+		close(n.joinDone)
+	}
+	return n.joinDone
+}
+
+// Records that the peer has pushed this node its keys, or failed to
+func (n *Node) JoinSyncDone(peerId store.Key) {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	if !n.joinPending[peerId] {
+		return
+	}
+	delete(n.joinPending, peerId)
+	if len(n.joinPending) == 0 {
+		close(n.joinDone)
+	}
+}
+
+func (n *Node) FinishJoin() {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	if len(n.joinPending) > 0 {
+		log.E.Printf("Joined without keys from %d peers\n", len(n.joinPending))
+	}
+	n.joinPending = nil
+	n.Ready = true
+	log.I.Println("Joined the cluster")
+}
+
+/* Adds the joining node to the ring, as an online peer.
+ * Returns the keys this node must push to it. Keys which other nodes
+ * became replicas of as a result are copied to them in a new goroutine.
+ */
+func (n *Node) AddJoiningPeer(id store.Key, joiner *Peer) map[store.Key]*store.StoreVal {
+	oldRing := n.addJoiningPeer(id, joiner)
+	transfers := n.rereplicationTransfers(oldRing, n.Ring())
+	values := transfers[id]
+	delete(transfers, id)
+	if len(transfers) > 0 {
+		go n.copyToReplicas(transfers)
+	}
+	return values
+}
+
+// Marks the joiner online, and publishes the ring with it.
+// Returns the ring from before it joined
+func (n *Node) addJoiningPeer(id store.Key, joiner *Peer) *Ring {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	peer, ok := n.KnownPeers[id]
+	if !ok {
+		peer = &Peer{}
+		n.KnownPeers[id] = peer
+	}
+	peer.Addr = joiner.Addr
+	peer.Weight = joiner.Weight
+	peer.Zone = joiner.Zone
+	if joiner.Incarnation > peer.Incarnation {
+		peer.Incarnation = joiner.Incarnation
+	}
+	peer.Online = true
+	peer.Suspect = false
+	peer.Left = false
+	peer.LastSeen = time.Now()
+	n.touchPeer(peer)
+
+	oldRing := n.Ring()
+	n.publishRing()
+	return oldRing
+}
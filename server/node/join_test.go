@@ -0,0 +1,31 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/tsiemens/kvstore/server/store"
+)
+
+func TestJoinSyncWaitsForAllPeers(t *testing.T) {
+	n := newTestNode()
+	done := n.StartJoinSync([]store.Key{{0x10}, {0x20}})
+
+	n.JoinSyncDone(store.Key{0x10})
+	n.JoinSyncDone(store.Key{0x10})
+	select {
+	case <-done:
+		t.Fatal("Join finished before every peer was done")
+	default:
+	}
+
+	n.JoinSyncDone(store.Key{0x20})
+	select {
+	case <-done:
+	default:
+		t.Fatal("Join did not finish once every peer was done")
+	}
+	n.FinishJoin()
+	if !n.IsReady() {
+		t.Fatal("Node not ready after joining")
+	}
+}
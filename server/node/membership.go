@@ -0,0 +1,74 @@
+package node
+
+import (
+	"github.com/tsiemens/kvstore/server/config"
+	"github.com/tsiemens/kvstore/server/store"
+	"sort"
+	"time"
+)
+
+// Membership is gossiped in deltas. Each change to a peer's entry sets the
+// entry's version to the next MembershipVersion of this node. A node sends
+// each peer only the entries changed since the version that peer last
+// acknowledged, along with the version they bring it up to, which the peer
+// acknowledges in its next message. A peer which has acknowledged nothing,
+// eg. one this node just met or which restarted, is sent the full state.
+
+type PeerEntry struct {
+	ID   store.Key
+	Peer Peer
+}
+
+type peerEntries []PeerEntry
+
+func (e peerEntries) Len() int           { return len(e) }
+func (e peerEntries) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e peerEntries) Less(i, j int) bool { return e[i].Peer.Version < e[j].Peer.Version }
+
+// Marks the peer's entry as changed, so that it is gossiped again
+func (n *Node) touchPeer(peer *Peer) {
+	n.MembershipVersion++
+	peer.Version = n.MembershipVersion
+	peer.gossipedLastSeen = peer.LastSeen
+}
+
+// Marks the peer's entry as changed if it was last seen long enough after it
+// was last gossiped, so that other nodes do not expire it.
+func (n *Node) refreshPeer(peer *Peer) {
+	refresh := time.Minute
+	if conf := config.GetConfig(); conf != nil && conf.NodeTimeout > 0 {
+		refresh = conf.NodeTimeout / 4
+	}
+	if peer.LastSeen.Sub(peer.gossipedLastSeen) > refresh {
+		n.touchPeer(peer)
+	}
+}
+
+/* Returns copies of the entries the peer has not acknowledged yet, sorted by
+ * version, and the version they bring it up to. Also returns the newest
+ * version of the peer's membership this node has received, to acknowledge.
+ * peerId may be nil if the peer is not known, in which case all entries are
+ * returned.
+ */
+func (n *Node) MembershipDelta(peerId *store.Key) ([]PeerEntry, int, int) {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+	acked, seen := 0, 0
+	if peerId != nil {
+		if peer, ok := n.KnownPeers[*peerId]; ok {
+			acked, seen = peer.AckedVersion, peer.SeenVersion
+		}
+	}
+	if acked > n.MembershipVersion {
+		// The peer acknowledged versions from before this node restarted
+		acked = 0
+	}
+	entries := []PeerEntry{}
+	for id, peer := range n.KnownPeers {
+		if peer.Version > acked {
+			entries = append(entries, PeerEntry{ID: id, Peer: *peer})
+		}
+	}
+	sort.Sort(peerEntries(entries))
+	return entries, n.MembershipVersion, seen
+}
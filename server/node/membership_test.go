@@ -0,0 +1,31 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/tsiemens/kvstore/server/store"
+)
+
+func TestMembershipDeltaSkipsAcknowledgedEntries(t *testing.T) {
+	n := newTestNode()
+	peerId := store.Key{0x10}
+	n.updateKnownPeer(peerId, &Peer{Online: true})
+	n.updateKnownPeer(store.Key{0x20}, &Peer{Online: true})
+
+	entries, version, _ := n.MembershipDelta(&peerId)
+	if len(entries) != 2 || version != n.MembershipVersion {
+		t.Fatal("Expected the full membership for a new peer, got", len(entries))
+	}
+
+	// The peer acknowledges our version in its next message
+	n.KnownPeers[peerId].AckedVersion = version
+	if entries, _, _ = n.MembershipDelta(&peerId); len(entries) != 0 {
+		t.Fatal("Sent acknowledged entries again")
+	}
+
+	n.updateKnownPeer(store.Key{0x20}, &Peer{Online: false})
+	entries, _, _ = n.MembershipDelta(&peerId)
+	if len(entries) != 1 || entries[0].ID != (store.Key{0x20}) || entries[0].Peer.Online {
+		t.Fatal("Expected only the changed entry")
+	}
+}
@@ -6,32 +6,61 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/tsiemens/kvstore/server/config"
+	"github.com/tsiemens/kvstore/server/seeds"
 	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/server/txn"
 	"github.com/tsiemens/kvstore/shared/log"
 	"github.com/tsiemens/kvstore/shared/util"
 	"net"
 	"sort"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const timeErr = time.Millisecond * 50
-
-// Node represents this machine, as one in a cluster of nodes.
+/* Node represents this machine, as one in a cluster of nodes.
+ * Lock guards the membership view: KnownPeers and the peers in it, and the
+ * state below it. Exported methods take the lock themselves, and hand out
+ * copies of peers. Unexported ones expect the caller to hold it.
+ * The ring is published as an immutable snapshot, which is read without it.
+ */
 type Node struct {
 	ID                  store.Key // Not needed just yet, but it will later
 	KnownPeers          map[store.Key]*Peer
-	NodeKeyList         []store.Key
-	Lock                util.Semaphore
+	Lock                sync.RWMutex
+	ring                atomic.Value // *Ring, the latest published
 	Conn                *net.UDPConn
 	Store               *store.Store
+	Clock               *Clock // Issues write versions
+	Hints               *Hints
+	unreplicated        *Hints // Keys which failed to copy to their new replicas, by replica
+	Txns                *txn.Manager
+	Incarnation         int     // Incremented by this node to refute rumors of its failure
+	Weight              float64 // Relative share of the keyspace this node takes
+	Zone                string  // Replicas are spread over as many zones as possible
+	Leaving             bool    // Being decommissioned
+	Ready               bool    // Joined the cluster, so may coordinate client requests
+	MembershipVersion   int     // Version of the latest change to KnownPeers
+	joinPending         map[store.Key]bool
+	joinDone            chan bool
 	sendKeyValuesToNode KeyValueMigrator
 }
 
 type Peer struct {
-	Online   bool
-	LastSeen time.Time
-	Addr     *net.UDPAddr
+	Online       bool
+	LastSeen     time.Time
+	Addr         *net.UDPAddr
+	Incarnation  int  // The newest incarnation of the peer heard of
+	Suspect      bool // Suspected failed. Still online until confirmed
+	SuspectSince time.Time
+	Weight       float64 // 0 if not known yet
+	Zone         string
+	Left         bool // Decommissioned. Only comes back online with a higher incarnation
+	Version      int  // MembershipVersion of the last change to this entry
+	AckedVersion int  // Our MembershipVersion the peer last acknowledged
+	SeenVersion  int  // The peer's MembershipVersion we last received
+
+	gossipedLastSeen time.Time
 }
 
 var node *Node
@@ -41,13 +70,17 @@ func Init(localAddr *net.UDPAddr, conn *net.UDPConn, procStore *store.Store,
 	node = &Node{
 		ID:                  createNodeID(localAddr),
 		KnownPeers:          map[store.Key]*Peer{},
-		NodeKeyList:         []store.Key{},
-		Lock:                util.NewSemaphore(),
 		Conn:                conn,
 		Store:               procStore,
+		Clock:               NewClock(),
+		Hints:               NewHints(),
+		unreplicated:        NewHints(),
+		Txns:                txn.NewManager(),
+		Weight:              config.GetConfig().Weight,
+		Zone:                config.GetConfig().Zone,
 		sendKeyValuesToNode: sendKVs,
 	}
-	node.UpdateSortedKeys()
+	node.publishRing()
 	log.I.Println("Node initialized with ID: " + node.ID.String())
 }
 
@@ -62,40 +95,31 @@ func createNodeID(localAddr *net.UDPAddr) store.Key {
 	return store.Key(sha256.Sum256(buf.Bytes()))
 }
 
-func wellKnownPeers() []*net.UDPAddr {
-	conf := config.GetConfig()
+// Returns the seed nodes, other than this node
+func WellKnownPeers() []*net.UDPAddr {
 	var myAddr *net.UDPAddr
 	if GetProcessNode() != nil {
 		myAddr = GetProcessNode().Conn.LocalAddr().(*net.UDPAddr)
 	}
-	if conf.UseLoopback {
-		p, _ := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(conf.DefaultLocalhostPort))
-		if myAddr != nil && util.AddrsEqual(myAddr, p) {
-			return []*net.UDPAddr{}
-		} else {
-			return []*net.UDPAddr{p}
+	seedAddrs := seeds.GetSeeds().Addrs()
+	knownPeers := make([]*net.UDPAddr, 0, len(seedAddrs))
+	for _, peerAddr := range seedAddrs {
+		if myAddr == nil || !util.AddrsEqual(myAddr, peerAddr) {
+			knownPeers = append(knownPeers, peerAddr)
 		}
-	} else {
-		knownPeers := make([]*net.UDPAddr, 0, len(conf.PeerList))
-		for _, peer := range conf.PeerList {
-			peerAddr, _ := net.ResolveUDPAddr("udp", peer)
-			if myAddr == nil || !util.AddrsEqual(myAddr, peerAddr) {
-				knownPeers = append(knownPeers, peerAddr)
-			}
-		}
-		return knownPeers
 	}
+	return knownPeers
 }
 
 func RandomWellKnownPeer() *Peer {
-	wellKnown := wellKnownPeers()
+	wellKnown := WellKnownPeers()
 	if len(wellKnown) == 0 { // May happen when this node is the only well known one
 		return nil
 	}
 	return &Peer{Addr: wellKnown[util.Rand.Intn(len(wellKnown))]}
 }
 
-func (node *Node) CountOnlinePeers() int {
+func (node *Node) countOnlinePeers() int {
 	count := 0
 	for _, peer := range node.KnownPeers {
 		if peer.Online {
@@ -105,10 +129,12 @@ func (node *Node) CountOnlinePeers() int {
 	return count
 }
 
+// Returns a copy of a random online peer, and its id.
+// If none are online, returns a well known peer, and a nil id.
 func (node *Node) RandomPeer() (*Peer, *store.Key) {
-	node.Lock.Lock()
-	defer node.Lock.Unlock()
-	size := node.CountOnlinePeers()
+	node.Lock.RLock()
+	defer node.Lock.RUnlock()
+	size := node.countOnlinePeers()
 	if size == 0 {
 		log.D.Println("No peers online. Looking for well known peers...")
 		return RandomWellKnownPeer(), nil
@@ -118,7 +144,8 @@ func (node *Node) RandomPeer() (*Peer, *store.Key) {
 	for key, peer := range node.KnownPeers {
 		if peer.Online {
 			if i == rand {
-				return peer, &key
+				peerCopy := *peer
+				return &peerCopy, &key
 			}
 			i += 1
 		}
@@ -127,7 +154,7 @@ func (node *Node) RandomPeer() (*Peer, *store.Key) {
 	return nil, nil
 }
 
-func (node *Node) CleanupKnownNodes() {
+func (node *Node) cleanupKnownNodes() {
 	now := time.Now()
 	TimeTillMemberDrop := config.GetConfig().NodeTimeout
 	for key, peer := range node.KnownPeers {
@@ -138,36 +165,33 @@ func (node *Node) CleanupKnownNodes() {
 	}
 }
 
-func (node *Node) UpdateSortedKeys() {
-	node.NodeKeyList = make([]store.Key, 0, len(node.KnownPeers)+1)
-	for k, peer := range node.KnownPeers {
-		if peer.Online {
-			node.NodeKeyList = append(node.NodeKeyList, k)
-		}
-	}
-	node.NodeKeyList = append(node.NodeKeyList, node.ID)
-	sort.Sort(store.Keys(node.NodeKeyList))
-}
-
-func (node *Node) UpdatePeers(peers map[store.Key]*Peer, sendingPeerId store.Key, sendingAddr *net.UDPAddr) {
+/* Merges the peers received from another node into KnownPeers.
+ * sender describes the sending node itself: its address, incarnation, weight
+ * and zone. If the peers include a rumor that this node failed or left,
+ * returns the update refuting it. Otherwise returns nil.
+ */
+func (node *Node) UpdatePeers(peers map[store.Key]*Peer, sendingPeerId store.Key,
+	sender *Peer) *SwimUpdate {
 	node.Lock.Lock()
 	defer node.Lock.Unlock()
-	newOnlineNodes := make([]store.Key, 1)
-	oldLowerBoundKey := node.GetNextLowestPeerKey()
+	newOnlineNodes := make([]store.Key, 0, 1)
+	var refutation *SwimUpdate
 	log.D.Println("Updating peers...")
 	for key, remotePeerVal := range peers {
-		if key != node.ID {
-			if node.updateKnownPeer(key, remotePeerVal) {
-				// Node is new or used to be offline and is now online
-				newOnlineNodes = append(newOnlineNodes, key)
+		if key == node.ID {
+			if u := node.refuteEntry(remotePeerVal); u != nil {
+				refutation = u
 			}
+		} else if node.updateKnownPeer(key, remotePeerVal) {
+			// Node is new or used to be offline and is now online
+			newOnlineNodes = append(newOnlineNodes, key)
 		}
 	}
 
 	// Using loopback, it's possible for a node to send a
 	// gossip membership message to itself
 	if sendingPeerId == node.ID {
-		return
+		return refutation
 	}
 
 	var sendingPeer *Peer
@@ -176,160 +200,264 @@ func (node *Node) UpdatePeers(peers map[store.Key]*Peer, sendingPeerId store.Key
 	} else {
 		sendingPeer = &Peer{}
 		node.KnownPeers[sendingPeerId] = sendingPeer
-		sendingPeer.Addr = sendingAddr
-		newOnlineNodes = append(newOnlineNodes, sendingPeerId)
+		sendingPeer.Addr = sender.Addr
+	}
+	changed := sendingPeer.Zone != sender.Zone ||
+		(sender.Weight > 0 && sendingPeer.Weight != sender.Weight)
+	// Hearing from the sender directly refutes a rumor that it failed only if
+	// the rumor is about an older incarnation. Otherwise the sender is told of
+	// the rumor in our reply, and refutes it itself.
+	if sendingPeer.State() <= SwimSuspect || sender.Incarnation > sendingPeer.Incarnation {
+		if !sendingPeer.Online {
+			newOnlineNodes = append(newOnlineNodes, sendingPeerId)
+		}
+		changed = changed || !sendingPeer.Online
+		sendingPeer.Online = true
+		sendingPeer.Left = false
+		if sender.Incarnation > sendingPeer.Incarnation {
+			sendingPeer.Incarnation = sender.Incarnation
+			sendingPeer.Suspect = false
+			changed = true
+		}
 	}
 	sendingPeer.LastSeen = time.Now()
-	sendingPeer.Online = true
+	if sender.Weight > 0 {
+		sendingPeer.Weight = sender.Weight
+	}
+	sendingPeer.Zone = sender.Zone
+	sendingPeer.SeenVersion = sender.SeenVersion
+	sendingPeer.AckedVersion = sender.AckedVersion
+	if changed {
+		node.touchPeer(sendingPeer)
+	} else {
+		node.refreshPeer(sendingPeer)
+	}
 
-	node.CleanupKnownNodes()
-	node.UpdateSortedKeys()
-	node.handleNewPeersOnline(newOnlineNodes, oldLowerBoundKey)
+	node.cleanupKnownNodes()
+	node.updateRing()
+	node.handOffHints(newOnlineNodes)
 	log.D.Println("Done.")
+	return refutation
 }
 
-// Updates the peer for key in KnownPeers with the newly received remotePeerVal
-// Returns true if the node has just come online
+/* Updates the peer for key in KnownPeers with the newly received remotePeerVal.
+ * The entry with the higher incarnation wins. For the same incarnation, the
+ * later state wins: left over failed over suspect over alive.
+ * Returns true if the node has just come online
+ */
 func (node *Node) updateKnownPeer(key store.Key, remotePeerVal *Peer) bool {
-	isNewlyOnline := false
 	log.D.Println("updating " + key.String())
-	if _, ok := node.KnownPeers[key]; ok {
-		if time.Now().Add(timeErr).After(remotePeerVal.LastSeen) {
-			peerVal := node.KnownPeers[key]
-			if !peerVal.Online && remotePeerVal.Online {
-				isNewlyOnline = true
-			}
-			peerVal.Online = remotePeerVal.Online
-			if peerVal.LastSeen.Before(remotePeerVal.LastSeen) {
-				peerVal.LastSeen = remotePeerVal.LastSeen
-			}
+	peerVal, ok := node.KnownPeers[key]
+	if !ok {
+		peer := &Peer{Online: remotePeerVal.Online, LastSeen: remotePeerVal.LastSeen,
+			Addr: remotePeerVal.Addr, Weight: remotePeerVal.Weight, Zone: remotePeerVal.Zone,
+			Incarnation: remotePeerVal.Incarnation, Suspect: remotePeerVal.Suspect,
+			Left: remotePeerVal.Left}
+		if peer.Suspect {
+			peer.SuspectSince = time.Now()
 		}
-	} else {
-		node.KnownPeers[key] = remotePeerVal
-		if remotePeerVal.Online {
-			isNewlyOnline = true
+		node.KnownPeers[key] = peer
+		node.touchPeer(peer)
+		return peer.Online
+	}
+
+	isNewlyOnline := false
+	if remotePeerVal.Incarnation > peerVal.Incarnation ||
+		(remotePeerVal.Incarnation == peerVal.Incarnation &&
+			remotePeerVal.State() > peerVal.State()) {
+		isNewlyOnline = !peerVal.Online && remotePeerVal.Online
+		if remotePeerVal.Suspect && !peerVal.Suspect {
+			peerVal.SuspectSince = time.Now()
 		}
+		peerVal.Incarnation = remotePeerVal.Incarnation
+		peerVal.Online = remotePeerVal.Online
+		peerVal.Suspect = remotePeerVal.Suspect
+		peerVal.Left = remotePeerVal.Left
+		node.touchPeer(peerVal)
+	}
+	// Only used to expire peers which have not been heard of in a long time
+	if peerVal.LastSeen.Before(remotePeerVal.LastSeen) {
+		peerVal.LastSeen = remotePeerVal.LastSeen
+		node.refreshPeer(peerVal)
+	}
+	// The weight is only 0 if the sender didn't know the peer's details yet
+	if remotePeerVal.Weight > 0 && (peerVal.Weight != remotePeerVal.Weight ||
+		peerVal.Zone != remotePeerVal.Zone) {
+		peerVal.Weight = remotePeerVal.Weight
+		peerVal.Zone = remotePeerVal.Zone
+		node.touchPeer(peerVal)
 	}
 	return isNewlyOnline
 }
 
-// Handles the case when a peer was previously not known, or is now online
-// If a value transfer is required, spawns new goroutines to copy it.
-func (n *Node) handleNewPeersOnline(peerIds []store.Key,
-	oldLowerBound store.Key) {
-
-	storeKeys := n.Store.GetSortedKeys()
-	for _, newPeerKey := range peerIds {
-		if (&newPeerKey).Between(oldLowerBound, n.ID) {
-			nodesKeys := n.GetAllKeysForNode(newPeerKey, storeKeys)
-			// send all keys in this range
-			values := make(map[store.Key]*store.StoreVal, len(nodesKeys))
-			for _, key := range nodesKeys {
-				val, err := n.Store.Get(key)
-				if err == nil {
-					values[key] = val
-				}
-			}
-			go n.sendKeyValuesToNode(newPeerKey, values)
-		}
-	}
+// Returns the replica ids for key, in the latest ring
+func (n *Node) GetReplicaIdsForKey(key store.Key) []store.Key {
+	return n.Ring().Replicas(key, maxReplicas())
 }
 
-func (n *Node) GetAllKeysForNode(peerKey store.Key,
-	sortedStoreKeys []store.Key) []store.Key {
-
-	nextLowest := n.GetNextLowestPeerKeyFrom(peerKey)
-	// probabalistic size for efficiency
-	//keys := make([]store.Key, int(float32(len(sortedStoreKeys))*0.6))
-	//copy all keys on the next lowest peer
-	keys := make([]store.Key, len(sortedStoreKeys))
-	for _, storeKey := range sortedStoreKeys {
-		if storeKey.Between(nextLowest, peerKey) {
-			keys = append(keys, storeKey)
-		}
+// Returns the replica ids of the range with id, the token at its end,
+// or none if no online node owns that token
+func (n *Node) GetRangeReplicaIds(id store.Key) []store.Key {
+	return n.Ring().RangeReplicas(id, maxReplicas())
+}
+
+// Returns whether this node is one of the replicas of key
+func (n *Node) IsReplicaForKey(key store.Key) bool {
+	return containsKey(n.GetReplicaIdsForKey(key), n.ID)
+}
+
+// Returns the replica ids for key as if every known peer were online.
+// Used by sloppy quorums, where unreachable replicas are substituted.
+func (n *Node) GetPreferredReplicaIdsForKey(key store.Key) []store.Key {
+	return n.Ring().PreferredReplicas(key, maxReplicas())
+}
+
+// Returns the online nodes which may stand in for unreachable preferred
+// replicas of key, in the order they should be tried.
+func (n *Node) GetStandInIdsForKey(key store.Key, preferred []store.Key) []store.Key {
+	return n.Ring().StandIns(key, preferred)
+}
+
+// Returns the sorted ids of this node and all known peers, online or not
+func (n *Node) allNodeKeys() []store.Key {
+	ring := make([]store.Key, 0, len(n.KnownPeers)+1)
+	for k := range n.KnownPeers {
+		ring = append(ring, k)
 	}
-	return keys
+	ring = append(ring, n.ID)
+	sort.Sort(store.Keys(ring))
+	return ring
 }
 
-func (n *Node) GetNextLowestPeerKey() store.Key {
-	return n.GetNextLowestPeerKeyFrom(n.ID)
+func (n *Node) isOnline(nodeKey store.Key) bool {
+	if nodeKey == n.ID {
+		return true
+	}
+	peer, ok := n.KnownPeers[nodeKey]
+	return ok && peer.Online
 }
 
-func (n *Node) GetNextLowestPeerKeyFrom(key store.Key) store.Key {
-	for i, nodekey := range n.NodeKeyList {
-		if nodekey == key {
-			return n.NodeKeyList[n.getPredecessorIndexOfNodeAtIndex(i)]
+// Sends keys held on behalf of any online peers back to them.
+func (n *Node) HandOffHints() {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	owners := []store.Key{}
+	for _, owner := range n.Hints.Owners() {
+		if n.isOnline(owner) && owner != n.ID {
+			owners = append(owners, owner)
 		}
 	}
-	return key
+	n.handOffHints(owners)
 }
 
-func (n *Node) getPredecessorIndexOfNodeAtIndex(index int) int {
-	if index == 0 {
-		return len(n.NodeKeyList) - 1
-	} else {
-		return index - 1
+// Sends keys held on behalf of peerIds back to them.
+// Spawns new goroutines to copy the values.
+func (n *Node) handOffHints(peerIds []store.Key) {
+	for _, owner := range peerIds {
+		keys := n.Hints.Take(owner)
+		if len(keys) == 0 {
+			continue
+		}
+		values := make(map[store.Key]*store.StoreVal, len(keys))
+		for _, key := range keys {
+			val, err := n.Store.Get(key)
+			if err == nil {
+				// A copy, since removes update the stored value in place
+				valCopy := *val
+				values[key] = &valCopy
+			}
+		}
+		go n.handOff(owner, keys, values)
 	}
 }
 
-func (n *Node) GetReplicaIdsForKey(key store.Key) []store.Key {
-	headKeyPtr, _ := n.GetPeerResponsibleForKey(key)
-	var headKeyIndex int
-	for i, nodeKey := range n.NodeKeyList {
-		if nodeKey == *headKeyPtr {
-			headKeyIndex = i
-			break
+/* Sends the values held for owner to it. Once it has them, deletes the ones
+ * this node is not a replica of, unless they were written again meanwhile.
+ * Keys the owner rejected, as it is no longer their replica, are neither
+ * held for it nor deleted. Their replicas got them when the ring changed.
+ */
+func (n *Node) handOff(owner store.Key, keys []store.Key, values map[store.Key]*store.StoreVal) {
+	rejected, err := n.sendKeyValuesToNode(owner, values)
+	if err != nil {
+		// Keep holding the keys, and try again later
+		for _, key := range keys {
+			n.Hints.Add(owner, key)
+		}
+		return
+	}
+	log.I.Printf("Handed off %d hinted keys to %s\n", len(values)-len(rejected), owner.String())
+	kept := map[store.Key]bool{}
+	for _, key := range rejected {
+		kept[key] = true
+	}
+	ring := n.Ring()
+	for key, val := range values {
+		if kept[key] {
+			continue
+		}
+		if !containsKey(ring.PreferredReplicas(key, maxReplicas()), n.ID) {
+			n.Store.DeleteIfVersion(key, val.Timestamp)
 		}
 	}
-	maxReplicas := config.GetConfig().MaxReplicas
-	keys := make([]store.Key, 0, maxReplicas)
-	keys = append(keys, *headKeyPtr)
-	nextReplicaIndex := n.getPredecessorIndexOfNodeAtIndex(headKeyIndex)
-	for len(keys) < maxReplicas && n.NodeKeyList[nextReplicaIndex] != *headKeyPtr {
-		keys = append(keys, n.NodeKeyList[nextReplicaIndex])
-		nextReplicaIndex = n.getPredecessorIndexOfNodeAtIndex(nextReplicaIndex)
+}
+
+// Records the outcome of a transaction this node prepared,
+// and applies its writes if committed.
+func (n *Node) FinishTransaction(id txn.ID, commit bool, timestamp int64) {
+	n.Clock.Update(timestamp)
+	if rec := n.Txns.Finish(id, commit, timestamp); rec != nil {
+		txn.Apply(n.Store, rec)
+		log.I.Printf("Committed transaction %x\n", id)
 	}
-	return keys
 }
 
 // This is really irritating that we need this because of IMPORT CYCLES
-type KeyValueMigrator func(peerKey store.Key, values map[store.Key]*store.StoreVal)
+// Returns the keys the peer rejected, or an error if it could not be reached
+type KeyValueMigrator func(peerKey store.Key,
+	values map[store.Key]*store.StoreVal) ([]store.Key, error)
 
 func (n *Node) SetPeerOffline(peerId store.Key) {
-	if peer, ok := node.KnownPeers[peerId]; ok {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	if peer, ok := n.KnownPeers[peerId]; ok {
 		peer.Online = false
+		n.touchPeer(peer)
 	}
-	node.UpdateSortedKeys()
+	n.updateRing()
+}
+
+// Returns a copy of the peer with id, and whether it is known
+func (n *Node) GetPeer(id store.Key) (*Peer, bool) {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+	peer, ok := n.KnownPeers[id]
+	if !ok {
+		return nil, false
+	}
+	peerCopy := *peer
+	return &peerCopy, true
 }
 
 /* Returns the peer that should handle the given key.
  * Returns nil peer if this node is responsible.
- * A peer is responsible if it is the next higher or equal to the key
+ * A peer is responsible if it owns the next token higher or equal to the key
  */
 func (n *Node) GetPeerResponsibleForKey(key store.Key) (*store.Key, *Peer) {
-	responsibleKey := n.NodeKeyList[0]
-	for _, nodekey := range n.NodeKeyList {
-		if nodekey.GreaterEquals(key) {
-			if nodekey == n.ID {
-				responsibleKey = nodekey
-				break
-			}
-			if node, ok := n.KnownPeers[nodekey]; ok && node.Online {
-				responsibleKey = nodekey
-				break
-			}
-		}
-	}
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+	responsibleKey := n.Ring().Owner(key)
 	if responsibleKey == n.ID {
 		return &responsibleKey, nil
-	} else {
-		return &responsibleKey, n.KnownPeers[responsibleKey]
 	}
+	peerCopy := *n.KnownPeers[responsibleKey]
+	return &responsibleKey, &peerCopy
 }
 
-func PeerListString(peers map[store.Key]*Peer) string {
+func (n *Node) PeerListString() string {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
 	s := ""
-	for key, peer := range peers {
+	for key, peer := range n.KnownPeers {
 		s += fmt.Sprintf("	%s: %s, online:%v, lastseen:%s\n",
 			key.String(), peer.Addr.String(), peer.Online,
 			peer.LastSeen.String())
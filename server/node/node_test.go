@@ -0,0 +1,60 @@
+package node
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/tsiemens/kvstore/server/store"
+)
+
+// Run with -race. Mutates the membership view from several goroutines,
+// as message handlers do, while others read it.
+func TestConcurrentMembershipAccess(t *testing.T) {
+	peerIds := []store.Key{{0x10}, {0x20}, {0x30}, {0x40}}
+	n := newTestNode(peerIds...)
+	var wg sync.WaitGroup
+	errs := make(chan string, 8*50)
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				peerId := peerIds[(i+j)%len(peerIds)]
+				switch j % 4 {
+				case 0:
+					n.SuspectPeer(peerId)
+				case 1:
+					n.ApplySwimUpdate(&SwimUpdate{Subject: peerId, State: SwimAlive,
+						Incarnation: j})
+				case 2:
+					n.SetPeerOffline(peerId)
+				case 3:
+					n.PeerAcked(peerId, j)
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := store.Key{byte(i), byte(j)}
+				n.GetReplicaIdsForKey(key)
+				n.GetStandInIdsForKey(key, n.GetPreferredReplicaIdsForKey(key))
+				n.RandomOnlinePeers(2, n.ID)
+				n.MembershipDelta(&peerIds[0])
+				// Returned peers are copies, which may be changed without the lock
+				peerId := peerIds[j%len(peerIds)]
+				if peer, ok := n.GetPeer(peerId); ok {
+					peer.Weight = -1
+					if again, _ := n.GetPeer(peerId); again.Weight == -1 {
+						errs <- "GetPeer returned the known peer itself"
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
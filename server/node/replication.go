@@ -0,0 +1,118 @@
+package node
+
+import (
+	"github.com/tsiemens/kvstore/server/store"
+)
+
+/* Rebuilds the ring from the online peers, and restores the replication
+ * of keys whose replica sets changed.
+ * The caller must hold the lock. The keys are found and copied in a new
+ * goroutine, without it.
+ */
+func (n *Node) updateRing() {
+	oldRing := n.Ring()
+	n.publishRing()
+	if ring := n.Ring(); !ringsEqual(oldRing.tokens, ring.tokens) {
+		go n.copyToReplicas(n.rereplicationTransfers(oldRing, ring))
+	}
+}
+
+/* Sends the values to the nodes which became their replicas.
+ * Keys which failed to copy are recorded, and copied again by
+ * RetryRereplication.
+ */
+func (n *Node) copyToReplicas(transfers map[store.Key]map[store.Key]*store.StoreVal) {
+	acked := n.sendTransfers(transfers)
+	for peerId, values := range transfers {
+		if _, ok := acked[peerId]; ok {
+			continue
+		}
+		for key := range values {
+			n.unreplicated.Add(peerId, key)
+		}
+	}
+}
+
+/* Copies the keys which failed to copy to their new replicas again, with
+ * their current values. Keys of replicas which went offline, or are no
+ * longer replicas of them, are dropped. The ring change which brings such a
+ * replica back copies the keys it needs.
+ * Spawns new goroutines to copy the values.
+ */
+func (n *Node) RetryRereplication() {
+	ring := n.Ring()
+	transfers := map[store.Key]map[store.Key]*store.StoreVal{}
+	for _, peerId := range n.unreplicated.Owners() {
+		keys := n.unreplicated.Take(peerId)
+		if !ring.online[peerId] {
+			continue
+		}
+		for _, key := range keys {
+			if !containsKey(ring.Replicas(key, maxReplicas()), peerId) {
+				continue
+			}
+			if val, err := n.Store.Get(key); err == nil {
+				if transfers[peerId] == nil {
+					transfers[peerId] = map[store.Key]*store.StoreVal{}
+				}
+				transfers[peerId][key] = val
+			}
+		}
+	}
+	if len(transfers) > 0 {
+		go n.copyToReplicas(transfers)
+	}
+}
+
+/* Returns the keys to copy to the nodes which became their replicas when the
+ * ring changed from oldRing to ring, because a node joined, failed or left,
+ * grouped by the node to send them to. Each such key is copied by the first
+ * of its new replicas which was already one, or by this node if there is
+ * none, so that the replication factor is restored.
+ * Scans the whole store, so must not be called with the lock held.
+ */
+func (n *Node) rereplicationTransfers(oldRing *Ring,
+	ring *Ring) map[store.Key]map[store.Key]*store.StoreVal {
+	toSend := map[store.Key]map[store.Key]*store.StoreVal{}
+	if ringsEqual(oldRing.tokens, ring.tokens) {
+		return toSend
+	}
+	for _, key := range n.Store.GetKeys() {
+		replicas := ring.Replicas(key, maxReplicas())
+		oldReplicas := oldRing.Replicas(key, maxReplicas())
+		sender := n.ID
+		for _, replica := range replicas {
+			if containsKey(oldReplicas, replica) {
+				sender = replica
+				break
+			}
+		}
+		if sender != n.ID {
+			continue
+		}
+		for _, replica := range replicas {
+			if replica == n.ID || containsKey(oldReplicas, replica) {
+				continue
+			}
+			if val, err := n.Store.Get(key); err == nil {
+				if toSend[replica] == nil {
+					toSend[replica] = map[store.Key]*store.StoreVal{}
+				}
+				toSend[replica][key] = val
+			}
+		}
+	}
+	return toSend
+}
+
+func ringsEqual(a []RingToken, b []RingToken) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package node
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tsiemens/kvstore/server/store"
+)
+
+func TestFailedRereplicationRetried(t *testing.T) {
+	failed := store.Key{0x10}
+	n := newTestNode(failed, store.Key{0x20}, store.Key{0x30})
+	for i := 0; i < 256; i++ {
+		n.Store.Put(store.Key{byte(i), 0x55}, []byte{1}, 1)
+	}
+	var lock sync.Mutex
+	reachable := false
+	received := map[store.Key]bool{}
+	n.sendKeyValuesToNode = func(peer store.Key,
+		values map[store.Key]*store.StoreVal) ([]store.Key, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !reachable {
+			return nil, errors.New("unreachable")
+		}
+		for key := range values {
+			received[key] = true
+		}
+		return nil, nil
+	}
+
+	n.Lock.Lock()
+	n.KnownPeers[failed].Online = false
+	n.updateRing()
+	n.Lock.Unlock()
+	waitFor(t, "Failed copies not recorded", func() bool {
+		return len(n.unreplicated.Owners()) > 0
+	})
+
+	lock.Lock()
+	reachable = true
+	lock.Unlock()
+	n.RetryRereplication()
+	waitFor(t, "Failed copies not retried", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) > 0 && len(n.unreplicated.Owners()) == 0
+	})
+}
+
+func waitFor(t *testing.T, failure string, cond func() bool) {
+	for deadline := time.Now().Add(time.Second * 5); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal(failure)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,331 @@
+package node
+
+import (
+	"crypto/sha256"
+	"github.com/tsiemens/kvstore/server/config"
+	"github.com/tsiemens/kvstore/server/store"
+	"math"
+	"sort"
+)
+
+// The consistent hash ring. Each node owns VirtualNodes tokens (positions)
+// on the ring per unit of weight, so that its share of the key space is split
+// into many small ranges, and is in proportion to its weight.
+// A key belongs to the node owning the first token at or after it,
+// and is replicated on the nodes owning the preceding tokens.
+
+type RingToken struct {
+	Token store.Key
+	Node  store.Key
+}
+
+type ringTokens []RingToken
+
+func (r ringTokens) Len() int           { return len(r) }
+func (r ringTokens) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r ringTokens) Less(i, j int) bool { return r[i].Token.LessThan(r[j].Token) }
+
+// Returns the number of tokens a node with weight owns.
+// Unknown weights (0) count as 1
+func tokenCount(weight float64) int {
+	virtualNodes := 1
+	if conf := config.GetConfig(); conf != nil && conf.VirtualNodes > 1 {
+		virtualNodes = conf.VirtualNodes
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	count := int(math.Floor(float64(virtualNodes)*weight + 0.5))
+	if count < 1 {
+		return 1
+	}
+	return count
+}
+
+// Returns the configured number of replicas of each key
+func maxReplicas() int {
+	if conf := config.GetConfig(); conf != nil {
+		return conf.MaxReplicas
+	}
+	return 3
+}
+
+// Returns the number of tokens the node with id owns
+func (n *Node) tokensFor(id store.Key) int {
+	if id == n.ID {
+		return tokenCount(n.Weight)
+	}
+	if peer, ok := n.KnownPeers[id]; ok {
+		return tokenCount(peer.Weight)
+	}
+	return tokenCount(0)
+}
+
+// Returns the tokens of the node with id. The first token is the id itself,
+// and the others are derived from it, so that any node can compute them.
+func NodeTokens(id store.Key, count int) []store.Key {
+	tokens := make([]store.Key, 0, count)
+	tokens = append(tokens, id)
+	for i := 1; i < count; i++ {
+		data := make([]byte, 0, len(id)+2)
+		data = append(data, id[:]...)
+		data = append(data, byte(i>>8), byte(i))
+		tokens = append(tokens, store.Key(sha256.Sum256(data)))
+	}
+	return tokens
+}
+
+// Returns the tokens of all the nodes, sorted
+func buildRing(nodeIds []store.Key, tokensFor func(store.Key) int) []RingToken {
+	ring := make([]RingToken, 0, len(nodeIds))
+	for _, id := range nodeIds {
+		for _, token := range NodeTokens(id, tokensFor(id)) {
+			ring = append(ring, RingToken{Token: token, Node: id})
+		}
+	}
+	sort.Sort(ringTokens(ring))
+	return ring
+}
+
+/* Ring is an immutable snapshot of the ring, as the node saw its membership
+ * at one point. The node publishes a new Ring whenever its membership changes,
+ * so that a request which keeps the snapshot it started with routes against
+ * one consistent view, however the membership changes meanwhile.
+ */
+type Ring struct {
+	Version   int                  // Increases with every Ring the node publishes
+	nodes     []store.Key          // Sorted ids of the online nodes
+	tokens    []RingToken          // Tokens of the online nodes, sorted
+	allTokens []RingToken          // Tokens of all known nodes, online or not
+	online    map[store.Key]bool   // Online nodes
+	zones     map[store.Key]string // Zones of all known nodes
+	nZones    int                  // Distinct zones of the online nodes
+	allZones  int                  // Distinct zones of all known nodes
+}
+
+// KeyRange is the range of keys after Start, up to and including End.
+// It wraps around the end of the keyspace if End is not after Start.
+type KeyRange struct {
+	Start store.Key
+	End   store.Key
+}
+
+func (r KeyRange) Contains(key store.Key) bool {
+	return key.Between(r.Start, r.End)
+}
+
+// Returns the id of the node responsible for key
+func (r *Ring) Owner(key store.Key) store.Key {
+	return r.tokens[ringIndex(r.tokens, key)].Node
+}
+
+/* Returns the id of the range which holds key, which is the token at its end.
+ * It stays the same as long as the token's node is online, and the replicas
+ * of the id are those of every key in the range.
+ */
+func (r *Ring) RangeID(key store.Key) store.Key {
+	return r.tokens[ringIndex(r.tokens, key)].Token
+}
+
+// Returns the first n replicas of key, starting with its owner
+func (r *Ring) Replicas(key store.Key, n int) []store.Key {
+	return zoneAwareWalk(r.tokens, key, n, r.nZones, r.zoneOf)
+}
+
+// Returns the first n replicas of the range with id, starting with the node
+// owning its token, or none if id is not the token of an online node.
+func (r *Ring) RangeReplicas(id store.Key, n int) []store.Key {
+	if len(r.tokens) == 0 || r.tokens[ringIndex(r.tokens, id)].Token != id {
+		return nil
+	}
+	return r.Replicas(id, n)
+}
+
+// Returns the first n replicas of key as if every known node were online.
+// Used by sloppy quorums, where unreachable replicas are substituted.
+func (r *Ring) PreferredReplicas(key store.Key, n int) []store.Key {
+	return zoneAwareWalk(r.allTokens, key, n, r.allZones, r.zoneOf)
+}
+
+// Returns the online nodes which may stand in for unreachable preferred
+// replicas of key, in the order they should be tried.
+// These are the nodes following the preferred replicas around the ring.
+func (r *Ring) StandIns(key store.Key, preferred []store.Key) []store.Key {
+	return ringWalk(r.allTokens, key, len(r.zones), func(id store.Key) bool {
+		return r.online[id] && !containsKey(preferred, id)
+	})
+}
+
+// Returns the ranges of keys which the node with id is the owner of
+func (r *Ring) RangesFor(id store.Key) []KeyRange {
+	ranges := []KeyRange{}
+	for i, token := range r.tokens {
+		if token.Node == id {
+			prev := r.tokens[predecessorIndex(i, len(r.tokens))]
+			ranges = append(ranges, KeyRange{Start: prev.Token, End: token.Token})
+		}
+	}
+	return ranges
+}
+
+// Returns the sorted ids of the online nodes
+func (r *Ring) Nodes() []store.Key {
+	nodes := make([]store.Key, len(r.nodes))
+	copy(nodes, r.nodes)
+	return nodes
+}
+
+func (r *Ring) zoneOf(id store.Key) string {
+	return r.zones[id]
+}
+
+// Returns the index of the token responsible for key
+func ringIndex(ring []RingToken, key store.Key) int {
+	i := sort.Search(len(ring), func(i int) bool {
+		return ring[i].Token.GreaterEquals(key)
+	})
+	if i == len(ring) {
+		return 0
+	}
+	return i
+}
+
+/* Returns up to max distinct nodes for key, starting with the node
+ * responsible for it, then the owners of the preceding tokens.
+ * Nodes for which include returns false are skipped. include may be nil.
+ */
+func ringWalk(ring []RingToken, key store.Key, max int,
+	include func(store.Key) bool) []store.Key {
+	nodes := make([]store.Key, 0, max)
+	if len(ring) == 0 {
+		return nodes
+	}
+	i := ringIndex(ring, key)
+	for range ring {
+		id := ring[i].Node
+		if len(nodes) == max {
+			break
+		}
+		if !containsKey(nodes, id) && (include == nil || include(id)) {
+			nodes = append(nodes, id)
+		}
+		i = predecessorIndex(i, len(ring))
+	}
+	return nodes
+}
+
+/* Returns up to max distinct nodes for key, starting with the node
+ * responsible for it. Nodes are picked from the preceding tokens so that
+ * they span as many distinct zones as possible, and then in ring order.
+ * zoneCount is the number of distinct zones of the ring's nodes. The walk
+ * stops once every zone is used and enough nodes were seen to fill up with.
+ */
+func zoneAwareWalk(ring []RingToken, key store.Key, max int, zoneCount int,
+	zoneOf func(store.Key) string) []store.Key {
+	nodes := make([]store.Key, 0, max)
+	if len(ring) == 0 {
+		return nodes
+	}
+	spare := []store.Key{} // Nodes in zones which already have one, in ring order
+	seen := map[store.Key]bool{}
+	zones := map[string]bool{}
+	i := ringIndex(ring, key)
+	for range ring {
+		if len(nodes) == max ||
+			(len(zones) == zoneCount && len(nodes)+len(spare) >= max) {
+			break
+		}
+		id := ring[i].Node
+		i = predecessorIndex(i, len(ring))
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if zone := zoneOf(id); !zones[zone] {
+			zones[zone] = true
+			nodes = append(nodes, id)
+		} else {
+			spare = append(spare, id)
+		}
+	}
+	// Fewer zones than replicas. Fill up with the nearest remaining nodes
+	for _, id := range spare {
+		if len(nodes) == max {
+			break
+		}
+		nodes = append(nodes, id)
+	}
+	return nodes
+}
+
+// Returns the number of distinct zones of nodes
+func countZones(nodes []store.Key, zoneOf func(store.Key) string) int {
+	zones := map[string]bool{}
+	for _, id := range nodes {
+		zones[zoneOf(id)] = true
+	}
+	return len(zones)
+}
+
+/* Returns the latest Ring the node published. Routing a request against the
+ * one snapshot, rather than calling this again, keeps it consistent.
+ * Does not need the lock.
+ */
+func (n *Node) Ring() *Ring {
+	return n.ring.Load().(*Ring)
+}
+
+// Builds a new Ring from the membership, and publishes it.
+// The caller must hold the lock.
+func (n *Node) publishRing() {
+	version := 0
+	if old, ok := n.ring.Load().(*Ring); ok {
+		version = old.Version + 1
+	}
+	ring := &Ring{
+		Version: version,
+		nodes:   []store.Key{},
+		online:  map[store.Key]bool{},
+		zones:   map[store.Key]string{},
+	}
+	allNodes := n.allNodeKeys()
+	for _, id := range allNodes {
+		ring.zones[id] = n.zoneOf(id)
+		if n.isOnline(id) {
+			ring.online[id] = true
+			ring.nodes = append(ring.nodes, id)
+		}
+	}
+	ring.tokens = buildRing(ring.nodes, n.tokensFor)
+	ring.allTokens = buildRing(allNodes, n.tokensFor)
+	ring.nZones = countZones(ring.nodes, ring.zoneOf)
+	ring.allZones = countZones(allNodes, ring.zoneOf)
+	n.ring.Store(ring)
+}
+
+// Returns the zone of the node with id
+func (n *Node) zoneOf(id store.Key) string {
+	if id == n.ID {
+		return n.Zone
+	}
+	if peer, ok := n.KnownPeers[id]; ok {
+		return peer.Zone
+	}
+	return ""
+}
+
+func predecessorIndex(index int, ringLen int) int {
+	if index == 0 {
+		return ringLen - 1
+	}
+	return index - 1
+}
+
+func containsKey(keys []store.Key, key store.Key) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
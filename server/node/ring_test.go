@@ -0,0 +1,140 @@
+package node
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/tsiemens/kvstore/server/store"
+)
+
+func newTestRing(tokensPerNode int, nodeIds ...store.Key) []RingToken {
+	ring := []RingToken{}
+	for _, id := range nodeIds {
+		for _, token := range NodeTokens(id, tokensPerNode) {
+			ring = append(ring, RingToken{Token: token, Node: id})
+		}
+	}
+	sort.Sort(ringTokens(ring))
+	return ring
+}
+
+func TestRingWalkSkipsDuplicateNodes(t *testing.T) {
+	nodeIds := []store.Key{{0x10}, {0x50}, {0x90}}
+	ring := newTestRing(8, nodeIds...)
+
+	for i := 0; i < 256; i++ {
+		replicas := ringWalk(ring, store.Key{byte(i), 0x33}, 3, nil)
+		if len(replicas) != 3 {
+			t.Fatalf("Expected 3 distinct replicas, got %d", len(replicas))
+		}
+		if replicas[0] != ring[ringIndex(ring, store.Key{byte(i), 0x33})].Node {
+			t.Fatal("First replica is not the responsible node")
+		}
+	}
+
+	if len(ringWalk(ring, store.Key{}, 5, nil)) != 3 {
+		t.Fatal("Walk returned more nodes than the ring has")
+	}
+}
+
+func TestRingWalkWraps(t *testing.T) {
+	ring := newTestRing(1, store.Key{0x10}, store.Key{0x50})
+	if ringWalk(ring, store.Key{0xf0}, 1, nil)[0] != (store.Key{0x10}) {
+		t.Fatal("Key past the last token not owned by the first token's node")
+	}
+	replicas := ringWalk(ring, store.Key{0x20}, 2, nil)
+	if replicas[0] != (store.Key{0x50}) || replicas[1] != (store.Key{0x10}) {
+		t.Fatal("Replicas are not the responsible node and its predecessor")
+	}
+}
+
+func TestTokensInProportionToWeight(t *testing.T) {
+	peerId := store.Key{0x10}
+	n := newTestNode(peerId)
+	n.Weight = 3
+	n.KnownPeers[peerId].Weight = 1
+	n.publishRing()
+
+	counts := map[store.Key]int{}
+	for _, token := range n.Ring().tokens {
+		counts[token.Node]++
+	}
+	if counts[n.ID] != 3 || counts[peerId] != 1 {
+		t.Fatalf("Expected 3 and 1 tokens, got %d and %d", counts[n.ID], counts[peerId])
+	}
+}
+
+func TestReplicasSpanZones(t *testing.T) {
+	ring := newTestRing(1, store.Key{0x10}, store.Key{0x20}, store.Key{0x30}, store.Key{0x40})
+	zones := map[store.Key]string{
+		{0x10}: "a", {0x20}: "b", {0x30}: "b", {0x40}: "a",
+	}
+	zoneOf := func(id store.Key) string { return zones[id] }
+
+	replicas := zoneAwareWalk(ring, store.Key{0x40}, 2, 2, zoneOf)
+	if replicas[0] != (store.Key{0x40}) || replicas[1] != (store.Key{0x30}) {
+		t.Fatal("Replicas do not start with the responsible node")
+	}
+	// 0x20 is nearer than 0x10, but its zone already has a replica
+	replicas = zoneAwareWalk(ring, store.Key{0x30}, 2, 2, zoneOf)
+	if replicas[1] != (store.Key{0x10}) {
+		t.Fatal("Replica placed in a zone which already has one")
+	}
+	// With more replicas than zones, the nearest remaining node is used
+	replicas = zoneAwareWalk(ring, store.Key{0x30}, 3, 2, zoneOf)
+	if len(replicas) != 3 || replicas[2] != (store.Key{0x20}) {
+		t.Fatal("Replicas not filled up in ring order")
+	}
+}
+
+func TestZoneAwareWalkStopsOnceZonesUsed(t *testing.T) {
+	nodeIds := []store.Key{}
+	for i := 0; i < 64; i++ {
+		nodeIds = append(nodeIds, store.Key{byte(i)})
+	}
+	ring := newTestRing(8, nodeIds...)
+	looked := 0
+	zoneOf := func(id store.Key) string {
+		looked++
+		return "a"
+	}
+
+	replicas := zoneAwareWalk(ring, store.Key{0x33}, 3, 1, zoneOf)
+	if len(replicas) != 3 {
+		t.Fatalf("Expected 3 replicas, got %d", len(replicas))
+	}
+	if looked != 3 {
+		t.Fatalf("Walked %d nodes to pick 3 replicas in one zone", looked)
+	}
+}
+
+func TestRingSnapshot(t *testing.T) {
+	peerId := store.Key{0x10}
+	n := newTestNode(peerId)
+	ring := n.Ring()
+
+	if ring.Owner(store.Key{0x50}) != n.ID || ring.Owner(store.Key{0x90}) != peerId {
+		t.Fatal("Keys not owned by the node with the next token")
+	}
+	for _, id := range []store.Key{n.ID, peerId} {
+		for _, r := range ring.RangesFor(id) {
+			if ring.Owner(r.End) != id || ring.Owner(r.Start) == id {
+				t.Fatal("Range not owned by its node")
+			}
+		}
+	}
+
+	n.SetPeerOffline(peerId)
+	if n.Ring().Version <= ring.Version {
+		t.Fatal("Ring version did not increase")
+	}
+	if len(ring.Nodes()) != 2 || ring.Owner(store.Key{0x90}) != peerId {
+		t.Fatal("Published ring changed")
+	}
+	if n.Ring().Owner(store.Key{0x90}) != n.ID {
+		t.Fatal("Offline peer still owns keys")
+	}
+	if len(n.Ring().StandIns(store.Key{0x90}, nil)) != 1 {
+		t.Fatal("Offline peer is a stand in")
+	}
+}
@@ -0,0 +1,232 @@
+package node
+
+import (
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/log"
+	"github.com/tsiemens/kvstore/shared/util"
+	"time"
+)
+
+// SWIM style failure detection. Peers which miss a direct and indirect probe
+// are suspected, and only marked offline if the suspicion is not refuted within
+// the suspect timeout. A node refutes a suspicion of itself by incrementing its
+// incarnation number, which only it can do.
+
+type SwimState int
+
+const (
+	SwimAlive SwimState = iota
+	SwimSuspect
+	SwimConfirm // Confirmed failed
+	SwimLeft    // Decommissioned
+)
+
+type SwimUpdate struct {
+	Subject     store.Key
+	State       SwimState
+	Incarnation int
+}
+
+// Returns the state of the peer, which orders rumors of the same incarnation
+func (p *Peer) State() SwimState {
+	switch {
+	case p.Left:
+		return SwimLeft
+	case !p.Online:
+		return SwimConfirm
+	case p.Suspect:
+		return SwimSuspect
+	default:
+		return SwimAlive
+	}
+}
+
+// Returns a random online peer to probe, or nil if there are none
+func (n *Node) RandomProbeTarget() (*store.Key, *Peer) {
+	targets := n.RandomOnlinePeers(1, n.ID)
+	for id, peer := range targets {
+		return &id, peer
+	}
+	return nil, nil
+}
+
+// Returns up to count random online peers, other than exclude.
+// The peers returned are copies.
+func (n *Node) RandomOnlinePeers(count int, exclude store.Key) map[store.Key]*Peer {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+	candidates := make([]store.Key, 0, len(n.KnownPeers))
+	for id, peer := range n.KnownPeers {
+		if peer.Online && id != exclude {
+			candidates = append(candidates, id)
+		}
+	}
+	peers := map[store.Key]*Peer{}
+	for _, i := range util.Rand.Perm(len(candidates)) {
+		if len(peers) == count {
+			break
+		}
+		peer := *n.KnownPeers[candidates[i]]
+		peers[candidates[i]] = &peer
+	}
+	return peers
+}
+
+// Returns copies of all the online peers
+func (n *Node) OnlinePeers() map[store.Key]*Peer {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+	peers := map[store.Key]*Peer{}
+	for id, peer := range n.KnownPeers {
+		if peer.Online {
+			peerCopy := *peer
+			peers[id] = &peerCopy
+		}
+	}
+	return peers
+}
+
+// Returns this node's current incarnation number
+func (n *Node) CurrentIncarnation() int {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+	return n.Incarnation
+}
+
+/* Suspects the peer of having failed, if it is online and not suspected yet.
+ * Returns the update to disseminate, or nil if nothing changed.
+ */
+func (n *Node) SuspectPeer(peerId store.Key) *SwimUpdate {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	peer, ok := n.KnownPeers[peerId]
+	if !ok || !peer.Online || peer.Suspect {
+		return nil
+	}
+	n.suspect(peerId, peer, peer.Incarnation)
+	n.touchPeer(peer)
+	return &SwimUpdate{Subject: peerId, State: SwimSuspect, Incarnation: peer.Incarnation}
+}
+
+func (n *Node) suspect(peerId store.Key, peer *Peer, incarnation int) {
+	log.I.Printf("Suspecting peer %s\n", peerId.String())
+	peer.Suspect = true
+	peer.SuspectSince = time.Now()
+	peer.Incarnation = incarnation
+}
+
+/* Marks the peers suspected for longer than timeout as offline.
+ * Returns the confirmations to disseminate.
+ */
+func (n *Node) ConfirmExpiredSuspects(timeout time.Duration) []*SwimUpdate {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	updates := []*SwimUpdate{}
+	for id, peer := range n.KnownPeers {
+		if peer.Suspect && time.Since(peer.SuspectSince) > timeout {
+			n.confirm(id, peer)
+			updates = append(updates, &SwimUpdate{Subject: id, State: SwimConfirm,
+				Incarnation: peer.Incarnation})
+		}
+	}
+	if len(updates) > 0 {
+		n.updateRing()
+	}
+	return updates
+}
+
+func (n *Node) confirm(peerId store.Key, peer *Peer) {
+	log.I.Printf("Peer %s confirmed failed\n", peerId.String())
+	peer.Suspect = false
+	peer.Online = false
+	n.touchPeer(peer)
+}
+
+/* Applies an update received from another node.
+ * If the update suspects this node, or confirms it failed, returns the alive
+ * update with a new incarnation which refutes it. Otherwise returns nil.
+ */
+func (n *Node) ApplySwimUpdate(u *SwimUpdate) *SwimUpdate {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	if u.Subject == n.ID {
+		return n.refute(u.State, u.Incarnation)
+	}
+
+	peer, ok := n.KnownPeers[u.Subject]
+	if !ok {
+		return nil
+	}
+	switch u.State {
+	case SwimAlive:
+		if u.Incarnation > peer.Incarnation {
+			wasOnline := peer.Online
+			peer.Incarnation = u.Incarnation
+			peer.Suspect = false
+			peer.Online = true
+			peer.Left = false
+			n.touchPeer(peer)
+			if !wasOnline {
+				log.I.Printf("Peer %s refuted its failure\n", u.Subject.String())
+				n.updateRing()
+			}
+		}
+	case SwimSuspect:
+		if peer.Online && (u.Incarnation > peer.Incarnation ||
+			(u.Incarnation == peer.Incarnation && !peer.Suspect)) {
+			n.suspect(u.Subject, peer, u.Incarnation)
+			n.touchPeer(peer)
+		}
+	case SwimConfirm:
+		if peer.Online && u.Incarnation >= peer.Incarnation {
+			peer.Incarnation = u.Incarnation
+			n.confirm(u.Subject, peer)
+			n.updateRing()
+		}
+	case SwimLeft:
+		if !peer.Left && u.Incarnation >= peer.Incarnation {
+			log.I.Printf("Peer %s is leaving\n", u.Subject.String())
+			peer.Incarnation = u.Incarnation
+			peer.Suspect = false
+			peer.Online = false
+			peer.Left = true
+			n.touchPeer(peer)
+			n.updateRing()
+		}
+	}
+	return nil
+}
+
+// Records a direct acknowledgement from the peer
+func (n *Node) PeerAcked(peerId store.Key, incarnation int) {
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+	if peer, ok := n.KnownPeers[peerId]; ok {
+		peer.LastSeen = time.Now()
+		n.refreshPeer(peer)
+		if incarnation > peer.Incarnation {
+			peer.Incarnation = incarnation
+			peer.Suspect = false
+			n.touchPeer(peer)
+		}
+	}
+}
+
+/* Returns the update refuting a rumor that this node is in state at
+ * incarnation, or nil if the rumor is true or outdated.
+ * The refutation carries a new incarnation, which overrides the rumor.
+ */
+func (n *Node) refute(state SwimState, incarnation int) *SwimUpdate {
+	if state == SwimAlive || (state == SwimLeft && n.Leaving) || incarnation < n.Incarnation {
+		return nil
+	}
+	n.Incarnation = incarnation + 1
+	log.I.Printf("Refuting failure rumor with incarnation %d\n", n.Incarnation)
+	return &SwimUpdate{Subject: n.ID, State: SwimAlive, Incarnation: n.Incarnation}
+}
+
+// Returns the update refuting a membership entry about this node,
+// or nil if the entry does not need refuting
+func (n *Node) refuteEntry(entry *Peer) *SwimUpdate {
+	return n.refute(entry.State(), entry.Incarnation)
+}
@@ -0,0 +1,103 @@
+package node
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/log"
+)
+
+func init() {
+	log.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard)
+}
+
+func newTestNode(peerIds ...store.Key) *Node {
+	n := &Node{
+		ID:           store.Key{0x80},
+		KnownPeers:   map[store.Key]*Peer{},
+		Store:        store.New(),
+		unreplicated: NewHints(),
+	}
+	for _, id := range peerIds {
+		n.KnownPeers[id] = &Peer{Online: true}
+	}
+	n.publishRing()
+	return n
+}
+
+func TestSuspectConfirmedAfterTimeout(t *testing.T) {
+	peerId := store.Key{0x10}
+	n := newTestNode(peerId)
+
+	if n.SuspectPeer(peerId) == nil {
+		t.Fatal("Online peer not suspected")
+	}
+	if len(n.ConfirmExpiredSuspects(time.Hour)) != 0 {
+		t.Fatal("Suspect confirmed before timeout")
+	}
+	if len(n.Ring().Nodes()) != 2 {
+		t.Fatal("Suspect removed from the ring")
+	}
+	if len(n.ConfirmExpiredSuspects(0)) != 1 || n.KnownPeers[peerId].Online {
+		t.Fatal("Suspect not confirmed after timeout")
+	}
+	if len(n.Ring().Nodes()) != 1 {
+		t.Fatal("Confirmed peer still in the ring")
+	}
+}
+
+func TestSuspicionRefuted(t *testing.T) {
+	peerId := store.Key{0x10}
+	n := newTestNode(peerId)
+
+	refutation := n.ApplySwimUpdate(&SwimUpdate{Subject: n.ID, State: SwimSuspect})
+	if refutation == nil || refutation.State != SwimAlive || refutation.Incarnation != 1 {
+		t.Fatal("Suspicion of self not refuted with a new incarnation")
+	}
+
+	n.ApplySwimUpdate(&SwimUpdate{Subject: peerId, State: SwimSuspect})
+	if !n.KnownPeers[peerId].Suspect {
+		t.Fatal("Peer not suspected")
+	}
+	// An alive message from the same incarnation does not clear the suspicion
+	n.ApplySwimUpdate(&SwimUpdate{Subject: peerId, State: SwimAlive})
+	if !n.KnownPeers[peerId].Suspect {
+		t.Fatal("Suspicion cleared without a new incarnation")
+	}
+	n.ApplySwimUpdate(&SwimUpdate{Subject: peerId, State: SwimAlive, Incarnation: 1})
+	if n.KnownPeers[peerId].Suspect {
+		t.Fatal("Suspicion not cleared by a new incarnation")
+	}
+}
+
+func TestMembershipMergedByIncarnation(t *testing.T) {
+	peerId := store.Key{0x10}
+	n := newTestNode(peerId)
+	n.KnownPeers[peerId].Incarnation = 2
+
+	// Rumors about older incarnations are ignored, however recent
+	n.updateKnownPeer(peerId, &Peer{Online: false, Incarnation: 1, LastSeen: time.Now()})
+	if !n.KnownPeers[peerId].Online {
+		t.Fatal("Stale rumor marked the peer offline")
+	}
+	// The same incarnation is overridden by a later state
+	n.updateKnownPeer(peerId, &Peer{Online: false, Incarnation: 2})
+	if n.KnownPeers[peerId].Online {
+		t.Fatal("Failure rumor was ignored")
+	}
+	n.updateKnownPeer(peerId, &Peer{Online: true, Incarnation: 2})
+	if n.KnownPeers[peerId].Online {
+		t.Fatal("Alive rumor of the same incarnation overrode the failure")
+	}
+	if !n.updateKnownPeer(peerId, &Peer{Online: true, Incarnation: 3}) {
+		t.Fatal("Refutation did not bring the peer back online")
+	}
+
+	// A rumor of this node's own failure is refuted with a new incarnation
+	u := n.refuteEntry(&Peer{Online: false, Incarnation: 4})
+	if u == nil || u.State != SwimAlive || u.Incarnation != 5 || n.Incarnation != 5 {
+		t.Fatal("Failure rumor about this node was not refuted")
+	}
+}
@@ -20,7 +20,7 @@ func IntraNodeGet(url string, msg api.Message) api.Message {
 	}
 }
 
-func IntraNodePut(url string, msg api.Message, timestamp int) api.Message {
+func IntraNodePut(url string, msg api.Message, timestamp int64) api.Message {
 	keyValMsg := msg.(*api.KeyValueDgram)
 	storeVal := &store.StoreVal{Val: keyValMsg.Value, Active: true, Timestamp: timestamp}
 	payload, jsonerr := json.Marshal(storeVal)
@@ -38,7 +38,7 @@ func IntraNodePut(url string, msg api.Message, timestamp int) api.Message {
 	}
 }
 
-func IntraNodeRemove(url string, msg api.Message, timestamp int) api.Message {
+func IntraNodeRemove(url string, msg api.Message, timestamp int64) api.Message {
 	keyMsg := msg.(*api.KeyDgram)
 	storeVal := &store.StoreVal{Val: nil, Active: false, Timestamp: timestamp}
 	payload, jsonerr := json.Marshal(storeVal)
@@ -56,6 +56,55 @@ func IntraNodeRemove(url string, msg api.Message, timestamp int) api.Message {
 	}
 }
 
+// A write sent to a stand-in node, on behalf of the unreachable owner
+type hintedStoreVal struct {
+	store.StoreVal
+	Owner string
+}
+
+// Sends a put to a stand-in node, which will hold the value for owner
+func IntraNodeHintedPut(url string, msg api.Message, timestamp int64, owner store.Key) api.Message {
+	keyValMsg := msg.(*api.KeyValueDgram)
+	storeVal := store.StoreVal{Val: keyValMsg.Value, Active: true, Timestamp: timestamp}
+	return intraNodeHintedWrite(url, msg.UID(), keyValMsg.Key, storeVal, owner)
+}
+
+// Sends a remove to a stand-in node, which will hold the removal for owner
+func IntraNodeHintedRemove(url string, msg api.Message, timestamp int64, owner store.Key) api.Message {
+	keyMsg := msg.(*api.KeyDgram)
+	storeVal := store.StoreVal{Val: nil, Active: false, Timestamp: timestamp}
+	return intraNodeHintedWrite(url, msg.UID(), keyMsg.Key, storeVal, owner)
+}
+
+func intraNodeHintedWrite(url string, uid [16]byte, key [32]byte,
+	storeVal store.StoreVal, owner store.Key) api.Message {
+	payload, jsonerr := json.Marshal(&hintedStoreVal{storeVal, api.KeyHex(owner)})
+	if jsonerr != nil {
+		log.E.Println(jsonerr)
+		return nil
+	}
+	msg, err := api.SendRecv(url, func(addr *net.UDPAddr) api.Message {
+		return api.NewKeyValueDgram(uid, api.CmdIntraHintedWrite, key, payload)
+	})
+	if err != nil {
+		return nil
+	} else {
+		return msg
+	}
+}
+
+// Returns the intended owner of a hinted write's value.
+// The value can otherwise be parsed as a plain store.StoreVal
+func ParseHintOwner(data []byte) (store.Key, error) {
+	hinted := &hintedStoreVal{}
+	err := json.Unmarshal(data, hinted)
+	if err != nil {
+		return store.Key{}, err
+	}
+	owner, err := api.KeyFromHex(hinted.Owner)
+	return store.Key(owner), err
+}
+
 func IntraNodeGetTimestamp(url string, msg api.Message) api.Message {
 	var key store.Key
 	if msg.Command() == api.CmdPut {
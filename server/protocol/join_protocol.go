@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"encoding/json"
+	"github.com/tsiemens/kvstore/server/cache"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+	"net"
+)
+
+// Describes a joining node to its peers. The address is sent explicitly,
+// since requests are not sent from the node's own socket.
+type JoinMsg struct {
+	Addr        *net.UDPAddr
+	Incarnation int
+	Weight      float64
+	Zone        string
+}
+
+// Announces this node to the peer at url, which then pushes it its keys
+func SendJoinSync(url string, myNodeId store.Key, joiner *JoinMsg) error {
+	payload, err := json.Marshal(joiner)
+	if err != nil {
+		return err
+	}
+	msg, err := api.SendRecv(url, func(addr *net.UDPAddr) api.Message {
+		return api.NewKeyValueDgram(api.NewMessageUID(addr), api.CmdJoinSync, myNodeId, payload)
+	})
+	if err != nil {
+		return err
+	}
+	return api.ResponseError(msg)
+}
+
+func ParseJoinMsg(msg *api.KeyValueDgram) (*JoinMsg, error) {
+	joiner := &JoinMsg{}
+	err := json.Unmarshal(msg.Value, joiner)
+	return joiner, err
+}
+
+// Tells the joining node at url that this node has pushed it its keys
+func SendJoinSyncDone(url string, myNodeId store.Key) error {
+	msg, err := api.SendRecv(url, func(addr *net.UDPAddr) api.Message {
+		return api.NewKeyDgram(api.NewMessageUID(addr), api.CmdJoinSyncDone, myNodeId)
+	})
+	if err != nil {
+		return err
+	}
+	return api.ResponseError(msg)
+}
+
+func ReplyToJoinMsg(conn *net.UDPConn, recvAddr *net.UDPAddr, cache *cache.Cache,
+	requestMsg api.Message) {
+	reply := api.NewValueDgram(requestMsg.UID(), api.RespOk, []byte{})
+	cache.SendReply(conn, reply, recvAddr)
+}
@@ -8,21 +8,66 @@ import (
 	"github.com/tsiemens/kvstore/shared/api"
 	"github.com/tsiemens/kvstore/shared/log"
 	"net"
+	"time"
 )
 
+// Upper bound of the encoded entries in a membership datagram, leaving room
+// for the rest of it under api.MaxMessageSize
+const membershipBytes = 12000
+
 type PeerList struct {
-	Peers map[string]node.Peer
+	Peers       map[string]peerState
+	Incarnation int     // Of the sending node
+	Weight      float64 // Of the sending node
+	Zone        string  // Of the sending node
+	Version     int     // Of the sender's membership, which the entries bring the receiver up to
+	Ack         int     // The receiver's membership version the sender last received
+}
+
+// The gossiped fields of a node.Peer
+type peerState struct {
+	Online      bool
+	LastSeen    time.Time
+	Addr        *net.UDPAddr
+	Incarnation int
+	Suspect     bool
+	Left        bool
+	Weight      float64
+	Zone        string
+	Version     int
 }
 
-func NewPeerList(peers map[store.Key]*node.Peer) *PeerList {
-	pl := map[string]node.Peer{}
-	for key, peer := range peers {
-		pl[api.KeyHex(key)] = node.Peer{Online: peer.Online,
-			LastSeen: peer.LastSeen,
-			Addr:     peer.Addr,
+/* Returns the list of as many of the entries as fit in a datagram. entries
+ * must be sorted by version, so that when they do not all fit, the ones left
+ * out are sent next time, once the receiver has acknowledged these.
+ */
+func NewPeerList(entries []node.PeerEntry, version int) *PeerList {
+	pl := map[string]peerState{}
+	size := 0
+	for _, entry := range entries {
+		state := peerState{Online: entry.Peer.Online,
+			LastSeen:    entry.Peer.LastSeen,
+			Addr:        entry.Peer.Addr,
+			Incarnation: entry.Peer.Incarnation,
+			Suspect:     entry.Peer.Suspect,
+			Left:        entry.Peer.Left,
+			Weight:      entry.Peer.Weight,
+			Zone:        entry.Peer.Zone,
+			Version:     entry.Peer.Version,
+		}
+		data, err := json.Marshal(state)
+		if err != nil {
+			log.E.Panicln("Could not marshal peer")
+		}
+		size += len(data) + 2*len(entry.ID) + 4 // Hex key, quotes, colon and comma
+		if size > membershipBytes {
+			// The receiver is up to date with the entries before this one
+			version = entry.Peer.Version - 1
+			break
 		}
+		pl[api.KeyHex(entry.ID)] = state
 	}
-	return &PeerList{pl}
+	return &PeerList{Peers: pl, Version: version}
 }
 
 func (pl *PeerList) PointerMap() map[store.Key]*node.Peer {
@@ -33,40 +78,42 @@ func (pl *PeerList) PointerMap() map[store.Key]*node.Peer {
 			log.E.Println("Failed to parse key " + key)
 		} else {
 			peers[store.Key(k)] = &node.Peer{Online: peer.Online,
-				LastSeen: peer.LastSeen,
-				Addr:     peer.Addr,
+				LastSeen:    peer.LastSeen,
+				Addr:        peer.Addr,
+				Incarnation: peer.Incarnation,
+				Suspect:     peer.Suspect,
+				Left:        peer.Left,
+				Weight:      peer.Weight,
+				Zone:        peer.Zone,
 			}
 		}
 	}
 	return peers
 }
 
-func SendMembershipMsg(conn *net.UDPConn, addr *net.UDPAddr, myNodeId [32]byte,
-	peers map[store.Key]*node.Peer, command byte) error {
-	peerdata, err := json.Marshal(NewPeerList(peers))
+/* Sends the peer at addr the membership changes it has not acknowledged.
+ * peerId may be nil if the peer is not known yet, in which case it is sent
+ * the full membership.
+ */
+func SendMembershipMsg(conn *net.UDPConn, addr *net.UDPAddr, peerId *store.Key,
+	command byte) error {
+	thisNode := node.GetProcessNode()
+	entries, version, ack := thisNode.MembershipDelta(peerId)
+	peerList := NewPeerList(entries, version)
+	peerList.Ack = ack
+	peerList.Incarnation = thisNode.CurrentIncarnation()
+	peerList.Weight = thisNode.Weight
+	peerList.Zone = thisNode.Zone
+	peerdata, err := json.Marshal(peerList)
 	if err != nil {
 		return err
 	}
 	msg := func(addr *net.UDPAddr) api.Message {
-		return api.NewKeyValueDgram(api.NewMessageUID(addr), command, myNodeId, peerdata)
+		return api.NewKeyValueDgram(api.NewMessageUID(addr), command, thisNode.ID, peerdata)
 	}
 	return api.Send(conn, addr.String(), msg)
 }
 
-func ReplyMembershipMsg(conn *net.UDPConn, recvAddr *net.UDPAddr, myNodeId [32]byte,
-	peers map[store.Key]*node.Peer, command byte, UID [16]byte) error {
-
-	peerdata, err := json.Marshal(NewPeerList(peers))
-	if err != nil {
-		return err
-	}
-	msg := func(addr *net.UDPAddr) api.Message {
-		return api.NewKeyValueDgram(UID, command, myNodeId, peerdata)
-	}
-	return api.Send(conn, recvAddr.String(), msg)
-
-}
-
 func SendMembershipQuery(url string) (map[store.Key]*node.Peer, error) {
 	msg, err := api.SendRecv(url, func(addr *net.UDPAddr) api.Message {
 		return api.NewBaseDgram(api.NewMessageUID(addr), api.CmdMembershipQuery)
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tsiemens/kvstore/server/cache"
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/server/raft"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+	"net"
+)
+
+// Sends a raft group message to a peer, and returns the reply payload.
+// Hack to avoid import cycles
+func SendRaftMsg(peerKey store.Key, cmd byte, groupId store.Key,
+	payload []byte) ([]byte, error) {
+	peer, ok := node.GetProcessNode().GetPeer(peerKey)
+	if !ok {
+		return nil, errors.New("Unknown peer " + peerKey.String())
+	}
+	return sendRaftMsg(peer.Addr.String(), cmd, groupId, payload)
+}
+
+// Asks the group member at url to run the entry through the group's log
+func SendRaftPropose(url string, args *raft.ProposeArgs) (*raft.ProposeReply, error) {
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	replyData, err := sendRaftMsg(url, api.CmdRaftPropose, args.Group, payload)
+	if err != nil {
+		return nil, err
+	}
+	reply := &raft.ProposeReply{}
+	err = json.Unmarshal(replyData, reply)
+	return reply, err
+}
+
+func sendRaftMsg(url string, cmd byte, groupId store.Key, payload []byte) ([]byte, error) {
+	msg, err := api.SendRecv(url, func(addr *net.UDPAddr) api.Message {
+		return api.NewKeyValueDgram(api.NewMessageUID(addr), cmd, groupId, payload)
+	})
+	if err != nil {
+		return nil, err
+	} else if cmdErr := api.ResponseError(msg); cmdErr != nil {
+		return nil, cmdErr
+	} else if vmsg, ok := msg.(*api.ValueDgram); ok {
+		return vmsg.Value, nil
+	} else {
+		return nil, errors.New("Received invalid raft reply datagram")
+	}
+}
+
+func ReplyToRaftMsg(conn *net.UDPConn, recvAddr *net.UDPAddr, cache *cache.Cache,
+	requestMsg api.Message, reply interface{}) error {
+	replyData, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	cache.SendReply(conn, api.NewValueDgram(requestMsg.UID(), api.RespOk, replyData),
+		recvAddr)
+	return nil
+}
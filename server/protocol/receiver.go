@@ -1,14 +1,25 @@
 package protocol
 
 import "net"
+import "github.com/tsiemens/kvstore/server/config"
 import "github.com/tsiemens/kvstore/shared/log"
 import "github.com/tsiemens/kvstore/shared/api"
 
 type MessageHandler interface {
 	HandleMessage(msg api.Message, recvAddr *net.UDPAddr)
+	// Whether cmd comes from clients. Only client commands are rejected
+	// when the node is overloaded
+	IsClientCommand(cmd byte) bool
 }
 
+/* Receives messages, and queues them to be handled by a pool of workers.
+ * If the queue of client commands is full, replies RespSysOverload to them
+ * instead. Messages from peers are never answered with an overload.
+ */
 func LoopReceiver(conn *net.UDPConn, handler MessageHandler) error {
+	conf := config.GetConfig()
+	workers := NewWorkerPool(handler, conf.Workers, conf.QueueSize)
+	pool.Store(workers)
 	for {
 		msg, recvAddr, err, errMsg := recvFrom(conn)
 		if err != nil {
@@ -19,14 +30,19 @@ func LoopReceiver(conn *net.UDPConn, handler MessageHandler) error {
 			conn.WriteTo(errMsg.Bytes(), recvAddr)
 		} else {
 			log.D.Printf("Received message type %x from %v\n", msg.Command(), recvAddr)
-			go handler.HandleMessage(msg, recvAddr)
+			if !workers.Submit(msg, recvAddr) {
+				log.E.Printf("Queue full. Rejecting message type %x from %v\n", msg.Command(), recvAddr)
+				conn.WriteTo(api.NewBaseDgram(msg.UID(), api.RespSysOverload).Bytes(), recvAddr)
+			}
 		}
 	}
 }
 
 /* Receives a message and parses it.
  * Returns the message, the address received from,
- * a possible error or an error message to return. */
+ * a possible error or an error message to return.
+ * Datagrams which may be replies are never answered, even if they cannot be
+ * parsed, so that two nodes never answer each other's answers. */
 func recvFrom(conn *net.UDPConn) (api.Message, *net.UDPAddr, net.Error, api.Message) {
 	buff := make([]byte, api.MaxMessageSize)
 
@@ -43,6 +59,9 @@ func recvFrom(conn *net.UDPConn) (api.Message, *net.UDPAddr, net.Error, api.Mess
 			if err != nil {
 				log.E.Println(err)
 				log.E.Println("From", recvAddr)
+				if n > 16 && isResponseCode(buff[16]) {
+					continue
+				}
 				return nil, recvAddr, nil, errMsg
 			} else {
 				return requestMsg, recvAddr, nil, nil
@@ -50,3 +69,8 @@ func recvFrom(conn *net.UDPConn) (api.Message, *net.UDPAddr, net.Error, api.Mess
 		}
 	}
 }
+
+func isResponseCode(cmd byte) bool {
+	_, ok := api.RespMessageParsers[cmd]
+	return ok
+}
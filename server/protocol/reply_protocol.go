@@ -11,8 +11,9 @@ import (
 	"time"
 )
 
-func ReplyToGet(conn *net.UDPConn, recvAddr *net.UDPAddr, replyMsg api.Message) {
-	conn.WriteTo(replyMsg.Bytes(), recvAddr)
+func ReplyToGet(conn *net.UDPConn, recvAddr *net.UDPAddr, cache *cache.Cache,
+	replyMsg api.Message) {
+	cache.SendReply(conn, replyMsg, recvAddr)
 }
 
 func ReplyToPut(conn *net.UDPConn, recvAddr *net.UDPAddr, cache *cache.Cache,
@@ -30,9 +31,10 @@ func ReplyCached(conn *net.UDPConn, recvAddr *net.UDPAddr, cache *cache.Cache,
 	cache.SendReply(conn, replyMsg, recvAddr)
 }
 
-func ReplyToGetTimestamp(conn *net.UDPConn, recvAddr *net.UDPAddr, replyMsg api.Message) {
+func ReplyToGetTimestamp(conn *net.UDPConn, recvAddr *net.UDPAddr, cache *cache.Cache,
+	replyMsg api.Message) {
 	log.D.Printf("Sending message type %x to %v\n", replyMsg.Command(), recvAddr.String())
-	conn.WriteTo(replyMsg.Bytes(), recvAddr)
+	cache.SendReply(conn, replyMsg, recvAddr)
 }
 
 func ReplyToStatusUpdateServer(conn *net.UDPConn, recvAddr *net.UDPAddr, cache *cache.Cache,
@@ -62,15 +64,18 @@ func ReplyToStatusUpdateServer(conn *net.UDPConn, recvAddr *net.UDPAddr, cache *
 }
 
 func ReplyToMembershipQuery(conn *net.UDPConn, recvAddr *net.UDPAddr, cache *cache.Cache,
-	requestMsg api.Message, myNodeId [32]byte,
-	peers map[store.Key]*node.Peer) error {
+	requestMsg api.Message, myNodeId [32]byte) error {
 
-	peerList := NewPeerList(peers)
+	entries, version, _ := node.GetProcessNode().MembershipDelta(nil)
+	peerList := NewPeerList(entries, version)
 	// Append this node to list
-	peerList.Peers[api.KeyHex(store.Key(myNodeId))] = node.Peer{
-		Online:   true,
-		Addr:     conn.LocalAddr().(*net.UDPAddr),
-		LastSeen: time.Now(),
+	peerList.Peers[api.KeyHex(store.Key(myNodeId))] = peerState{
+		Online:      true,
+		Addr:        conn.LocalAddr().(*net.UDPAddr),
+		LastSeen:    time.Now(),
+		Incarnation: node.GetProcessNode().CurrentIncarnation(),
+		Weight:      node.GetProcessNode().Weight,
+		Zone:        node.GetProcessNode().Zone,
 	}
 
 	peerdata, err := json.Marshal(peerList)
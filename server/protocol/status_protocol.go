@@ -15,7 +15,7 @@ var StatusMessageParsers = map[byte]api.MessagePayloadParser{
 	api.CmdAdhocUpdate:  api.ParseKeyValueDgram,
 
 	api.RespOk:             api.ParseValueDgram,
-	api.RespSysOverload:    api.ParseBaseDgram,
+	api.RespSysOverload:    api.ParseOverloadDgram,
 	api.RespInternalError:  api.ParseBaseDgram,
 	api.RespUnknownCommand: api.ParseBaseDgram,
 	api.RespStatusUpdateOK: api.ParseValueDgram,
@@ -2,26 +2,22 @@ package protocol
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/tsiemens/kvstore/server/cache"
+	"github.com/tsiemens/kvstore/server/config"
 	"github.com/tsiemens/kvstore/server/node"
 	"github.com/tsiemens/kvstore/server/store"
 	"github.com/tsiemens/kvstore/shared/api"
 	"github.com/tsiemens/kvstore/shared/log"
+	"github.com/tsiemens/kvstore/shared/util"
 	"net"
+	"sort"
 )
 
 type kvMap struct {
 	M map[string]*store.StoreVal
 }
 
-func NewKVMap(kvs map[store.Key]*store.StoreVal) *kvMap {
-	keyStringMap := map[string]*store.StoreVal{}
-	for key, value := range kvs {
-		keyStringMap[api.KeyHex(key)] = value
-	}
-	return &kvMap{keyStringMap}
-}
-
 func (kvmap *kvMap) KeyValues() map[store.Key]*store.StoreVal {
 	keyValMap := map[store.Key]*store.StoreVal{}
 	for keyString, value := range kvmap.M {
@@ -35,51 +31,176 @@ func (kvmap *kvMap) KeyValues() map[store.Key]*store.StoreVal {
 	return keyValMap
 }
 
-// Sends a sendRecv message with a range of key values to a node
-// Returns error if the node times out
-func SendStorePushMsg(conn *net.UDPConn, addr *net.UDPAddr,
-	values map[store.Key]*store.StoreVal) error {
+// Key values are migrated to other nodes as a stream of StorePush batches,
+// in key order. Each batch is acknowledged with its cursor (its last key)
+// before the next one is sent, so a failed migration resumes after the last
+// acknowledged batch instead of starting over. All migrations from this node
+// share a throttle, so that they do not starve client requests.
 
-	valuesWrapper := NewKVMap(values)
-	kvdata, err := json.Marshal(valuesWrapper)
-	if err != nil {
-		log.E.Panicln("Could not marshal key values")
+// Upper bound of the encoded entries in a batch, leaving room for the
+// datagram header under api.MaxMessageSize
+const migrationBatchBytes = 10000
+
+// Number of times a migration is attempted before giving up
+const migrationAttempts = 3
+
+var migrationThrottle *util.Throttle
+var migrationThrottleLock = util.NewSemaphore()
+
+type storePushMsg struct {
+	M      map[string]*store.StoreVal
+	Cursor string // Hex of the last key in the batch
+}
+
+type storePushAck struct {
+	Cursor   string
+	Rejected []string // Hex of the keys the receiver is not a replica for
+}
+
+type Migration struct {
+	Peer     store.Key
+	Addr     *net.UDPAddr
+	keys     []store.Key
+	values   map[store.Key]*store.StoreVal
+	Cursor   int         // Index of the next key to send
+	Rejected []store.Key // Keys the peer refused, as it is not a replica for them
+}
+
+func NewMigration(peerId store.Key, addr *net.UDPAddr,
+	values map[store.Key]*store.StoreVal) *Migration {
+	keys := make([]store.Key, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Sort(store.Keys(keys))
+	return &Migration{Peer: peerId, Addr: addr, keys: keys, values: values}
+}
+
+func (m *Migration) Done() bool {
+	return m.Cursor >= len(m.keys)
+}
+
+// Sends the remaining batches, starting at the cursor.
+// Returns an error if a batch is not acknowledged, leaving the cursor after
+// the last batch which was.
+func (m *Migration) Run() error {
+	for !m.Done() {
+		batch, end := m.nextBatch()
+		data, err := json.Marshal(batch)
+		if err != nil {
+			log.E.Panicln("Could not marshal key values")
+		}
+		getMigrationThrottle().Wait(len(data))
+
+		reply, err := api.SendRecv(m.Addr.String(), func(addr *net.UDPAddr) api.Message {
+			return api.NewValueDgram(api.NewMessageUID(addr), api.CmdStorePush, data)
+		})
+		if err != nil {
+			return err
+		}
+		ack := &storePushAck{}
+		if valueMsg, ok := reply.(*api.ValueDgram); !ok {
+			return errors.New("Received invalid store push reply datagram")
+		} else if err = json.Unmarshal(valueMsg.Value, ack); err != nil {
+			return err
+		} else if ack.Cursor != batch.Cursor {
+			return errors.New("Store push acknowledged the wrong cursor")
+		}
+		for _, keyHex := range ack.Rejected {
+			if key, err := api.KeyFromHex(keyHex); err == nil {
+				m.Rejected = append(m.Rejected, store.Key(key))
+			}
+		}
+		m.Cursor = end
 	}
+	return nil
+}
 
-	msgGenerator := func(addr *net.UDPAddr) api.Message {
-		return api.NewValueDgram(api.NewMessageUID(addr), api.CmdStorePush, kvdata)
+// Returns the batch starting at the cursor, and the index after it.
+// A batch always holds at least one key.
+func (m *Migration) nextBatch() (*storePushMsg, int) {
+	batch := &storePushMsg{M: map[string]*store.StoreVal{}}
+	size := 0
+	i := m.Cursor
+	for ; i < len(m.keys); i++ {
+		keyHex := api.KeyHex(m.keys[i])
+		entry, err := json.Marshal(m.values[m.keys[i]])
+		if err != nil {
+			log.E.Panicln("Could not marshal key values")
+		}
+		entrySize := len(keyHex) + len(entry) + 4 // Quotes, colon and comma
+		if len(batch.M) > 0 && size+entrySize > migrationBatchBytes {
+			break
+		}
+		batch.M[keyHex] = m.values[m.keys[i]]
+		batch.Cursor = keyHex
+		size += entrySize
 	}
+	return batch, i
+}
 
-	_, err = api.SendRecv(addr.String(), msgGenerator)
-	return err
+func getMigrationThrottle() *util.Throttle {
+	migrationThrottleLock.Lock()
+	defer migrationThrottleLock.Unlock()
+	if migrationThrottle == nil {
+		migrationThrottle = util.NewThrottle(config.GetConfig().MigrationRate)
+	}
+	return migrationThrottle
 }
 
-func ParseStorePushMsgValue(data []byte) (map[store.Key]*store.StoreVal, error) {
-	values := &kvMap{}
-	err := json.Unmarshal(data, values)
+func ParseStorePushMsgValue(data []byte) (map[store.Key]*store.StoreVal, string, error) {
+	batch := &storePushMsg{}
+	err := json.Unmarshal(data, batch)
 	if err != nil {
-		return nil, err
-	} else {
-		return values.KeyValues(), nil
+		return nil, "", err
 	}
+	return (&kvMap{batch.M}).KeyValues(), batch.Cursor, nil
 }
 
-// Hack to avoid import cycles
-func SendKeyValuesToNode(peerKey store.Key, values map[store.Key]*store.StoreVal) {
+/* Hack to avoid import cycles
+ * Returns the keys the peer rejected, as it is not their replica, or an
+ * error if the peer could not be reached.
+ */
+func SendKeyValuesToNode(peerKey store.Key,
+	values map[store.Key]*store.StoreVal) ([]store.Key, error) {
 	n := node.GetProcessNode()
-	if peer, ok := n.KnownPeers[peerKey]; ok {
-		err := SendStorePushMsg(n.Conn, peer.Addr, values)
-		if err != nil {
-			peer.Online = false
-			log.D.Printf("Failed to copy keys to %s\n", peerKey.String())
-		} else {
-			log.I.Printf("Copied portion of keys to %s\n", peerKey.String())
+	peer, ok := n.GetPeer(peerKey)
+	if !ok {
+		return nil, errors.New("Unknown peer " + peerKey.String())
+	}
+	migration := NewMigration(peerKey, peer.Addr, values)
+	var err error
+	for attempt := 0; attempt < migrationAttempts && !migration.Done(); attempt++ {
+		if err = migration.Run(); err != nil {
+			log.D.Printf("Copying keys to %s stopped after %d of %d keys: %s\n",
+				peerKey.String(), migration.Cursor, len(values), err)
+		}
+	}
+	if err != nil && !migration.Done() {
+		if update := n.SuspectPeer(peerKey); update != nil {
+			GossipSwimUpdate(n.Conn, update, peer.Addr)
 		}
+		log.D.Printf("Failed to copy keys to %s\n", peerKey.String())
+		return nil, err
+	}
+	if len(migration.Rejected) > 0 {
+		log.I.Printf("%s rejected %d of %d keys, as it is not their replica\n",
+			peerKey.String(), len(migration.Rejected), len(values))
 	}
+	log.I.Printf("Copied %d keys to %s\n", len(values)-len(migration.Rejected), peerKey.String())
+	return migration.Rejected, nil
 }
 
 func ReplyToStorePush(conn *net.UDPConn, recvAddr *net.UDPAddr,
-	cache *cache.Cache, requestMsg api.Message) {
-	reply := api.NewValueDgram(requestMsg.UID(), api.RespOk, []byte{})
+	cache *cache.Cache, requestMsg api.Message, cursor string, rejected []store.Key) {
+	rejectedHex := make([]string, 0, len(rejected))
+	for _, key := range rejected {
+		rejectedHex = append(rejectedHex, api.KeyHex(key))
+	}
+	ack, err := json.Marshal(&storePushAck{Cursor: cursor, Rejected: rejectedHex})
+	if err != nil {
+		log.E.Panicln("Could not marshal store push ack")
+	}
+	reply := api.NewValueDgram(requestMsg.UID(), api.RespOk, ack)
 	cache.SendReply(conn, reply, recvAddr)
 }
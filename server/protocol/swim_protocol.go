@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tsiemens/kvstore/server/cache"
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+	"net"
+)
+
+type PingMsg struct {
+	Incarnation int // Of the sender, or of the acknowledging node in a reply
+}
+
+type PingReqMsg struct {
+	Addr string // Of the node to probe
+}
+
+type PingReqReply struct {
+	Acked bool
+}
+
+type swimUpdateMsg struct {
+	State       node.SwimState
+	Incarnation int
+}
+
+// Pings the node at url directly.
+// Returns the incarnation it acknowledged with
+func SendPing(url string, myNodeId store.Key, incarnation int) (int, error) {
+	reply := &PingMsg{}
+	err := sendSwimMsg(url, api.CmdPing, myNodeId, &PingMsg{Incarnation: incarnation}, reply)
+	return reply.Incarnation, err
+}
+
+// Asks the node at url to ping the target for us.
+// Returns whether the target acknowledged it
+func SendPingReq(url string, target store.Key, targetAddr string) (bool, error) {
+	reply := &PingReqReply{}
+	err := sendSwimMsg(url, api.CmdPingReq, target, &PingReqMsg{Addr: targetAddr}, reply)
+	return reply.Acked, err
+}
+
+func sendSwimMsg(url string, cmd byte, key store.Key, args interface{},
+	reply interface{}) error {
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	msg, err := api.SendRecv(url, func(addr *net.UDPAddr) api.Message {
+		return api.NewKeyValueDgram(api.NewMessageUID(addr), cmd, key, payload)
+	})
+	if err != nil {
+		return err
+	} else if cmdErr := api.ResponseError(msg); cmdErr != nil {
+		return cmdErr
+	} else if vmsg, ok := msg.(*api.ValueDgram); ok {
+		return json.Unmarshal(vmsg.Value, reply)
+	} else {
+		return errors.New("Received invalid probe reply datagram")
+	}
+}
+
+func ReplyToSwimMsg(conn *net.UDPConn, recvAddr *net.UDPAddr, cache *cache.Cache,
+	requestMsg api.Message, reply interface{}) error {
+	replyData, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	cache.SendReply(conn, api.NewValueDgram(requestMsg.UID(), api.RespOk, replyData),
+		recvAddr)
+	return nil
+}
+
+func NewSwimUpdateMsg(u *node.SwimUpdate, addr *net.UDPAddr) (*api.KeyValueDgram, error) {
+	payload, err := json.Marshal(&swimUpdateMsg{State: u.State, Incarnation: u.Incarnation})
+	if err != nil {
+		return nil, err
+	}
+	return api.NewKeyValueDgram(api.NewMessageUID(addr), api.CmdSwimUpdate, u.Subject,
+		payload), nil
+}
+
+func ParseSwimUpdateMsg(msg *api.KeyValueDgram) (*node.SwimUpdate, error) {
+	payload := &swimUpdateMsg{}
+	if err := json.Unmarshal(msg.Value, payload); err != nil {
+		return nil, err
+	}
+	return &node.SwimUpdate{Subject: msg.Key, State: payload.State,
+		Incarnation: payload.Incarnation}, nil
+}
+
+// Sends the update directly to each of the peers
+func BroadcastSwimUpdate(conn *net.UDPConn, u *node.SwimUpdate,
+	peers map[store.Key]*node.Peer) error {
+	msg, err := NewSwimUpdateMsg(u, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		conn.WriteTo(msg.Bytes(), peer.Addr)
+	}
+	return nil
+}
+
+/* Disseminates the update to random peers, which gossip it further.
+ * If to is not nil, the update is also sent directly to it.
+ */
+func GossipSwimUpdate(conn *net.UDPConn, u *node.SwimUpdate, to *net.UDPAddr) error {
+	msg, err := NewSwimUpdateMsg(u, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return err
+	}
+	if to != nil {
+		conn.WriteTo(msg.Bytes(), to)
+	}
+	Gossip(conn, msg)
+	return nil
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tsiemens/kvstore/server/cache"
+	"github.com/tsiemens/kvstore/server/node"
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/server/txn"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"net"
+)
+
+// Asks the participant at url to prepare its part of a transaction
+func SendTxPrepare(url string, rec *txn.Record) (*txn.PrepareReply, error) {
+	reply := &txn.PrepareReply{}
+	err := sendTxMsg(url, api.CmdIntraTxPrepare, rec, reply)
+	return reply, err
+}
+
+// Sends the coordinator's decision to the participant at url
+func SendTxDecision(url string, args *txn.DecisionArgs) error {
+	return sendTxMsg(url, api.CmdIntraTxDecision, args, &struct{}{})
+}
+
+/* Sends the coordinator's decision to each participant, and waits for them to
+ * acknowledge it. Records the acknowledgements, so the decision is forgotten
+ * once all participants have it.
+ */
+func SendTxDecisions(participants []store.Key, args *txn.DecisionArgs) {
+	thisNode := node.GetProcessNode()
+	done := make(chan bool, len(participants))
+	for _, participant := range participants {
+		go func(participant store.Key) {
+			if participant == thisNode.ID {
+				thisNode.FinishTransaction(args.ID, args.Commit, args.Timestamp)
+				thisNode.Txns.Acknowledge(args.ID, participant)
+			} else if peer, ok := thisNode.GetPeer(participant); ok {
+				err := SendTxDecision(peer.Addr.String(), args)
+				if err != nil {
+					log.I.Printf("Failed to send decision to %s: %s\n",
+						participant.String(), err)
+				} else {
+					thisNode.Txns.Acknowledge(args.ID, participant)
+				}
+			}
+			done <- true
+		}(participant)
+	}
+	for range participants {
+		<-done
+	}
+}
+
+// Asks the node at url for its state of a transaction
+func SendTxStatusQuery(url string, args *txn.StatusArgs) (*txn.StatusReply, error) {
+	reply := &txn.StatusReply{}
+	err := sendTxMsg(url, api.CmdIntraTxStatus, args, reply)
+	return reply, err
+}
+
+func sendTxMsg(url string, cmd byte, args interface{}, reply interface{}) error {
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	msg, err := api.SendRecv(url, func(addr *net.UDPAddr) api.Message {
+		return api.NewValueDgram(api.NewMessageUID(addr), cmd, payload)
+	})
+	if err != nil {
+		return err
+	} else if cmdErr := api.ResponseError(msg); cmdErr != nil {
+		return cmdErr
+	} else if vmsg, ok := msg.(*api.ValueDgram); ok {
+		return json.Unmarshal(vmsg.Value, reply)
+	} else {
+		return errors.New("Received invalid transaction reply datagram")
+	}
+}
+
+func ReplyToTxMsg(conn *net.UDPConn, recvAddr *net.UDPAddr, cache *cache.Cache,
+	requestMsg api.Message, reply interface{}) error {
+	replyData, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	cache.SendReply(conn, api.NewValueDgram(requestMsg.UID(), api.RespOk, replyData),
+		recvAddr)
+	return nil
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"net"
+	"sync/atomic"
+)
+
+/* WorkerPool handles received messages on a fixed number of goroutines.
+ * Client commands wait for a free worker in a bounded queue, so that a flood
+ * of requests cannot create unbounded goroutines. Messages from peers have
+ * workers and a queue of their own, so that a client flood cannot delay
+ * them, and are never answered with an overload.
+ */
+type WorkerPool struct {
+	handler     MessageHandler
+	queue       chan *request // Client commands
+	peerQueue   chan *request // Everything else
+	peerDropped int64         // Peer messages dropped since their queue was full
+}
+
+type request struct {
+	msg      api.Message
+	recvAddr *net.UDPAddr
+}
+
+// The *WorkerPool of the receiver, stored once it starts
+var pool atomic.Value
+
+// Returns the pool of the receiver, or nil if it is not running
+func GetWorkerPool() *WorkerPool {
+	p, _ := pool.Load().(*WorkerPool)
+	return p
+}
+
+// Starts workers goroutines for client commands, and as many for other
+// messages, which handle messages queued with Submit.
+// At most queueSize messages of each may wait.
+func NewWorkerPool(handler MessageHandler, workers int, queueSize int) *WorkerPool {
+	p := &WorkerPool{
+		handler:   handler,
+		queue:     make(chan *request, queueSize),
+		peerQueue: make(chan *request, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work(p.queue)
+		go p.work(p.peerQueue)
+	}
+	return p
+}
+
+func (p *WorkerPool) work(queue chan *request) {
+	for req := range queue {
+		p.handler.HandleMessage(req.msg, req.recvAddr)
+	}
+}
+
+/* Queues the message to be handled, without blocking.
+ * Returns false if it is a client command and their queue is full, so that
+ * the client can be told to back off. Other messages are dropped and counted
+ * if their queue is full, since peers retry messages which go unanswered.
+ */
+func (p *WorkerPool) Submit(msg api.Message, recvAddr *net.UDPAddr) bool {
+	req := &request{msg: msg, recvAddr: recvAddr}
+	if !p.handler.IsClientCommand(msg.Command()) {
+		select {
+		case p.peerQueue <- req:
+		default:
+			atomic.AddInt64(&p.peerDropped, 1)
+			log.E.Printf("Peer queue full. Dropping message type %x from %v\n",
+				msg.Command(), recvAddr)
+		}
+		return true
+	}
+	select {
+	case p.queue <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the number of peer messages dropped since their queue was full
+func (p *WorkerPool) PeerDropped() int64 {
+	return atomic.LoadInt64(&p.peerDropped)
+}
+
+// Returns the number of client commands waiting for a worker
+func (p *WorkerPool) QueueDepth() int {
+	return len(p.queue)
+}
+
+// Returns the maximum number of client commands which may wait
+func (p *WorkerPool) QueueSize() int {
+	return cap(p.queue)
+}
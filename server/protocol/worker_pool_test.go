@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+)
+
+func init() {
+	log.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard)
+}
+
+// Blocks handling client commands until released
+type blockingHandler struct {
+	handled     chan bool
+	release     chan bool
+	peerHandled chan bool
+}
+
+func (h *blockingHandler) HandleMessage(msg api.Message, recvAddr *net.UDPAddr) {
+	if !h.IsClientCommand(msg.Command()) {
+		h.peerHandled <- true
+		return
+	}
+	h.handled <- true
+	<-h.release
+}
+
+func (h *blockingHandler) IsClientCommand(cmd byte) bool {
+	return cmd == api.CmdGet
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{
+		handled:     make(chan bool, 3),
+		release:     make(chan bool),
+		peerHandled: make(chan bool, 3),
+	}
+}
+
+func TestWorkerPoolRejectsWhenQueueFull(t *testing.T) {
+	h := newBlockingHandler()
+	p := NewWorkerPool(h, 1, 1)
+	msg := api.NewBaseDgram([16]byte{}, api.CmdGet)
+
+	if !p.Submit(msg, nil) {
+		t.Fatal("Message rejected by an idle pool")
+	}
+	<-h.handled // The worker is busy
+	if !p.Submit(msg, nil) || p.QueueDepth() != 1 {
+		t.Fatal("Message not queued")
+	}
+	if p.Submit(msg, nil) {
+		t.Fatal("Message accepted by a full queue")
+	}
+
+	close(h.release)
+	<-h.handled
+	if !p.Submit(msg, nil) {
+		t.Fatal("Message rejected after the queue drained")
+	}
+}
+
+func TestWorkerPoolHandlesPeersDuringClientFlood(t *testing.T) {
+	h := newBlockingHandler()
+	defer close(h.release)
+	p := NewWorkerPool(h, 1, 1)
+	clientMsg := api.NewBaseDgram([16]byte{}, api.CmdGet)
+	p.Submit(clientMsg, nil)
+	<-h.handled
+	p.Submit(clientMsg, nil)
+	if p.Submit(clientMsg, nil) {
+		t.Fatal("Client command accepted by a full queue")
+	}
+
+	peerMsg := api.NewBaseDgram([16]byte{}, api.CmdMembershipQuery)
+	for i := 0; i < 3; i++ {
+		if !p.Submit(peerMsg, nil) {
+			t.Fatal("Peer message rejected")
+		}
+		select {
+		case <-h.peerHandled:
+		case <-time.After(time.Second):
+			t.Fatal("Peer message not handled while client workers are busy")
+		}
+	}
+}
+
+func TestWorkerPoolDropsPeerMessagesWhenQueueFull(t *testing.T) {
+	h := &blockingHandler{
+		handled:     make(chan bool),
+		release:     make(chan bool),
+		peerHandled: make(chan bool), // Blocks the peer worker
+	}
+	p := NewWorkerPool(h, 1, 1)
+	peerMsg := api.NewBaseDgram([16]byte{}, api.CmdMembershipQuery)
+	p.Submit(peerMsg, nil) // Taken by the worker, which then blocks
+	for p.PeerDropped() == 0 {
+		done := make(chan bool)
+		go func() {
+			p.Submit(peerMsg, nil)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Submit blocked on a full peer queue")
+		}
+	}
+	<-h.peerHandled
+}
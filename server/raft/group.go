@@ -0,0 +1,731 @@
+package raft
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"github.com/tsiemens/kvstore/shared/util"
+)
+
+const (
+	follower = iota
+	candidate
+	leader
+)
+
+// These are vars so that tests may shorten them
+var heartbeatInterval = time.Millisecond * 200
+var minElectionTimeout = time.Millisecond * 1000
+var proposeTimeout = time.Millisecond * 2000
+
+// Max approximate bytes of entries sent in one AppendEntries datagram
+const maxEntriesBytes = 8000
+
+type waiter struct {
+	term int
+	done chan *store.StoreVal
+}
+
+/* Group is this node's member of the Raft group for one range of keys.
+ * The log, term and vote are saved to the Groups' Storage before they are
+ * acted on, so a member which restarts keeps the votes and entries it gave.
+ * Applied entries are compacted into a snapshot, so the log stays short.
+ * Members change one at a time, through configuration entries, as in the
+ * single server changes of the Raft thesis. A member uses the latest
+ * configuration in its log as soon as it is appended, committed or not.
+ */
+type Group struct {
+	ID     store.Key
+	groups *Groups
+
+	lock        util.Semaphore
+	members     []store.Key // of the latest configuration in the log
+	configIndex int         // index of that configuration
+	state       int
+	term        int
+	votedFor    *store.Key
+	leader      *store.Key
+	log         []Entry // log[0] is the last compacted entry, at index base
+	base        int
+	snapshot    *Snapshot // The compacted entries, up to base
+	commitIndex int
+	lastApplied int
+	lastHeard   time.Time
+	timeout     time.Duration
+	stopped     chan bool
+
+	// Leader state
+	termStart  int // index of the first entry of this leader's term
+	nextIndex  map[store.Key]int
+	matchIndex map[store.Key]int
+	inFlight   map[store.Key]bool
+	waiters    map[int]*waiter
+	round      int                         // heartbeat round, which reads wait on
+	acked      map[store.Key]int           // latest round each peer answered
+	reads      []*readWaiter               // reads waiting to be served
+	sending    map[store.Key]*sendProgress // snapshots being sent
+
+	// Follower state
+	receiving      map[store.Key]Entry // parts of the snapshot being received
+	receivingIndex int
+}
+
+// Starts the member from its saved state, log and snapshot, if it has them
+func newGroup(id store.Key, groups *Groups, state *State, savedLog *SavedLog,
+	snapshot *Snapshot) *Group {
+	g := &Group{
+		ID:         id,
+		groups:     groups,
+		lock:       util.NewSemaphore(),
+		state:      follower,
+		log:        []Entry{{}},
+		snapshot:   &Snapshot{},
+		lastHeard:  time.Now(),
+		timeout:    randomElectionTimeout(),
+		stopped:    make(chan bool),
+		nextIndex:  map[store.Key]int{},
+		matchIndex: map[store.Key]int{},
+		inFlight:   map[store.Key]bool{},
+		waiters:    map[int]*waiter{},
+		acked:      map[store.Key]int{},
+		sending:    map[store.Key]*sendProgress{},
+	}
+	if state != nil {
+		g.term = state.Term
+		g.votedFor = state.VotedFor
+	}
+	if savedLog != nil && len(savedLog.Entries) > 0 {
+		g.log = savedLog.Entries
+		g.base = savedLog.Base
+	}
+	if snapshot != nil {
+		g.restoreSnapshot(snapshot)
+	}
+	g.updateMembers()
+	return g
+}
+
+// Starts the log of a new group with its first configuration.
+// Returns false if it could not be saved
+func (g *Group) bootstrap(members []store.Key) bool {
+	g.term = 1
+	g.log = append(g.log, Entry{Term: g.term, Op: OpConfig, Members: members})
+	g.updateMembers()
+	// No other member can lead yet, so don't wait out a timeout
+	g.lastHeard = time.Time{}
+	return g.saveState() && g.saveEntries(1)
+}
+
+func randomElectionTimeout() time.Duration {
+	return minElectionTimeout + time.Duration(util.Rand.Int63n(int64(minElectionTimeout)))
+}
+
+// Runs elections and heartbeats, until the group is stopped.
+// Only members of the latest configuration run for election.
+func (g *Group) run() {
+	for {
+		select {
+		case <-g.stopped:
+			return
+		case <-time.After(heartbeatInterval):
+		}
+		g.lock.Lock()
+		if g.state == leader {
+			g.lock.Unlock()
+			g.replicateAll()
+			g.changeMembers()
+		} else if g.isMember() && time.Since(g.lastHeard) > g.timeout {
+			g.lock.Unlock()
+			g.startElection()
+		} else {
+			g.lock.Unlock()
+		}
+	}
+}
+
+// Stops the group's elections and heartbeats, and fails pending proposals
+func (g *Group) Stop() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	select {
+	case <-g.stopped:
+		return
+	default:
+	}
+	close(g.stopped)
+	if g.state == leader {
+		g.failWaiters()
+	}
+	g.state = follower
+	g.leader = nil
+}
+
+/* The save functions save the term and vote, or the log, before they are
+ * acted on or replied with, and return whether they were saved.
+ * A stopped group no longer saves, so it can't overwrite the state of a group
+ * started again in its place, and fails whatever it was about to reply to.
+ * They must be called with the lock held.
+ */
+func (g *Group) saved(err error) bool {
+	if err != nil {
+		log.E.Printf("Raft group %s: failed to save state: %s\n", g.ID.String(), err)
+		return false
+	}
+	return true
+}
+
+func (g *Group) isStopped() bool {
+	select {
+	case <-g.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *Group) saveState() bool {
+	if g.isStopped() {
+		return false
+	}
+	return g.saved(g.groups.storage.SaveState(g.ID, &State{Term: g.term, VotedFor: g.votedFor}))
+}
+
+// Saves the entries from index on, in place of any saved from index on.
+// Entries dropped from the log without new ones in their place need not be
+// saved: the member acknowledged none of them, and the leader drops them
+// again if they come back after a restart.
+func (g *Group) saveEntries(index int) bool {
+	if g.isStopped() {
+		return false
+	}
+	return g.saved(g.groups.storage.Append(g.ID, index, g.log[index-g.base:]))
+}
+
+// Saves the whole log, once entries before it were compacted
+func (g *Group) saveLog() bool {
+	if g.isStopped() {
+		return false
+	}
+	return g.saved(g.groups.storage.SaveLog(g.ID, &SavedLog{Base: g.base, Entries: g.log}))
+}
+
+func (g *Group) lastIndex() int {
+	return g.base + len(g.log) - 1
+}
+
+// Returns the entry at index, which must be after base
+func (g *Group) entry(index int) Entry {
+	return g.log[index-g.base]
+}
+
+// Returns the term of the entry at index, which must not be before base
+func (g *Group) termAt(index int) int {
+	return g.log[index-g.base].Term
+}
+
+// Drops the entries from index on
+func (g *Group) truncate(index int) {
+	g.log = g.log[:index-g.base]
+	g.updateMembers()
+}
+
+// Returns the group's members, as of the latest configuration in the log
+func (g *Group) Members() []store.Key {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.members
+}
+
+/* Takes the members of the latest configuration in the log, or of the
+ * snapshot if the log holds none. A leader starts replicating to the members
+ * added.
+ * Must be called with the lock held, whenever entries are added to or
+ * dropped from the log.
+ */
+func (g *Group) updateMembers() {
+	g.members, g.configIndex = g.configAt(g.lastIndex())
+	if g.state != leader {
+		return
+	}
+	for _, peer := range g.peers() {
+		if _, ok := g.nextIndex[peer]; !ok {
+			g.nextIndex[peer] = g.lastIndex() + 1
+			g.matchIndex[peer] = 0
+			g.inFlight[peer] = false
+			g.acked[peer] = 0
+		}
+	}
+}
+
+// Returns the members as of the entry at index, and the index of the
+// configuration they were added with. index must not be before base
+func (g *Group) configAt(index int) ([]store.Key, int) {
+	for i := index; i > g.base; i-- {
+		if entry := g.entry(i); entry.Op == OpConfig {
+			return entry.Members, i
+		}
+	}
+	return g.snapshot.Members, g.base
+}
+
+func (g *Group) isMember() bool {
+	return containsMember(g.members, g.groups.self)
+}
+
+func (g *Group) majority() int {
+	return len(g.members)/2 + 1
+}
+
+// Returns the number of members, counting this one if it is a member, for
+// which has returns true
+func (g *Group) count(has func(peer store.Key) bool) int {
+	count := 0
+	if g.isMember() {
+		count++
+	}
+	for _, peer := range g.peers() {
+		if has(peer) {
+			count++
+		}
+	}
+	return count
+}
+
+func (g *Group) peers() []store.Key {
+	peers := make([]store.Key, 0, len(g.members))
+	for _, member := range g.members {
+		if member != g.groups.self {
+			peers = append(peers, member)
+		}
+	}
+	return peers
+}
+
+// Must be called with the lock held
+func (g *Group) becomeFollower(term int) {
+	if term > g.term {
+		g.term = term
+		g.votedFor = nil
+	}
+	if g.state == leader {
+		log.I.Printf("Raft group %s: no longer leader\n", g.ID.String())
+		g.failWaiters()
+	}
+	g.state = follower
+}
+
+func (g *Group) startElection() {
+	g.lock.Lock()
+	g.state = candidate
+	g.term++
+	self := g.groups.self
+	g.votedFor = &self
+	g.leader = nil
+	g.lastHeard = time.Now()
+	g.timeout = randomElectionTimeout()
+	if !g.saveState() {
+		g.state = follower
+		g.lock.Unlock()
+		return
+	}
+	args := &RequestVoteArgs{
+		Term:         g.term,
+		Candidate:    self,
+		LastLogIndex: g.lastIndex(),
+		LastLogTerm:  g.termAt(g.lastIndex()),
+	}
+	peers := g.peers()
+	majority := g.majority()
+	g.lock.Unlock()
+
+	log.D.Printf("Raft group %s: starting election for term %d\n", g.ID.String(), args.Term)
+	votes := make(chan bool, len(peers))
+	for _, peer := range peers {
+		go func(peer store.Key) {
+			reply := &RequestVoteReply{}
+			err := g.groups.call(peer, api.CmdRaftRequestVote, g.ID, args, reply)
+			if err != nil {
+				votes <- false
+				return
+			}
+			g.lock.Lock()
+			if reply.Term > g.term {
+				g.becomeFollower(reply.Term)
+				g.saveState()
+			}
+			g.lock.Unlock()
+			votes <- reply.VoteGranted
+		}(peer)
+	}
+
+	granted := 1 // our own vote
+	for range peers {
+		if granted >= majority {
+			break
+		}
+		if <-votes {
+			granted++
+		}
+	}
+
+	g.lock.Lock()
+	if granted >= majority && g.state == candidate && g.term == args.Term {
+		g.becomeLeader()
+		if !g.saveEntries(g.lastIndex()) {
+			g.becomeFollower(g.term)
+			g.lock.Unlock()
+			return
+		}
+		g.lock.Unlock()
+		g.replicateAll()
+		return
+	}
+	g.lock.Unlock()
+}
+
+// Must be called with the lock held
+func (g *Group) becomeLeader() {
+	log.I.Printf("Raft group %s: leader for term %d\n", g.ID.String(), g.term)
+	g.state = leader
+	self := g.groups.self
+	g.leader = &self
+	g.nextIndex = map[store.Key]int{}
+	g.matchIndex = map[store.Key]int{}
+	g.inFlight = map[store.Key]bool{}
+	g.acked = map[store.Key]int{}
+	g.sending = map[store.Key]*sendProgress{}
+	g.updateMembers()
+	// Entries from earlier terms can only be committed along with one
+	// from the current term
+	g.log = append(g.log, Entry{Term: g.term, Op: OpNoop})
+	g.termStart = g.lastIndex()
+}
+
+func (g *Group) replicateAll() {
+	g.lock.Lock()
+	peers := g.peers()
+	g.advanceCommit()
+	g.lock.Unlock()
+	for _, peer := range peers {
+		go g.replicate(peer)
+	}
+}
+
+/* Proposes a change to the members, toward the replicas this node's view of
+ * the ring gives the range. Members are added before any are removed, one at
+ * a time, and only once the previous change and an entry of this leader's
+ * term have committed, so that any two majorities overlap.
+ */
+func (g *Group) changeMembers() {
+	view := g.groups.membersOf(g.ID)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.state != leader || len(view) == 0 ||
+		g.configIndex > g.commitIndex || g.termStart > g.commitIndex {
+		return
+	}
+	members := nextMembers(g.members, view)
+	if members == nil {
+		return
+	}
+	log.I.Printf("Raft group %s: changing to %d members\n", g.ID.String(), len(members))
+	g.log = append(g.log, Entry{Term: g.term, Op: OpConfig, Members: members})
+	g.updateMembers()
+	if !g.saveEntries(g.lastIndex()) {
+		g.truncate(g.lastIndex())
+	}
+}
+
+// Returns members with one member of view added, or if none is missing, one
+// not in view removed. Returns nil if members already match view.
+func nextMembers(members []store.Key, view []store.Key) []store.Key {
+	for _, id := range view {
+		if !containsMember(members, id) {
+			return append(append([]store.Key{}, members...), id)
+		}
+	}
+	for i, id := range members {
+		if !containsMember(view, id) {
+			return append(append([]store.Key{}, members[:i]...), members[i+1:]...)
+		}
+	}
+	return nil
+}
+
+// Sends the entries peer is missing (or a heartbeat) to peer.
+// Peers missing compacted entries are sent the snapshot instead.
+func (g *Group) replicate(peer store.Key) {
+	g.lock.Lock()
+	if g.state != leader || g.inFlight[peer] {
+		g.lock.Unlock()
+		return
+	}
+	if g.nextIndex[peer] <= g.base {
+		g.lock.Unlock()
+		g.sendSnapshot(peer)
+		return
+	}
+	g.inFlight[peer] = true
+	round := g.round
+	prevIndex := g.nextIndex[peer] - 1
+	entries := []Entry{}
+	size := 0
+	for i := prevIndex + 1; i <= g.lastIndex(); i++ {
+		size += len(g.entry(i).Val) + 100
+		if len(entries) > 0 && size > maxEntriesBytes {
+			break
+		}
+		entries = append(entries, g.entry(i))
+	}
+	args := &AppendEntriesArgs{
+		Term:         g.term,
+		Leader:       g.groups.self,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  g.termAt(prevIndex),
+		Entries:      entries,
+		LeaderCommit: g.commitIndex,
+	}
+	g.lock.Unlock()
+
+	reply := &AppendEntriesReply{}
+	err := g.groups.call(peer, api.CmdRaftAppendEntries, g.ID, args, reply)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.inFlight[peer] = false
+	if err != nil || g.state != leader || g.term != args.Term {
+		return
+	}
+	if reply.Term > g.term {
+		g.becomeFollower(reply.Term)
+		g.saveState()
+		return
+	}
+	if reply.Success {
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > g.matchIndex[peer] {
+			g.matchIndex[peer] = match
+		}
+		g.nextIndex[peer] = g.matchIndex[peer] + 1
+		g.ack(peer, round)
+		g.advanceCommit()
+	} else if reply.ConflictIndex > 0 && reply.ConflictIndex < g.nextIndex[peer] {
+		g.nextIndex[peer] = reply.ConflictIndex
+	} else if g.nextIndex[peer] > 1 {
+		g.nextIndex[peer]--
+	}
+}
+
+// Commits the highest entry of the current term stored on a majority.
+// Must be called with the lock held
+func (g *Group) advanceCommit() {
+	if g.state != leader {
+		return
+	}
+	for n := g.lastIndex(); n > g.commitIndex; n-- {
+		if g.termAt(n) != g.term {
+			break
+		}
+		count := g.count(func(peer store.Key) bool {
+			return g.matchIndex[peer] >= n
+		})
+		if count >= g.majority() {
+			g.commitIndex = n
+			break
+		}
+	}
+	g.applyCommitted()
+	if g.configIndex <= g.commitIndex && !g.isMember() {
+		// A leader removing itself leads until the change commits
+		log.I.Printf("Raft group %s: removed from the group\n", g.ID.String())
+		g.becomeFollower(g.term)
+		g.leader = nil
+	}
+}
+
+// Must be called with the lock held
+func (g *Group) applyCommitted() {
+	for g.lastApplied < g.commitIndex {
+		g.lastApplied++
+		entry := g.entry(g.lastApplied)
+		var result *store.StoreVal
+		if entry.Op != OpNoop && entry.Op != OpConfig {
+			result = g.groups.apply(entry)
+		}
+		if w, ok := g.waiters[g.lastApplied]; ok {
+			delete(g.waiters, g.lastApplied)
+			if w.term == entry.Term {
+				w.done <- result
+			} else {
+				close(w.done)
+			}
+		}
+	}
+	g.serveReads()
+	if g.lastApplied-g.base >= maxLogEntries {
+		g.compact()
+	}
+}
+
+// Must be called with the lock held
+func (g *Group) failWaiters() {
+	for index, w := range g.waiters {
+		close(w.done)
+		delete(g.waiters, index)
+	}
+	g.failReads()
+}
+
+/* Votes for the candidate if its log is at least as up to date as this
+ * member's. Any member votes, whether or not it is in its own configuration.
+ * A member which has heard from a leader within the minimum election timeout
+ * ignores candidates, so that a member which was removed without learning of
+ * it can't disrupt the group by campaigning.
+ */
+func (g *Group) HandleRequestVote(args *RequestVoteArgs) *RequestVoteReply {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.state == leader ||
+		(g.leader != nil && time.Since(g.lastHeard) < minElectionTimeout) {
+		return &RequestVoteReply{Term: g.term}
+	}
+	termChanged := args.Term > g.term
+	if termChanged {
+		g.becomeFollower(args.Term)
+	}
+	reply := &RequestVoteReply{Term: g.term}
+	if args.Term < g.term {
+		return reply
+	}
+	lastTerm := g.termAt(g.lastIndex())
+	upToDate := args.LastLogTerm > lastTerm ||
+		(args.LastLogTerm == lastTerm && args.LastLogIndex >= g.lastIndex())
+	if (g.votedFor == nil || *g.votedFor == args.Candidate) && upToDate {
+		candidate := args.Candidate
+		g.votedFor = &candidate
+		g.lastHeard = time.Now()
+		reply.VoteGranted = true
+	}
+	if (termChanged || reply.VoteGranted) && !g.saveState() {
+		reply.VoteGranted = false
+	}
+	return reply
+}
+
+func (g *Group) HandleAppendEntries(args *AppendEntriesArgs) *AppendEntriesReply {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	reply := &AppendEntriesReply{Term: g.term}
+	if args.Term < g.term {
+		return reply
+	}
+	changed := args.Term > g.term
+	g.becomeFollower(args.Term)
+	reply.Term = g.term
+	if changed && !g.saveState() {
+		return reply
+	}
+	leaderId := args.Leader
+	g.leader = &leaderId
+	g.lastHeard = time.Now()
+
+	prevIndex, prevTerm, entries := args.PrevLogIndex, args.PrevLogTerm, args.Entries
+	if prevIndex < g.base {
+		// Compacted entries were committed, so they match the leader's
+		skip := g.base - prevIndex
+		if skip > len(entries) {
+			skip = len(entries)
+		}
+		entries = entries[skip:]
+		prevIndex, prevTerm = g.base, g.termAt(g.base)
+	}
+	if prevIndex > g.lastIndex() {
+		reply.ConflictIndex = g.lastIndex() + 1
+		return reply
+	}
+	if prevIndex > g.base && g.termAt(prevIndex) != prevTerm {
+		// Drop the conflicting entry and everything after it
+		g.truncate(prevIndex)
+		reply.ConflictIndex = prevIndex
+		return reply
+	}
+
+	firstNew := 0
+	for i, entry := range entries {
+		index := prevIndex + 1 + i
+		if index <= g.lastIndex() {
+			if g.termAt(index) == entry.Term {
+				continue
+			}
+			g.truncate(index)
+		}
+		if firstNew == 0 {
+			firstNew = index
+		}
+		g.groups.clock.Update(entry.Timestamp)
+		g.log = append(g.log, entry)
+	}
+	if firstNew > 0 {
+		g.updateMembers()
+		// The leader counts the entries as stored once this replies
+		if !g.saveEntries(firstNew) {
+			return reply
+		}
+	}
+
+	lastNew := args.PrevLogIndex + len(args.Entries)
+	if args.LeaderCommit > g.commitIndex {
+		if args.LeaderCommit < lastNew {
+			g.commitIndex = args.LeaderCommit
+		} else {
+			g.commitIndex = lastNew
+		}
+		g.applyCommitted()
+	}
+	reply.Success = true
+	return reply
+}
+
+/* Appends the entry to the log if this member is the leader, and waits for
+ * it to be applied. Gets are not appended, but read once the leader has
+ * confirmed it still leads.
+ * If not the leader, returns the known leader, if any, to retry with.
+ */
+func (g *Group) Propose(entry Entry) (*store.StoreVal, *store.Key, error) {
+	if entry.Op == api.CmdGet {
+		return g.read(entry)
+	}
+	g.lock.Lock()
+	if g.state != leader {
+		leader := g.leader
+		g.lock.Unlock()
+		return nil, leader, errors.New("Not the group leader")
+	}
+	entry.Term = g.term
+	g.groups.clock.Update(entry.Timestamp)
+	entry.Timestamp = g.groups.clock.Now()
+	g.log = append(g.log, entry)
+	if !g.saveEntries(g.lastIndex()) {
+		g.truncate(g.lastIndex())
+		g.lock.Unlock()
+		return nil, nil, errors.New("Failed to save entry")
+	}
+	w := &waiter{term: g.term, done: make(chan *store.StoreVal, 1)}
+	g.waiters[g.lastIndex()] = w
+	g.lock.Unlock()
+
+	go g.replicateAll()
+
+	select {
+	case result, ok := <-w.done:
+		if !ok {
+			return nil, nil, errors.New("Entry lost with leadership change")
+		}
+		return result, nil, nil
+	case <-time.After(proposeTimeout):
+		return nil, nil, errors.New("Timed out waiting for entry to commit")
+	}
+}
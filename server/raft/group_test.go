@@ -0,0 +1,432 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"github.com/tsiemens/kvstore/shared/util"
+)
+
+type testClock struct {
+	t    int64
+	lock util.Semaphore
+}
+
+func (c *testClock) Now() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t++
+	return c.t
+}
+
+func (c *testClock) Update(remote int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if remote > c.t {
+		c.t = remote
+	}
+}
+
+// The range id every test group is started for
+var testGroupID = store.Key(api.ByteArray32([]byte{0x99}))
+
+type testCluster struct {
+	members []store.Key
+	groups  map[store.Key]*Groups
+	stores  map[store.Key]*store.Store
+	down    map[store.Key]bool
+	lock    util.Semaphore
+}
+
+func init() {
+	log.Init(ioDiscard{}, ioDiscard{}, ioDiscard{})
+	heartbeatInterval = time.Millisecond * 10
+	minElectionTimeout = time.Millisecond * 50
+	maxLogEntries = 10
+}
+
+func newTestCluster(size int) *testCluster {
+	c := &testCluster{
+		groups: map[store.Key]*Groups{},
+		stores: map[store.Key]*store.Store{},
+		down:   map[store.Key]bool{},
+		lock:   util.NewSemaphore(),
+	}
+	for i := 0; i < size; i++ {
+		id := store.Key(api.ByteArray32([]byte{byte(i + 1)}))
+		c.members = append(c.members, id)
+		s := store.New()
+		c.stores[id] = s
+		c.groups[id] = New(id, &testClock{lock: util.NewSemaphore()}, c.transportFrom(id),
+			func(e Entry) *store.StoreVal {
+				if e.Op == api.CmdPut {
+					s.Put(e.Key, e.Val, e.Timestamp)
+				}
+				v, _ := s.Get(e.Key)
+				return v
+			}, c.currentMembers, newTestStorage())
+	}
+	return c
+}
+
+func (c *testCluster) currentMembers(groupId store.Key) []store.Key {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.members
+}
+
+func (c *testCluster) setMembers(members []store.Key) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.members = members
+}
+
+func (c *testCluster) isDown(id store.Key) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.down[id]
+}
+
+func (c *testCluster) setDown(id store.Key, down bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.down[id] = down
+}
+
+// Returns a transport which drops messages to or from members which are down
+func (c *testCluster) transportFrom(sender store.Key) Transport {
+	return func(peer store.Key, cmd byte, groupId store.Key,
+		payload []byte) ([]byte, error) {
+		if c.isDown(sender) || c.isDown(peer) {
+			return nil, errors.New("down")
+		}
+		return c.deliver(peer, cmd, groupId, payload)
+	}
+}
+
+func (c *testCluster) deliver(peer store.Key, cmd byte, groupId store.Key,
+	payload []byte) ([]byte, error) {
+	g := c.groups[peer].Join(groupId)
+	if g == nil {
+		return nil, errors.New("not a member")
+	}
+	var reply interface{}
+	switch cmd {
+	case api.CmdRaftRequestVote:
+		args := &RequestVoteArgs{}
+		json.Unmarshal(payload, args)
+		reply = g.HandleRequestVote(args)
+	case api.CmdRaftAppendEntries:
+		args := &AppendEntriesArgs{}
+		json.Unmarshal(payload, args)
+		reply = g.HandleAppendEntries(args)
+	case api.CmdRaftInstallSnapshot:
+		args := &InstallSnapshotArgs{}
+		json.Unmarshal(payload, args)
+		reply = g.HandleInstallSnapshot(args)
+	}
+	return json.Marshal(reply)
+}
+
+// Proposes on whichever member accepts it, until timeout
+func (c *testCluster) propose(t *testing.T, entry Entry) (store.Key, *store.StoreVal) {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		for _, id := range c.currentMembers(testGroupID) {
+			if c.isDown(id) {
+				continue
+			}
+			val, _, err := c.groups[id].Group(testGroupID).Propose(entry)
+			if err == nil {
+				return id, val
+			}
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("No leader accepted the proposal")
+	return store.Key{}, nil
+}
+
+func (c *testCluster) waitForValue(t *testing.T, id store.Key, key store.Key, val string) {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		if v, err := c.stores[id].Get(key); err == nil && string(v.Val) == val {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("Value %s never applied on member %d", val, id[31])
+}
+
+// Keeps saved states, logs and snapshots in memory
+type testStorage struct {
+	states    map[store.Key][]byte
+	logs      map[store.Key]*SavedLog
+	snapshots map[store.Key][]byte
+	lock      util.Semaphore
+}
+
+func newTestStorage() *testStorage {
+	return &testStorage{
+		states:    map[store.Key][]byte{},
+		logs:      map[store.Key]*SavedLog{},
+		snapshots: map[store.Key][]byte{},
+		lock:      util.NewSemaphore(),
+	}
+}
+
+func (s *testStorage) SaveState(groupId store.Key, state *State) error {
+	data, err := json.Marshal(state)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.states[groupId] = data
+	return err
+}
+
+func (s *testStorage) Append(groupId store.Key, index int, entries []Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	log, ok := s.logs[groupId]
+	if !ok {
+		log = &SavedLog{Entries: []Entry{{}}}
+		s.logs[groupId] = log
+	}
+	log.Entries = append(log.Entries[:index-log.Base:index-log.Base], entries...)
+	return nil
+}
+
+func (s *testStorage) SaveLog(groupId store.Key, log *SavedLog) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.logs[groupId] = &SavedLog{Base: log.Base, Entries: append([]Entry{}, log.Entries...)}
+	return nil
+}
+
+func (s *testStorage) SaveSnapshot(groupId store.Key, snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.snapshots[groupId] = data
+	return err
+}
+
+func (s *testStorage) Load(groupId store.Key) (*State, *SavedLog, *Snapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var state *State
+	var log *SavedLog
+	var snapshot *Snapshot
+	if data, ok := s.states[groupId]; ok {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if saved, ok := s.logs[groupId]; ok {
+		log = &SavedLog{Base: saved.Base, Entries: append([]Entry{}, saved.Entries...)}
+	}
+	if data, ok := s.snapshots[groupId]; ok {
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return state, log, snapshot, nil
+}
+
+type ioDiscard struct{}
+
+func (ioDiscard) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestReplicatesToAllMembers(t *testing.T) {
+	c := newTestCluster(3)
+	key := store.Key(api.ByteArray32([]byte{0x42}))
+
+	c.propose(t, Entry{Op: api.CmdPut, Key: key, Val: []byte("a")})
+	for _, id := range c.members {
+		c.waitForValue(t, id, key, "a")
+	}
+
+	_, val := c.propose(t, Entry{Op: api.CmdGet, Key: key})
+	if val == nil || string(val.Val) != "a" {
+		t.Fatal("Read through the log returned the wrong value")
+	}
+}
+
+func TestNewLeaderAfterLeaderFails(t *testing.T) {
+	c := newTestCluster(3)
+	key := store.Key(api.ByteArray32([]byte{0x42}))
+
+	oldLeader, _ := c.propose(t, Entry{Op: api.CmdPut, Key: key, Val: []byte("a")})
+	c.setDown(oldLeader, true)
+
+	newLeader, _ := c.propose(t, Entry{Op: api.CmdPut, Key: key, Val: []byte("b")})
+	if newLeader == oldLeader {
+		t.Fatal("Failed leader accepted a proposal")
+	}
+	for _, id := range c.members {
+		if id != oldLeader {
+			c.waitForValue(t, id, key, "b")
+		}
+	}
+
+	// The old leader is caught up once it returns
+	c.setDown(oldLeader, false)
+	c.waitForValue(t, oldLeader, key, "b")
+}
+
+// Waits until each of ids has exactly ids as the group's members
+func (c *testCluster) waitForMembers(t *testing.T, ids []store.Key) {
+	deadline := time.Now().Add(time.Second * 5)
+	for _, id := range ids {
+		for {
+			members := c.groups[id].Group(testGroupID).Members()
+			same := len(members) == len(ids)
+			for _, member := range ids {
+				same = same && containsMember(members, member)
+			}
+			if same {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatalf("Member %d never took the new members", id[31])
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+func TestMembersChangedThroughLog(t *testing.T) {
+	c := newTestCluster(4)
+	all := c.members
+	c.setMembers(all[:3])
+	key := store.Key(api.ByteArray32([]byte{0x42}))
+	c.propose(t, Entry{Op: api.CmdPut, Key: key, Val: []byte("a")})
+
+	// A replica is added once the leader sees it, and catches up
+	c.setMembers(all)
+	c.waitForMembers(t, all)
+	c.waitForValue(t, all[3], key, "a")
+
+	// The member which started the group is removed, and the others carry
+	// on without it
+	c.setMembers(all[1:])
+	c.waitForMembers(t, all[1:])
+	c.propose(t, Entry{Op: api.CmdPut, Key: key, Val: []byte("b")})
+	for _, id := range all[1:] {
+		c.waitForValue(t, id, key, "b")
+	}
+}
+
+func TestOnlyRangeOwnerStartsGroup(t *testing.T) {
+	c := newTestCluster(3)
+	// Started before the owner, but must wait for it
+	follower := c.groups[c.members[1]].Group(testGroupID)
+	time.Sleep(minElectionTimeout * 3)
+	if members := follower.Members(); len(members) != 0 {
+		t.Fatal("A member other than the range owner configured the group")
+	}
+	c.propose(t, Entry{Op: api.CmdPut, Key: store.Key{0x42}, Val: []byte("a")})
+	c.waitForMembers(t, c.members)
+}
+
+func TestRestartedMemberKeepsVote(t *testing.T) {
+	c := newTestCluster(3)
+	// Not the range owner, so the member starts with an empty log
+	self, first, second := c.members[1], c.members[0], c.members[2]
+	storage := newTestStorage()
+	noSend := func(store.Key, byte, store.Key, []byte) ([]byte, error) {
+		return nil, errors.New("down")
+	}
+	start := func() *Group {
+		gs := New(self, &testClock{lock: util.NewSemaphore()}, noSend,
+			func(e Entry) *store.StoreVal { return nil }, c.currentMembers, storage)
+		return gs.Group(testGroupID)
+	}
+	// Far ahead of any term the member could reach by itself during the test
+	term := 1000
+
+	g := start()
+	reply := g.HandleRequestVote(&RequestVoteArgs{Term: term, Candidate: first})
+	if !reply.VoteGranted {
+		t.Fatal("Vote was not granted")
+	}
+	g.Stop()
+
+	g = start()
+	reply = g.HandleRequestVote(&RequestVoteArgs{Term: term, Candidate: second})
+	if reply.VoteGranted {
+		t.Fatal("Restarted member voted twice in one term")
+	}
+	g.Stop()
+}
+
+func (c *testCluster) logLength(id store.Key) (int, int) {
+	g := c.groups[id].Group(testGroupID)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.lastIndex(), len(g.log)
+}
+
+func TestReadsAreNotLogged(t *testing.T) {
+	c := newTestCluster(3)
+	key := store.Key(api.ByteArray32([]byte{0x42}))
+	leader, _ := c.propose(t, Entry{Op: api.CmdPut, Key: key, Val: []byte("a")})
+	before, _ := c.logLength(leader)
+
+	for i := 0; i < 5; i++ {
+		_, val := c.propose(t, Entry{Op: api.CmdGet, Key: key})
+		if val == nil || string(val.Val) != "a" {
+			t.Fatal("Read returned the wrong value")
+		}
+	}
+	if after, _ := c.logLength(leader); after != before {
+		t.Fatalf("Reads were appended to the log: %d entries before, %d after",
+			before, after)
+	}
+}
+
+func TestWriteNewerThanProposedVersion(t *testing.T) {
+	c := newTestCluster(3)
+	key := store.Key(api.ByteArray32([]byte{0x42}))
+	_, val := c.propose(t, Entry{Op: api.CmdPut, Key: key, Val: []byte("a"), Timestamp: 1000})
+	if val == nil || val.Timestamp <= 1000 {
+		t.Fatal("Write was not newer than the proposed version")
+	}
+}
+
+func TestLaggingMemberCaughtUpFromSnapshot(t *testing.T) {
+	c := newTestCluster(3)
+	first := store.Key(api.ByteArray32([]byte{0x42}))
+	leader, _ := c.propose(t, Entry{Op: api.CmdPut, Key: first, Val: []byte("a")})
+	var lagging store.Key
+	for _, id := range c.members {
+		if id != leader {
+			lagging = id
+		}
+	}
+	c.setDown(lagging, true)
+
+	keys := []store.Key{}
+	for i := 0; i < maxLogEntries*3; i++ {
+		key := store.Key(api.ByteArray32([]byte{0x50, byte(i)}))
+		keys = append(keys, key)
+		c.propose(t, Entry{Op: api.CmdPut, Key: key, Val: []byte("b")})
+	}
+	for _, id := range c.members {
+		if id == lagging {
+			continue
+		}
+		if _, length := c.logLength(id); length > maxLogEntries+1 {
+			t.Fatalf("Log of member %d was not compacted: %d entries", id[31], length)
+		}
+	}
+
+	c.setDown(lagging, false)
+	c.waitForValue(t, lagging, first, "a")
+	for _, key := range keys {
+		c.waitForValue(t, lagging, key, "b")
+	}
+}
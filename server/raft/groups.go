@@ -0,0 +1,144 @@
+package raft
+
+import (
+	"encoding/json"
+
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/log"
+	"github.com/tsiemens/kvstore/shared/util"
+)
+
+// Sends a raft message to the peer, and returns its reply payload.
+// Implemented by the protocol package, to avoid import cycles.
+type Transport func(peer store.Key, cmd byte, groupId store.Key,
+	payload []byte) ([]byte, error)
+
+// Applies a committed entry to the store, and returns the result
+type Applier func(entry Entry) *store.StoreVal
+
+// Returns the replicas of the range with groupId, as this node currently
+// sees them, starting with the node owning the range's token. Returns none if
+// the range does not exist in this node's view.
+type MembersOf func(groupId store.Key) []store.Key
+
+// Clock issues the versions that committed values are written with
+type Clock interface {
+	Now() int64
+	Update(remote int64)
+}
+
+// Groups holds the raft groups this node is a member of
+type Groups struct {
+	self      store.Key
+	clock     Clock
+	send      Transport
+	apply     Applier
+	membersOf MembersOf
+	storage   Storage
+	m         map[store.Key]*Group
+	lock      util.Semaphore
+}
+
+var groups *Groups
+
+func Init(self store.Key, clock Clock, send Transport, apply Applier,
+	membersOf MembersOf, storage Storage) {
+	groups = New(self, clock, send, apply, membersOf, storage)
+}
+
+func GetGroups() *Groups {
+	return groups
+}
+
+func New(self store.Key, clock Clock, send Transport, apply Applier,
+	membersOf MembersOf, storage Storage) *Groups {
+	return &Groups{
+		self:      self,
+		clock:     clock,
+		send:      send,
+		apply:     apply,
+		membersOf: membersOf,
+		storage:   storage,
+		m:         map[store.Key]*Group{},
+		lock:      util.NewSemaphore(),
+	}
+}
+
+/* Returns the group with id, starting it if this node has saved state for it,
+ * or sees itself among the range's replicas.
+ * Groups are identified by the key range they replicate, which outlives
+ * changes to its replica set. The members of a group are those of the
+ * configuration entries in its log, not of any node's view of the ring, so
+ * members with diverging views still agree on who may vote. The leader
+ * changes the configuration to follow its view.
+ * Returns nil if this node is not a member, or its saved state could not be
+ * loaded.
+ */
+func (gs *Groups) Group(id store.Key) *Group {
+	return gs.start(id, false)
+}
+
+// Returns the group with id for a message from another of its members,
+// starting it even if this node has not yet seen itself among the replicas.
+func (gs *Groups) Join(id store.Key) *Group {
+	return gs.start(id, true)
+}
+
+/* A group with no saved state is started with an empty configuration, and
+ * waits for the leader to add it, except on the node owning the range's
+ * token. That node starts the log with the first configuration, so there is
+ * only ever one, whatever the other members' views.
+ */
+func (gs *Groups) start(id store.Key, join bool) *Group {
+	members := gs.membersOf(id)
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	if g, ok := gs.m[id]; ok {
+		return g
+	}
+	state, savedLog, snapshot, err := gs.storage.Load(id)
+	if err != nil {
+		log.E.Printf("Raft group %s: failed to load state: %s\n", id.String(), err)
+		return nil
+	}
+	isNew := state == nil && savedLog == nil && snapshot == nil
+	if isNew && !join && !containsMember(members, gs.self) {
+		return nil
+	}
+	g := newGroup(id, gs, state, savedLog, snapshot)
+	if isNew && len(members) > 0 && members[0] == gs.self && !g.bootstrap(members) {
+		return nil
+	}
+	gs.m[id] = g
+	go g.run()
+	return g
+}
+
+// Returns the number of groups this node is running
+func (gs *Groups) Len() int {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	return len(gs.m)
+}
+
+func containsMember(members []store.Key, id store.Key) bool {
+	for _, member := range members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (gs *Groups) call(peer store.Key, cmd byte, groupId store.Key,
+	args interface{}, reply interface{}) error {
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	replyData, err := gs.send(peer, cmd, groupId, payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(replyData, reply)
+}
@@ -0,0 +1,85 @@
+package raft
+
+import (
+	"github.com/tsiemens/kvstore/server/store"
+)
+
+// Op for entries which only exist to commit entries from earlier terms
+const OpNoop = 0x00
+
+// Op for entries which change the group's members to Members
+const OpConfig = 0xff
+
+// Entry is a single command in a group's replicated log.
+// Op is one of api.CmdPut or api.CmdRemove, OpNoop or OpConfig.
+// Gets are proposed as entries too, but are served by the leader without
+// being appended, once it has confirmed it still leads.
+// Applying an entry only writes it if it is newer than the stored version,
+// so applying entries again, or out of order, leaves the same store.
+type Entry struct {
+	Term int
+	Op   byte
+	Key  store.Key
+	Val  []byte
+	// Version the value is written with, assigned by the leader. A proposal
+	// may set it to a version the assigned one must be newer than.
+	Timestamp int64
+	Members   []store.Key // of OpConfig entries
+}
+
+type RequestVoteArgs struct {
+	Term         int
+	Candidate    store.Key
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         int
+	Leader       store.Key
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []Entry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+	// On failure, the index the leader should retry from
+	ConflictIndex int
+}
+
+// Sent to a member missing entries the leader has compacted. The snapshot is
+// sent in several of these, and stands in for the log up to Index once Done.
+type InstallSnapshotArgs struct {
+	Term     int
+	Leader   store.Key
+	Index    int
+	LastTerm int         // term of the entry at Index
+	Members  []store.Key // the group's members as of Index
+	Entries  []Entry
+	Done     bool
+}
+
+type InstallSnapshotReply struct {
+	Term    int
+	Success bool
+}
+
+// Sent by a coordinator to a group member, to run an entry through the log
+type ProposeArgs struct {
+	Group store.Key
+	Entry Entry
+}
+
+type ProposeReply struct {
+	Ok     bool
+	Leader *store.Key // set if the receiver was not the leader, but knows it
+	Val    *store.StoreVal
+}
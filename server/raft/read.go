@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tsiemens/kvstore/server/store"
+)
+
+/* readWaiter is a get waiting to be served by the leader.
+ * It is served once a majority has answered a heartbeat round sent after it
+ * arrived, which shows no other leader had committed anything newer, and
+ * this member has applied everything committed when it arrived.
+ */
+type readWaiter struct {
+	index int // commit index when the read arrived
+	round int
+	entry Entry
+	done  chan *store.StoreVal
+}
+
+// Serves a get without appending it to the log, as the ReadIndex algorithm
+// of the Raft paper does
+func (g *Group) read(entry Entry) (*store.StoreVal, *store.Key, error) {
+	g.lock.Lock()
+	if g.state != leader {
+		leader := g.leader
+		g.lock.Unlock()
+		return nil, leader, errors.New("Not the group leader")
+	}
+	g.round++
+	index := g.commitIndex
+	if index < g.termStart {
+		// The commit index may lag until an entry of this term commits
+		index = g.termStart
+	}
+	r := &readWaiter{index: index, round: g.round, entry: entry,
+		done: make(chan *store.StoreVal, 1)}
+	g.reads = append(g.reads, r)
+	g.serveReads()
+	g.lock.Unlock()
+
+	go g.replicateAll()
+
+	select {
+	case result, ok := <-r.done:
+		if !ok {
+			return nil, nil, errors.New("Read lost with leadership change")
+		}
+		return result, nil, nil
+	case <-time.After(proposeTimeout):
+		return nil, nil, errors.New("Timed out waiting to confirm leadership")
+	}
+}
+
+// Records that peer accepted the leader's heartbeat of round.
+// Must be called with the lock held
+func (g *Group) ack(peer store.Key, round int) {
+	if round > g.acked[peer] {
+		g.acked[peer] = round
+		g.serveReads()
+	}
+}
+
+// Serves the reads whose round a majority answered, once their index is
+// applied. Must be called with the lock held
+func (g *Group) serveReads() {
+	if g.state != leader {
+		return
+	}
+	waiting := g.reads[:0]
+	for _, r := range g.reads {
+		count := g.count(func(peer store.Key) bool {
+			return g.acked[peer] >= r.round
+		})
+		if count >= g.majority() && g.lastApplied >= r.index {
+			r.done <- g.groups.apply(r.entry)
+		} else {
+			waiting = append(waiting, r)
+		}
+	}
+	g.reads = waiting
+}
+
+// Must be called with the lock held
+func (g *Group) failReads() {
+	for _, r := range g.reads {
+		close(r.done)
+	}
+	g.reads = nil
+}
@@ -0,0 +1,228 @@
+package raft
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+)
+
+// Number of applied entries the log may hold before they are compacted.
+// A var so that tests may shorten it
+var maxLogEntries = 1000
+
+// A snapshot being sent to a peer
+type sendProgress struct {
+	index int // of the snapshot being sent
+	next  int // first of its entries not yet accepted
+}
+
+/* Folds the applied entries into the snapshot, keeping the latest entry of
+ * each key, and drops them from the log.
+ * Must be called with the lock held
+ */
+func (g *Group) compact() {
+	select {
+	case <-g.stopped:
+		return
+	default:
+	}
+	latest := map[store.Key]Entry{}
+	for _, entry := range g.snapshot.Entries {
+		latest[entry.Key] = entry
+	}
+	for i := g.base + 1; i <= g.lastApplied; i++ {
+		if entry := g.entry(i); entry.Op != OpNoop && entry.Op != OpConfig {
+			latest[entry.Key] = entry
+		}
+	}
+	members, _ := g.configAt(g.lastApplied)
+	snapshot := &Snapshot{
+		Index:   g.lastApplied,
+		Term:    g.termAt(g.lastApplied),
+		Members: members,
+		Entries: sortedEntries(latest),
+	}
+	if err := g.groups.storage.SaveSnapshot(g.ID, snapshot); err != nil {
+		log.E.Printf("Raft group %s: failed to save snapshot: %s\n", g.ID.String(), err)
+		return
+	}
+	g.dropLogUpTo(snapshot.Index, snapshot.Term)
+	g.snapshot = snapshot
+	g.saveLog()
+}
+
+func sortedEntries(latest map[store.Key]Entry) []Entry {
+	entries := make([]Entry, 0, len(latest))
+	for _, entry := range latest {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key.LessThan(entries[j].Key)
+	})
+	return entries
+}
+
+// Makes index the new base of the log, keeping the entries after it if the
+// log holds index with term, and dropping them otherwise.
+// The caller takes the members again, once it has replaced the snapshot.
+// Must be called with the lock held
+func (g *Group) dropLogUpTo(index int, term int) {
+	entries := []Entry{{Term: term}}
+	if index > g.base && index <= g.lastIndex() && g.termAt(index) == term {
+		entries = append(entries, g.log[index-g.base+1:]...)
+	}
+	g.log = entries
+	g.base = index
+}
+
+// Applies a saved snapshot to the store, when the member starts.
+// Entries after it are applied again once the leader says they are committed.
+func (g *Group) restoreSnapshot(snapshot *Snapshot) {
+	for _, entry := range snapshot.Entries {
+		g.groups.clock.Update(entry.Timestamp)
+		g.groups.apply(entry)
+	}
+	if snapshot.Index > g.base {
+		// Saved before the log which dropped the compacted entries
+		g.dropLogUpTo(snapshot.Index, snapshot.Term)
+	}
+	g.snapshot = snapshot
+	g.commitIndex = snapshot.Index
+	g.lastApplied = snapshot.Index
+}
+
+// Sends the next part of the snapshot to a peer which is missing
+// compacted entries
+func (g *Group) sendSnapshot(peer store.Key) {
+	g.lock.Lock()
+	if g.state != leader || g.inFlight[peer] {
+		g.lock.Unlock()
+		return
+	}
+	g.inFlight[peer] = true
+	round := g.round
+	progress := g.sending[peer]
+	if progress == nil || progress.index != g.snapshot.Index {
+		// Start over if the log was compacted again since
+		progress = &sendProgress{index: g.snapshot.Index}
+		g.sending[peer] = progress
+	}
+	entries := []Entry{}
+	size := 0
+	next := progress.next
+	for ; next < len(g.snapshot.Entries); next++ {
+		entry := g.snapshot.Entries[next]
+		size += len(entry.Val) + 100
+		if len(entries) > 0 && size > maxEntriesBytes {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	args := &InstallSnapshotArgs{
+		Term:     g.term,
+		Leader:   g.groups.self,
+		Index:    g.snapshot.Index,
+		LastTerm: g.snapshot.Term,
+		Members:  g.snapshot.Members,
+		Entries:  entries,
+		Done:     next == len(g.snapshot.Entries),
+	}
+	g.lock.Unlock()
+
+	reply := &InstallSnapshotReply{}
+	err := g.groups.call(peer, api.CmdRaftInstallSnapshot, g.ID, args, reply)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.inFlight[peer] = false
+	if err != nil || g.state != leader || g.term != args.Term {
+		return
+	}
+	if reply.Term > g.term {
+		g.becomeFollower(reply.Term)
+		g.saveState()
+		return
+	}
+	if !reply.Success {
+		return
+	}
+	g.ack(peer, round)
+	if g.sending[peer] != progress {
+		return
+	}
+	if args.Done {
+		delete(g.sending, peer)
+		if args.Index > g.matchIndex[peer] {
+			g.matchIndex[peer] = args.Index
+		}
+		g.nextIndex[peer] = g.matchIndex[peer] + 1
+		g.advanceCommit()
+	} else {
+		progress.next = next
+	}
+	// Carry on with the rest, rather than waiting for the next heartbeat
+	go g.replicate(peer)
+}
+
+/* Applies a part of the leader's snapshot. Applying entries only writes
+ * those newer than the store holds, so parts may be applied as they arrive,
+ * and again if the leader resends them.
+ * The last part replaces the log up to the snapshot's index.
+ */
+func (g *Group) HandleInstallSnapshot(args *InstallSnapshotArgs) *InstallSnapshotReply {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	reply := &InstallSnapshotReply{Term: g.term}
+	if args.Term < g.term {
+		return reply
+	}
+	changed := args.Term > g.term
+	g.becomeFollower(args.Term)
+	reply.Term = g.term
+	if changed && !g.saveState() {
+		return reply
+	}
+	leaderId := args.Leader
+	g.leader = &leaderId
+	g.lastHeard = time.Now()
+
+	if args.Index <= g.lastApplied {
+		// Already holds everything the snapshot does
+		reply.Success = true
+		return reply
+	}
+	if g.receiving == nil || g.receivingIndex != args.Index {
+		g.receiving = map[store.Key]Entry{}
+		g.receivingIndex = args.Index
+	}
+	for _, entry := range args.Entries {
+		g.groups.clock.Update(entry.Timestamp)
+		g.groups.apply(entry)
+		g.receiving[entry.Key] = entry
+	}
+	if args.Done {
+		snapshot := &Snapshot{
+			Index:   args.Index,
+			Term:    args.LastTerm,
+			Members: args.Members,
+			Entries: sortedEntries(g.receiving),
+		}
+		if err := g.groups.storage.SaveSnapshot(g.ID, snapshot); err != nil {
+			log.E.Printf("Raft group %s: failed to save snapshot: %s\n", g.ID.String(), err)
+			return reply
+		}
+		g.receiving = nil
+		g.dropLogUpTo(snapshot.Index, snapshot.Term)
+		g.snapshot = snapshot
+		g.updateMembers()
+		g.commitIndex = snapshot.Index
+		g.lastApplied = snapshot.Index
+		reply.Success = g.saveLog()
+		return reply
+	}
+	reply.Success = true
+	return reply
+}
@@ -0,0 +1,251 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/util"
+)
+
+// State is the term and vote of a member, which must survive restarts.
+// Without them, a restarted member could vote twice in one term.
+type State struct {
+	Term     int
+	VotedFor *store.Key
+}
+
+// SavedLog is a member's log as it was saved. Entries[0] is the last
+// compacted entry, at index Base.
+type SavedLog struct {
+	Base    int
+	Entries []Entry
+}
+
+// Snapshot holds the latest compacted entry of each key, sorted by key,
+// which together stand in for every entry of the log up to Index.
+// Members are the group's members as of Index.
+type Snapshot struct {
+	Index   int
+	Term    int
+	Members []store.Key
+	Entries []Entry
+}
+
+/* Storage keeps the State, log and Snapshot of each group this node is a
+ * member of. Members save their State and entries before answering any RPC
+ * which changed them.
+ * Entries are appended as they arrive, at most one after the last saved
+ * entry. A log which was never saved holds only the empty entry at index 0.
+ * Appending at an index drops the entries saved from that index on, so a
+ * conflicting suffix is replaced without rewriting the log. The whole log is
+ * only saved when it is compacted, after the Snapshot which holds the entries
+ * it no longer does.
+ * Load returns nil for those which were never saved.
+ */
+type Storage interface {
+	SaveState(groupId store.Key, state *State) error
+	Append(groupId store.Key, index int, entries []Entry) error
+	SaveLog(groupId store.Key, log *SavedLog) error
+	SaveSnapshot(groupId store.Key, snapshot *Snapshot) error
+	Load(groupId store.Key) (*State, *SavedLog, *Snapshot, error)
+}
+
+// An entry of the log file. Records are replayed in order, each replacing
+// the entries from its index on. A Base record starts the log over at Index.
+type logRecord struct {
+	Index int
+	Entry Entry
+	Base  bool
+}
+
+/* FileStorage keeps each group's State and Snapshot in files of their own, in
+ * dir. The log is kept in a file of JSON records, one per line, which is only
+ * appended to until the log is compacted.
+ */
+type FileStorage struct {
+	dir   string
+	files map[store.Key]*os.File // log files open for appending
+	lock  util.Semaphore
+}
+
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStorage{
+		dir:   dir,
+		files: map[store.Key]*os.File{},
+		lock:  util.NewSemaphore(),
+	}, nil
+}
+
+func (s *FileStorage) path(groupId store.Key, suffix string) string {
+	return filepath.Join(s.dir, groupId.String()+suffix)
+}
+
+func (s *FileStorage) SaveState(groupId store.Key, state *State) error {
+	return writeJSON(s.path(groupId, ".json"), state)
+}
+
+func (s *FileStorage) SaveSnapshot(groupId store.Key, snapshot *Snapshot) error {
+	return writeJSON(s.path(groupId, ".snapshot.json"), snapshot)
+}
+
+func (s *FileStorage) Append(groupId store.Key, index int, entries []Entry) error {
+	data, err := encodeRecords(index, entries, false)
+	if err != nil {
+		return err
+	}
+	file, err := s.logFile(groupId)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Replaces the log file with one holding only log
+func (s *FileStorage) SaveLog(groupId store.Key, log *SavedLog) error {
+	s.lock.Lock()
+	if file, ok := s.files[groupId]; ok {
+		file.Close()
+		delete(s.files, groupId)
+	}
+	s.lock.Unlock()
+	data, err := encodeRecords(log.Base, log.Entries, true)
+	if err != nil {
+		return err
+	}
+	return writeFile(s.path(groupId, ".log"), data)
+}
+
+// Returns the group's log file, opening it for appending if needed
+func (s *FileStorage) logFile(groupId store.Key) (*os.File, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if file, ok := s.files[groupId]; ok {
+		return file, nil
+	}
+	file, err := os.OpenFile(s.path(groupId, ".log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.files[groupId] = file
+	return file, nil
+}
+
+func (s *FileStorage) Load(groupId store.Key) (*State, *SavedLog, *Snapshot, error) {
+	var state *State
+	var snapshot *Snapshot
+	if ok, err := readJSON(s.path(groupId, ".json"), &state); !ok {
+		return nil, nil, nil, err
+	}
+	if ok, err := readJSON(s.path(groupId, ".snapshot.json"), &snapshot); !ok {
+		return nil, nil, nil, err
+	}
+	log, err := readLog(s.path(groupId, ".log"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return state, log, snapshot, nil
+}
+
+// Returns the records of entries, starting at index, one per line.
+// If base, the first record starts the log over.
+func encodeRecords(index int, entries []Entry, base bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	for i, entry := range entries {
+		record := &logRecord{Index: index + i, Entry: entry, Base: base && i == 0}
+		if err := encoder.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+/* Replays the records of the log file.
+ * A last record without its newline was cut short by a crash before it was
+ * synced, so was never acknowledged. It is cut from the file, so that later
+ * records are appended after the complete ones.
+ * Returns nil if there is no file.
+ */
+func readLog(path string) (*SavedLog, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	if last := lines[len(lines)-1]; len(last) > 0 {
+		if err := os.Truncate(path, int64(len(data)-len(last))); err != nil {
+			return nil, err
+		}
+	}
+	log := &SavedLog{Entries: []Entry{{}}}
+	for _, line := range lines[:len(lines)-1] {
+		record := &logRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return nil, err
+		}
+		if record.Base {
+			log = &SavedLog{Base: record.Index, Entries: []Entry{record.Entry}}
+			continue
+		}
+		if record.Index <= log.Base || record.Index > log.Base+len(log.Entries) {
+			return nil, errors.New("Log record out of order in " + path)
+		}
+		log.Entries = append(log.Entries[:record.Index-log.Base], record.Entry)
+	}
+	return log, nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// Replaces the file in one rename, so a crash leaves the old or the new
+// contents, never part of them.
+func writeFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Decodes the file into v, leaving v untouched if there is no file.
+// Returns false if the file could not be read
+func readJSON(path string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	err = json.Unmarshal(data, v)
+	return err == nil, err
+}
@@ -0,0 +1,97 @@
+package raft
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+)
+
+func TestFileStorageRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := store.Key(api.ByteArray32([]byte{0x01}))
+
+	if state, log, snapshot, err := s.Load(id); state != nil || log != nil ||
+		snapshot != nil || err != nil {
+		t.Fatal("Loaded a state which was never saved")
+	}
+	vote := store.Key(api.ByteArray32([]byte{0x02}))
+	if err := s.SaveState(id, &State{Term: 3, VotedFor: &vote}); err != nil {
+		t.Fatal(err)
+	}
+	entry := func(term int, val string) Entry {
+		return Entry{Term: term, Op: api.CmdPut, Key: id, Val: []byte(val), Timestamp: 7}
+	}
+	s.Append(id, 1, []Entry{entry(1, "a"), entry(1, "b")})
+	// Replaces the entry at 2
+	s.Append(id, 2, []Entry{entry(3, "c")})
+	if err := s.SaveSnapshot(id, &Snapshot{Index: 4, Term: 2}); err != nil {
+		t.Fatal(err)
+	}
+	state, log, snapshot, err := s.Load(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot == nil || snapshot.Index != 4 || snapshot.Term != 2 {
+		t.Fatal("Loaded snapshot differs from the saved one")
+	}
+	if state.Term != 3 || *state.VotedFor != vote {
+		t.Fatal("Loaded state differs from the saved one")
+	}
+	if log.Base != 0 || len(log.Entries) != 3 || string(log.Entries[1].Val) != "a" ||
+		string(log.Entries[2].Val) != "c" || log.Entries[2].Timestamp != 7 {
+		t.Fatal("Loaded log differs from the appended one")
+	}
+
+	// Compacting replaces the log, which is appended to again after
+	if err := s.SaveLog(id, &SavedLog{Base: 2, Entries: []Entry{{Term: 3}}}); err != nil {
+		t.Fatal(err)
+	}
+	s.Append(id, 3, []Entry{entry(3, "d")})
+	if _, log, _, _ = s.Load(id); log.Base != 2 || len(log.Entries) != 2 ||
+		string(log.Entries[1].Val) != "d" {
+		t.Fatal("Loaded log differs from the compacted one")
+	}
+}
+
+func TestFileStorageIgnoresTornAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := store.Key(api.ByteArray32([]byte{0x01}))
+	s.Append(id, 1, []Entry{{Term: 1, Val: []byte("a")}})
+
+	// A crash part way through writing a record
+	file, err := os.OpenFile(s.path(id, ".log"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(`{"Index":2,"En`))
+	file.Close()
+
+	s, _ = NewFileStorage(dir)
+	if _, log, _, err := s.Load(id); err != nil || len(log.Entries) != 2 {
+		t.Fatal("Log with a torn record did not load")
+	}
+	s.Append(id, 2, []Entry{{Term: 1, Val: []byte("b")}})
+	if _, log, _, err := s.Load(id); err != nil || len(log.Entries) != 3 ||
+		string(log.Entries[2].Val) != "b" {
+		t.Fatal("Record appended after a torn one was lost")
+	}
+}
@@ -0,0 +1,225 @@
+package seeds
+
+import (
+	"bufio"
+	"github.com/tsiemens/kvstore/server/config"
+	"github.com/tsiemens/kvstore/shared/log"
+	"github.com/tsiemens/kvstore/shared/util"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Seeds are the well known nodes a node contacts to join the cluster.
+// They come from a set of providers, and are re-resolved periodically,
+// so that the seeds can change without restarting or reconfiguring nodes.
+
+// A source of seed addresses, as host:port strings
+type Provider interface {
+	Name() string
+	Seeds() ([]string, error)
+}
+
+// The hosts listed in the config
+type StaticProvider struct {
+	Hosts []string
+}
+
+func (p *StaticProvider) Name() string { return "static list" }
+
+func (p *StaticProvider) Seeds() ([]string, error) {
+	return p.Hosts, nil
+}
+
+/* Looks up seeds in DNS. Names starting with an underscore are SRV records
+ * (eg. _kvstore._udp.example.com), which carry their own ports. Other names
+ * are A records, with an optional port, otherwise DefaultPort is used.
+ */
+type DNSProvider struct {
+	Record      string
+	DefaultPort int
+}
+
+func (p *DNSProvider) Name() string { return "DNS " + p.Record }
+
+func (p *DNSProvider) Seeds() ([]string, error) {
+	if strings.HasPrefix(p.Record, "_") {
+		_, records, err := net.LookupSRV("", "", p.Record)
+		if err != nil {
+			return nil, err
+		}
+		seeds := make([]string, 0, len(records))
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			seeds = append(seeds, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+		return seeds, nil
+	}
+
+	host, port, err := net.SplitHostPort(p.Record)
+	if err != nil {
+		host, port = p.Record, strconv.Itoa(p.DefaultPort)
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	seeds := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		seeds = append(seeds, net.JoinHostPort(ip, port))
+	}
+	return seeds, nil
+}
+
+/* Reads seeds from a file, or from every file in a directory, one host:port
+ * per line. Blank lines and lines starting with # are ignored.
+ * The files are read again on each refresh, so seeds can be added by
+ * dropping a file into the directory.
+ */
+type FileProvider struct {
+	Path string
+}
+
+func (p *FileProvider) Name() string { return "file " + p.Path }
+
+func (p *FileProvider) Seeds() ([]string, error) {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{p.Path}
+	if info.IsDir() {
+		files, err := ioutil.ReadDir(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		paths = make([]string, 0, len(files))
+		for _, file := range files {
+			if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+				paths = append(paths, filepath.Join(p.Path, file.Name()))
+			}
+		}
+	}
+	seeds := []string{}
+	for _, path := range paths {
+		fileSeeds, err := readSeedFile(path)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, fileSeeds...)
+	}
+	return seeds, nil
+}
+
+func readSeedFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	seeds := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			seeds = append(seeds, line)
+		}
+	}
+	return seeds, scanner.Err()
+}
+
+type Seeds struct {
+	providers []Provider
+	last      map[Provider][]string // Last successful result of each provider
+	addrs     []*net.UDPAddr
+	lock      util.Semaphore
+}
+
+var seeds *Seeds
+
+// Sets up the providers configured, and resolves the seeds once
+func Init() {
+	seeds = New(ProvidersFromConfig(config.GetConfig()))
+	seeds.Refresh()
+}
+
+func GetSeeds() *Seeds {
+	return seeds
+}
+
+func New(providers []Provider) *Seeds {
+	return &Seeds{
+		providers: providers,
+		last:      map[Provider][]string{},
+		addrs:     []*net.UDPAddr{},
+		lock:      util.NewSemaphore(),
+	}
+}
+
+func ProvidersFromConfig(conf *config.Config) []Provider {
+	if conf.UseLoopback {
+		return []Provider{&StaticProvider{
+			[]string{"localhost:" + strconv.Itoa(conf.DefaultLocalhostPort)}}}
+	}
+	providers := []Provider{&StaticProvider{conf.PeerList}}
+	for _, name := range conf.SeedDNS {
+		providers = append(providers,
+			&DNSProvider{Record: name, DefaultPort: conf.DefaultLocalhostPort})
+	}
+	if conf.SeedPath != "" {
+		providers = append(providers, &FileProvider{conf.SeedPath})
+	}
+	return providers
+}
+
+/* Asks every provider for its seeds, and resolves them.
+ * A provider which fails keeps its last seeds, so that a DNS outage does not
+ * leave the node without any.
+ */
+func (s *Seeds) Refresh() {
+	hosts := []string{}
+	for _, provider := range s.providers {
+		providerSeeds, err := provider.Seeds()
+		s.lock.Lock()
+		if err != nil {
+			log.E.Printf("Failed to get seeds from %s: %s\n", provider.Name(), err)
+			providerSeeds = s.last[provider]
+		} else {
+			s.last[provider] = providerSeeds
+		}
+		s.lock.Unlock()
+		hosts = append(hosts, providerSeeds...)
+	}
+
+	addrs := make([]*net.UDPAddr, 0, len(hosts))
+	for _, host := range hosts {
+		addr, err := net.ResolveUDPAddr("udp", host)
+		if err != nil {
+			log.E.Printf("Failed to resolve seed %s: %s\n", host, err)
+		} else if !containsAddr(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.addrs = addrs
+}
+
+// Returns the resolved seeds
+func (s *Seeds) Addrs() []*net.UDPAddr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.addrs
+}
+
+func containsAddr(addrs []*net.UDPAddr, addr *net.UDPAddr) bool {
+	for _, a := range addrs {
+		if util.AddrsEqual(a, addr) {
+			return true
+		}
+	}
+	return false
+}
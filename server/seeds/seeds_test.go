@@ -0,0 +1,45 @@
+package seeds
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tsiemens/kvstore/shared/log"
+)
+
+func init() {
+	log.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard)
+}
+
+func TestFileProviderReadsDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("# rack a\n10.0.0.1:5555\n\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b"), []byte("10.0.0.2:5555\n"), 0644)
+
+	provider := &FileProvider{dir}
+	found, err := provider.Seeds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0] != "10.0.0.1:5555" || found[1] != "10.0.0.2:5555" {
+		t.Fatal("Unexpected seeds", found)
+	}
+
+	// Seeds are read again on refresh, and kept if the provider fails
+	s := New([]Provider{provider})
+	s.Refresh()
+	if len(s.Addrs()) != 2 {
+		t.Fatal("Expected 2 seeds, got", len(s.Addrs()))
+	}
+	os.RemoveAll(dir)
+	s.Refresh()
+	if len(s.Addrs()) != 2 {
+		t.Fatal("Lost seeds when the provider failed")
+	}
+}
@@ -9,7 +9,7 @@ import (
 type StoreVal struct {
 	Val       []byte
 	Active    bool
-	Timestamp int // a logical timestamp
+	Timestamp int64 // a hybrid logical timestamp
 }
 
 // representation of the consistent hashing store
@@ -35,31 +35,73 @@ func (s *Store) Get(key Key) (*StoreVal, error) {
 	return v, nil
 }
 
-func (s *Store) Put(key Key, value []byte, timestamp int) error {
-	v := &StoreVal{Val: value, Active: true, Timestamp: timestamp}
-	s.PutDirect(key, v)
+// Stores the value, unless a newer version of the key is already stored.
+// Stale writes are ignored (last writer wins), and are not an error.
+func (s *Store) Put(key Key, value []byte, timestamp int64) error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if v, ok := s.m[key]; ok && v.Timestamp > timestamp {
+		return nil
+	}
+	s.m[key] = &StoreVal{Val: value, Active: true, Timestamp: timestamp}
 	return nil
 }
 
-func (s *Store) PutDirect(key Key, value *StoreVal) {
+// Stores the value if it is newer than the stored version of the key.
+// Returns whether it was stored.
+func (s *Store) Merge(key Key, value *StoreVal) bool {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
+	if v, ok := s.m[key]; ok && v.Timestamp >= value.Timestamp {
+		return false
+	}
 	s.m[key] = value
+	return true
 }
 
-func (s *Store) Remove(key Key, timestamp int) error {
+// Marks the key as removed.
+// Returns an error if there is no active value for the key.
+func (s *Store) Remove(key Key, timestamp int64) error {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
-	if v, ok := s.m[key]; ok {
-		v.Val = make([]byte, 0)
-		v.Active = false
-		v.Timestamp = timestamp
+	if v, ok := s.m[key]; ok && v.Active {
+		if v.Timestamp <= timestamp {
+			v.Val = make([]byte, 0)
+			v.Active = false
+			v.Timestamp = timestamp
+		}
 		return nil
 	} else {
 		return errors.New("No value for " + key.String())
 	}
 }
 
+// Marks the key as removed, unless a newer version of it is stored.
+// Unlike Remove, a tombstone is stored even if the key is not, so that the
+// removal can be passed on to other nodes.
+func (s *Store) Tombstone(key Key, timestamp int64) {
+	s.Merge(key, &StoreVal{Val: make([]byte, 0), Active: false, Timestamp: timestamp})
+}
+
+// Deletes the key entirely, rather than marking it removed
+func (s *Store) Delete(key Key) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	delete(s.m, key)
+}
+
+// Deletes the key entirely if its stored version is timestamp.
+// Returns whether it was deleted.
+func (s *Store) DeleteIfVersion(key Key, timestamp int64) bool {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if v, ok := s.m[key]; ok && v.Timestamp == timestamp {
+		delete(s.m, key)
+		return true
+	}
+	return false
+}
+
 func (s *Store) GetKeys() []Key {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
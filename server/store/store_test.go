@@ -0,0 +1,52 @@
+package store
+
+import "testing"
+
+func TestMergeKeepsNewestVersion(t *testing.T) {
+	s := New()
+	key := Key{0x42}
+	if !s.Merge(key, &StoreVal{Val: []byte{1}, Active: true, Timestamp: 5}) {
+		t.Fatal("Did not store a new key")
+	}
+	if s.Merge(key, &StoreVal{Val: []byte{2}, Active: true, Timestamp: 3}) {
+		t.Fatal("Overwrote a newer version")
+	}
+	if s.Merge(key, &StoreVal{Val: []byte{3}, Active: true, Timestamp: 5}) {
+		t.Fatal("Overwrote the same version")
+	}
+	if !s.Merge(key, &StoreVal{Active: false, Timestamp: 6}) {
+		t.Fatal("Did not store a newer removal")
+	}
+	if v, _ := s.Get(key); v.Active || v.Timestamp != 6 {
+		t.Fatal("Expected the removal to be stored")
+	}
+}
+
+func TestTombstoneWithoutValue(t *testing.T) {
+	s := New()
+	key := Key{0x42}
+	s.Tombstone(key, 4)
+	if v, err := s.Get(key); err != nil || v.Active || v.Timestamp != 4 {
+		t.Fatal("Tombstone not stored for a missing key")
+	}
+	s.Put(key, []byte{1}, 6)
+	s.Tombstone(key, 5)
+	if v, _ := s.Get(key); !v.Active {
+		t.Fatal("Tombstone overwrote a newer value")
+	}
+}
+
+func TestDeleteIfVersion(t *testing.T) {
+	s := New()
+	key := Key{0x42}
+	s.Put(key, []byte{1}, 3)
+	if s.DeleteIfVersion(key, 2) {
+		t.Fatal("Deleted a different version")
+	}
+	if !s.DeleteIfVersion(key, 3) {
+		t.Fatal("Did not delete the version")
+	}
+	if _, err := s.Get(key); err == nil {
+		t.Fatal("Key still stored")
+	}
+}
@@ -0,0 +1,29 @@
+package txn
+
+import (
+	"github.com/tsiemens/kvstore/server/store"
+)
+
+type PrepareReply struct {
+	Vote bool
+	// The participant's values for the record's keys, to evaluate checks with.
+	// Keyed by api.KeyHex of the key.
+	Values map[string]*store.StoreVal
+}
+
+type DecisionArgs struct {
+	ID        ID
+	Commit    bool
+	Timestamp int64
+}
+
+type StatusArgs struct {
+	ID            ID
+	AsCoordinator bool      // Whether to ask for the decision, or the participant state
+	From          store.Key // The participant asking. It applies a decision it is told
+}
+
+type StatusReply struct {
+	State     State
+	Timestamp int64
+}
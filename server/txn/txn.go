@@ -0,0 +1,437 @@
+package txn
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+	"github.com/tsiemens/kvstore/shared/log"
+	"github.com/tsiemens/kvstore/shared/util"
+)
+
+// This package tracks multi-key transactions, committed with two-phase commit.
+// A node may be the coordinator of a transaction, a participant (a replica
+// of one of its keys), or both.
+
+type ID [16]byte
+
+type State int
+
+const (
+	Unknown  State = iota
+	Pending        // The coordinator has not decided yet
+	Prepared       // The participant voted to commit, and awaits the decision
+	Committed
+	Aborted
+)
+
+type Op struct {
+	Op    byte // One of the api.TxOp codes
+	Key   store.Key
+	Value []byte
+}
+
+// Record is a participant's view of a transaction.
+type Record struct {
+	ID           ID
+	Coordinator  store.Key
+	Participants []store.Key
+	Ops          []Op  // Only the ops on keys this participant replicates
+	Timestamp    int64 // The version committed values are written with. Set on commit
+	State        State
+	Since        time.Time // When State last changed
+	presumed     bool      // Aborted only because it was unknown here
+}
+
+type decision struct {
+	State     State
+	Timestamp int64
+	Since     time.Time
+	unacked   map[store.Key]bool // Participants which have not acknowledged the decision
+}
+
+// A decision as it is saved
+type savedDecision struct {
+	ID        ID
+	State     State
+	Timestamp int64
+	Since     time.Time
+	Unacked   []store.Key
+}
+
+// A decision which some participants have not acknowledged yet
+type PendingDecision struct {
+	Args         DecisionArgs
+	Participants []store.Key
+}
+
+// Manager holds the transactions this node takes part in, and the locks
+// they hold on keys. Transactions never wait for locks. A prepare which
+// conflicts with another transaction's lock fails, and the transaction aborts.
+// Plain writes wait a little for a lock to be released, then fail.
+// Participant state is in memory, like the store itself. Coordinator
+// decisions are also saved to a file, once Restore has been called.
+type Manager struct {
+	records   map[ID]*Record
+	decisions map[ID]*decision
+	locks     map[store.Key]ID
+	released  chan bool // Closed and replaced whenever locks are released
+	path      string    // File the decisions are saved to. Empty if not saved
+	lock      util.Semaphore
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		records:   map[ID]*Record{},
+		decisions: map[ID]*decision{},
+		locks:     map[store.Key]ID{},
+		released:  make(chan bool),
+		lock:      util.NewSemaphore(),
+	}
+}
+
+// Participant
+
+/* Locks the record's keys, and marks it prepared.
+ * Returns an error if the transaction already aborted here, or if a key is
+ * locked by another transaction.
+ */
+func (m *Manager) Prepare(rec *Record) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if existing, ok := m.records[rec.ID]; ok {
+		if existing.State == Prepared {
+			return nil
+		}
+		return errors.New("Transaction already finished")
+	}
+	for _, op := range rec.Ops {
+		if owner, ok := m.locks[op.Key]; ok && owner != rec.ID {
+			return errors.New("Key locked by another transaction")
+		}
+	}
+	for _, op := range rec.Ops {
+		m.locks[op.Key] = rec.ID
+	}
+	rec.State = Prepared
+	rec.Since = time.Now()
+	m.records[rec.ID] = rec
+	return nil
+}
+
+/* Records the outcome of a prepared transaction, and releases its locks.
+ * Returns the record if it was committed by this call, so that the caller
+ * applies its ops exactly once. Otherwise returns nil.
+ */
+func (m *Manager) Finish(id ID, commit bool, timestamp int64) *Record {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rec, ok := m.records[id]
+	if !ok {
+		// Never prepared here. Make sure a late prepare can't succeed
+		m.records[id] = &Record{ID: id, State: Aborted, Since: time.Now()}
+		return nil
+	}
+	if rec.State != Prepared {
+		return nil
+	}
+	for _, op := range rec.Ops {
+		if m.locks[op.Key] == id {
+			delete(m.locks, op.Key)
+		}
+	}
+	close(m.released)
+	m.released = make(chan bool)
+	rec.Since = time.Now()
+	if commit {
+		rec.State = Committed
+		rec.Timestamp = timestamp
+		return rec
+	}
+	rec.State = Aborted
+	return nil
+}
+
+/* Returns this participant's state for the transaction, and the commit
+ * timestamp if committed.
+ * If unknown, the transaction is presumed aborted from now on, which
+ * prevents it from ever being prepared here. It is still reported as
+ * unknown, since this participant may have committed it and forgotten.
+ */
+func (m *Manager) ParticipantState(id ID) (State, int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if rec, ok := m.records[id]; ok {
+		if rec.presumed {
+			return Unknown, 0
+		}
+		return rec.State, rec.Timestamp
+	}
+	m.records[id] = &Record{ID: id, State: Aborted, Since: time.Now(), presumed: true}
+	return Unknown, 0
+}
+
+/* Runs write, a plain put or remove of key, unless a prepared transaction
+ * holds a lock on key. Waits up to timeout for the lock to be released.
+ * The lock table is held while write runs, so no transaction can prepare
+ * the key, and read its value, part way through.
+ * Returns false if the key stayed locked, and write was not run.
+ */
+func (m *Manager) WriteUnlocked(key store.Key, timeout time.Duration, write func()) bool {
+	deadline := time.After(timeout)
+	for {
+		m.lock.Lock()
+		if _, locked := m.locks[key]; !locked {
+			write()
+			m.lock.Unlock()
+			return true
+		}
+		released := m.released
+		m.lock.Unlock()
+		select {
+		case <-released:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// Returns copies of the records prepared longer ago than timeout
+func (m *Manager) InDoubt(timeout time.Duration) []Record {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	recs := []Record{}
+	for _, rec := range m.records {
+		if rec.State == Prepared && time.Since(rec.Since) > timeout {
+			recs = append(recs, *rec)
+		}
+	}
+	return recs
+}
+
+// Coordinator
+
+/* Loads the decisions saved at path, and saves them there from now on.
+ * Transactions which were still pending when they were saved are aborted:
+ * their coordinator restarted before deciding, so never told anyone to
+ * commit them. They are sent to the participants like any other decision.
+ */
+func (m *Manager) Restore(path string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	m.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	saved := []savedDecision{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for _, s := range saved {
+		d := &decision{State: s.State, Timestamp: s.Timestamp, Since: s.Since,
+			unacked: map[store.Key]bool{}}
+		if d.State == Pending {
+			d.State = Aborted
+			d.Since = time.Now()
+		}
+		for _, participant := range s.Unacked {
+			d.unacked[participant] = true
+		}
+		m.decisions[s.ID] = d
+	}
+	return m.save()
+}
+
+// Saves the decisions, if Restore has been called. Called with the lock held
+func (m *Manager) save() error {
+	if m.path == "" {
+		return nil
+	}
+	saved := make([]savedDecision, 0, len(m.decisions))
+	for id, d := range m.decisions {
+		s := savedDecision{ID: id, State: d.State, Timestamp: d.Timestamp, Since: d.Since}
+		for participant := range d.unacked {
+			s.Unacked = append(s.Unacked, participant)
+		}
+		saved = append(saved, s)
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	// Replaced in one rename, so a crash leaves the old or the new decisions
+	tmpPath := m.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, m.path)
+}
+
+/* Records a transaction to be decided, before any participant prepares it.
+ * Returns an error if it could not be saved, in which case it must not be
+ * started.
+ */
+func (m *Manager) Begin(id ID, participants []store.Key) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	unacked := map[store.Key]bool{}
+	for _, participant := range participants {
+		unacked[participant] = true
+	}
+	m.decisions[id] = &decision{State: Pending, Since: time.Now(), unacked: unacked}
+	if err := m.save(); err != nil {
+		delete(m.decisions, id)
+		return err
+	}
+	return nil
+}
+
+/* Records the coordinator's decision, and returns it.
+ * The decision is abort if the transaction was already presumed aborted,
+ * or if a commit could not be saved. An abort which could not be saved
+ * stands, since a pending transaction is aborted when it is restored.
+ */
+func (m *Manager) Decide(id ID, commit bool, timestamp int64) State {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d, ok := m.decisions[id]
+	if !ok || d.State != Pending {
+		return Aborted
+	}
+	if commit {
+		d.State = Committed
+		d.Timestamp = timestamp
+	} else {
+		d.State = Aborted
+	}
+	d.Since = time.Now()
+	if err := m.save(); err != nil {
+		log.E.Printf("Failed to save decision for transaction %x: %v\n", id, err)
+		d.State = Aborted
+		d.Timestamp = 0
+	}
+	return d.State
+}
+
+// Records that participant has applied the decision, so it need not be kept
+// for it any longer
+func (m *Manager) Acknowledge(id ID, participant store.Key) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if d, ok := m.decisions[id]; ok && d.State != Pending {
+		delete(d.unacked, participant)
+	}
+}
+
+/* Returns the coordinator's decision for the transaction, and the commit
+ * timestamp if committed. Decisions are kept until every participant has
+ * acknowledged them, and survive restarts once Restore has been called, so
+ * it is only unknown if they were not saved. That does not make it aborted:
+ * the coordinator may have decided to commit it before restarting, and told
+ * some participants.
+ */
+func (m *Manager) CoordinatorState(id ID) (State, int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if d, ok := m.decisions[id]; ok {
+		return d.State, d.Timestamp
+	}
+	return Unknown, 0
+}
+
+// Returns the decisions made longer ago than age, which some participants
+// have not acknowledged, to send to them again
+func (m *Manager) Unacknowledged(age time.Duration) []PendingDecision {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	pending := []PendingDecision{}
+	for id, d := range m.decisions {
+		if d.State == Pending || len(d.unacked) == 0 || time.Since(d.Since) <= age {
+			continue
+		}
+		p := PendingDecision{Args: DecisionArgs{ID: id, Commit: d.State == Committed,
+			Timestamp: d.Timestamp}}
+		for participant := range d.unacked {
+			p.Participants = append(p.Participants, participant)
+		}
+		pending = append(pending, p)
+	}
+	return pending
+}
+
+// Forgets finished transactions older than retention. Decisions are kept
+// until all participants have acknowledged them, however old.
+func (m *Manager) Clean(retention time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, rec := range m.records {
+		if rec.State != Prepared && time.Since(rec.Since) > retention {
+			delete(m.records, id)
+		}
+	}
+	cleaned := false
+	for id, d := range m.decisions {
+		if d.State != Pending && len(d.unacked) == 0 && time.Since(d.Since) > retention {
+			delete(m.decisions, id)
+			cleaned = true
+		}
+	}
+	if cleaned {
+		// Left in the file if this fails, they are only acknowledged again
+		if err := m.save(); err != nil {
+			log.E.Println(err)
+		}
+	}
+}
+
+// Writes a committed record's puts and removes to s
+func Apply(s *store.Store, rec *Record) {
+	for _, op := range rec.Ops {
+		switch op.Op {
+		case api.TxOpPut:
+			s.Put(op.Key, op.Value, rec.Timestamp)
+		case api.TxOpRemove:
+			s.Remove(op.Key, rec.Timestamp)
+		}
+	}
+}
+
+/* Returns whether the check op holds for the value.
+ * val is the most up to date value of the key, and nil if it is absent.
+ * Non-check ops always hold.
+ */
+func CheckHolds(op Op, val *store.StoreVal) bool {
+	exists := val != nil && val.Active
+	switch op.Op {
+	case api.TxOpCheckEquals:
+		return exists && string(val.Val) == string(op.Value)
+	case api.TxOpCheckExists:
+		return exists
+	case api.TxOpCheckAbsent:
+		return !exists
+	default:
+		return true
+	}
+}
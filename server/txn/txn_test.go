@@ -0,0 +1,146 @@
+package txn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tsiemens/kvstore/server/store"
+	"github.com/tsiemens/kvstore/shared/api"
+)
+
+func newRecord(id byte, key store.Key) *Record {
+	return &Record{
+		ID:  ID{id},
+		Ops: []Op{{Op: api.TxOpPut, Key: key, Value: []byte{id}}},
+	}
+}
+
+func TestConflictingPrepareFails(t *testing.T) {
+	m := NewManager()
+	key := store.Key{0x42}
+
+	if err := m.Prepare(newRecord(1, key)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Prepare(newRecord(2, key)); err == nil {
+		t.Fatal("Prepared a transaction on a locked key")
+	}
+
+	if rec := m.Finish(ID{1}, true, 10); rec == nil || rec.Timestamp != 10 {
+		t.Fatal("Commit did not return the record")
+	}
+	if err := m.Prepare(newRecord(3, key)); err != nil {
+		t.Fatal("Key still locked after commit")
+	}
+}
+
+func TestUnknownTransactionPresumedAborted(t *testing.T) {
+	m := NewManager()
+	if state, _ := m.ParticipantState(ID{1}); state != Unknown {
+		t.Fatal("Expected unknown state")
+	}
+	if err := m.Prepare(newRecord(1, store.Key{0x42})); err == nil {
+		t.Fatal("Prepared a transaction presumed aborted")
+	}
+	if state, _ := m.ParticipantState(ID{1}); state != Unknown {
+		t.Fatal("Presumed abort reported as an explicit one")
+	}
+
+	m.Begin(ID{2}, nil)
+	if state, _ := m.CoordinatorState(ID{3}); state != Unknown {
+		t.Fatal("Expected unknown decision")
+	}
+	if m.Decide(ID{3}, true, 1) != Aborted {
+		t.Fatal("Committed a transaction presumed aborted")
+	}
+	if m.Decide(ID{2}, true, 1) != Committed {
+		t.Fatal("Failed to commit a pending transaction")
+	}
+}
+
+func TestWriteWaitsForLock(t *testing.T) {
+	m := NewManager()
+	key := store.Key{0x42}
+	if err := m.Prepare(newRecord(1, key)); err != nil {
+		t.Fatal(err)
+	}
+	if m.WriteUnlocked(key, time.Millisecond*10, func() {}) {
+		t.Fatal("Wrote a key locked by a prepared transaction")
+	}
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- m.WriteUnlocked(key, time.Second*5, func() {})
+	}()
+	m.Finish(ID{1}, false, 0)
+	if !<-done {
+		t.Fatal("Write did not run once the lock was released")
+	}
+}
+
+func TestDecisionKeptUntilAcknowledged(t *testing.T) {
+	m := NewManager()
+	a, b := store.Key{0x01}, store.Key{0x02}
+	m.Begin(ID{1}, []store.Key{a, b})
+	m.Decide(ID{1}, true, 5)
+
+	m.Acknowledge(ID{1}, a)
+	m.Clean(0)
+	if state, ts := m.CoordinatorState(ID{1}); state != Committed || ts != 5 {
+		t.Fatal("Decision forgotten before all participants acknowledged it")
+	}
+	pending := m.Unacknowledged(0)
+	if len(pending) != 1 || len(pending[0].Participants) != 1 ||
+		pending[0].Participants[0] != b || !pending[0].Args.Commit {
+		t.Fatal("Expected the decision to be resent to the other participant")
+	}
+
+	m.Acknowledge(ID{1}, b)
+	m.Clean(0)
+	if state, _ := m.CoordinatorState(ID{1}); state != Unknown {
+		t.Fatal("Acknowledged decision never forgotten")
+	}
+}
+
+func TestDecisionsRestored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "decisions.json")
+	a := store.Key{0x01}
+
+	m := NewManager()
+	if err := m.Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Begin(ID{1}, []store.Key{a}); err != nil {
+		t.Fatal(err)
+	}
+	m.Decide(ID{1}, true, 5)
+	if err := m.Begin(ID{2}, []store.Key{a}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The coordinator restarts before deciding the second transaction
+	m = NewManager()
+	if err := m.Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	if state, ts := m.CoordinatorState(ID{1}); state != Committed || ts != 5 {
+		t.Fatal("Commit decision lost on restart")
+	}
+	if state, _ := m.CoordinatorState(ID{2}); state != Aborted {
+		t.Fatal("Undecided transaction not aborted on restart")
+	}
+	if m.Decide(ID{2}, true, 6) != Aborted {
+		t.Fatal("Committed a transaction aborted on restart")
+	}
+	if len(m.Unacknowledged(-1)) != 2 {
+		t.Fatal("Expected both decisions to be sent again")
+	}
+}
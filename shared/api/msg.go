@@ -16,6 +16,11 @@ const CmdPut = 0x01
 const CmdGet = 0x02
 const CmdRemove = 0x03
 const CmdShutdown = 0x04
+const CmdTransaction = 0x06
+const CmdSessionGet = 0x07
+const CmdSessionPut = 0x08
+const CmdSessionRemove = 0x09
+const CmdDecommission = 0x0a
 const CmdIntraPut = 0x22
 const CmdIntraGet = 0x23
 const CmdIntraRemove = 0x24
@@ -28,6 +33,19 @@ const CmdMembershipQuery = 0x30
 const CmdMembershipFailure = 0x31
 const CmdMembershipFailureGossip = 0x32
 const CmdStorePush = 0x33
+const CmdIntraHintedWrite = 0x34
+const CmdRaftRequestVote = 0x35
+const CmdRaftAppendEntries = 0x36
+const CmdRaftPropose = 0x37
+const CmdIntraTxPrepare = 0x38
+const CmdIntraTxDecision = 0x39
+const CmdIntraTxStatus = 0x3a
+const CmdPing = 0x3b
+const CmdPingReq = 0x3c
+const CmdSwimUpdate = 0x3d
+const CmdJoinSync = 0x3e
+const CmdJoinSyncDone = 0x3f
+const CmdRaftInstallSnapshot = 0x40
 
 // Response codes that can be sent back to the client
 const RespOk = 0x00
@@ -44,6 +62,8 @@ const RespInvalidNode = 0x10
 const RespTimeout = 0x11
 const RespOkTimestamp = 0x12
 const RespInternalError = 0x13
+const RespTxAborted = 0x14
+const RespStale = 0x15
 
 type BaseDgram struct {
 	uid     [16]byte
@@ -183,9 +203,9 @@ func ParseMessage(dgram []byte,
 
 	if parser, ok := parserMap[command]; ok {
 		msg, err := parser(ByteArray16(uid), command, dgram[17:])
-		log.D.Println("Parsing command %x", command)
+		log.D.Printf("Parsing command %x\n", command)
 		if err != nil {
-			log.E.Println("Error parsing command %x", command)
+			log.E.Printf("Error parsing command %x\n", command)
 			return nil, err,
 				NewBaseDgram(ByteArray16(uid), RespMalformedDatagram)
 		} else {
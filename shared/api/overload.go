@@ -0,0 +1,32 @@
+package api
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Overload replies may carry how long the client should wait before
+// retrying, in milliseconds. Replies without it have no payload.
+const retryAfterLen = 4
+
+func NewOverloadDgram(msgUID [16]byte, retryAfter time.Duration) Message {
+	data := make([]byte, retryAfterLen)
+	binary.BigEndian.PutUint32(data, uint32(retryAfter/time.Millisecond))
+	return NewValueDgram(msgUID, RespSysOverload, data)
+}
+
+func ParseOverloadDgram(uid [16]byte, cmd byte, payload []byte) (Message, error) {
+	if len(payload) == 0 {
+		return NewBaseDgram(uid, cmd), nil
+	}
+	return ParseValueDgram(uid, cmd, payload)
+}
+
+// Returns the retry after hint of an overload reply, or 0 if it has none
+func RetryAfter(msg Message) time.Duration {
+	vMsg, ok := msg.(*ValueDgram)
+	if !ok || len(vMsg.Value) < retryAfterLen {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(vMsg.Value)) * time.Millisecond
+}
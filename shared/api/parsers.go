@@ -4,11 +4,16 @@ var CmdMessageParsers = map[byte]MessagePayloadParser{
 	CmdPut:                     ParseKeyValueDgram,
 	CmdGet:                     ParseKeyDgram,
 	CmdRemove:                  ParseKeyDgram,
+	CmdTransaction:             ParseValueDgram,
+	CmdSessionGet:              ParseKeyValueDgram,
+	CmdSessionPut:              ParseKeyValueDgram,
+	CmdSessionRemove:           ParseKeyValueDgram,
 	CmdIntraPut:                ParseKeyValueDgram,
 	CmdIntraGet:                ParseKeyDgram,
 	CmdIntraRemove:             ParseKeyValueDgram,
 	CmdGetTimestamp:            ParseKeyDgram,
 	CmdShutdown:                ParseKeyDgram,
+	CmdDecommission:            ParseKeyDgram,
 	CmdStatusUpdate:            ParseKeyValueDgram,
 	CmdAdhocUpdate:             ParseKeyValueDgram,
 	CmdMembership:              ParseKeyValueDgram,
@@ -17,13 +22,26 @@ var CmdMessageParsers = map[byte]MessagePayloadParser{
 	CmdMembershipFailure:       ParseKeyValueDgram,
 	CmdMembershipFailureGossip: ParseKeyValueDgram,
 	CmdStorePush:               ParseValueDgram,
+	CmdIntraHintedWrite:        ParseKeyValueDgram,
+	CmdRaftRequestVote:         ParseKeyValueDgram,
+	CmdRaftAppendEntries:       ParseKeyValueDgram,
+	CmdRaftPropose:             ParseKeyValueDgram,
+	CmdRaftInstallSnapshot:     ParseKeyValueDgram,
+	CmdIntraTxPrepare:          ParseValueDgram,
+	CmdIntraTxDecision:         ParseValueDgram,
+	CmdIntraTxStatus:           ParseValueDgram,
+	CmdPing:                    ParseKeyValueDgram,
+	CmdPingReq:                 ParseKeyValueDgram,
+	CmdSwimUpdate:              ParseKeyValueDgram,
+	CmdJoinSync:                ParseKeyValueDgram,
+	CmdJoinSyncDone:            ParseKeyDgram,
 }
 
 var RespMessageParsers = map[byte]MessagePayloadParser{
 	RespOk:                  ParseValueDgram,
-	RespInvalidKey:          ParseBaseDgram,
+	RespInvalidKey:          ParseInvalidKeyDgram,
 	RespOutOfSpace:          ParseBaseDgram,
-	RespSysOverload:         ParseBaseDgram,
+	RespSysOverload:         ParseOverloadDgram,
 	RespInternalError:       ParseBaseDgram,
 	RespClientInternalError: ParseBaseDgram,
 	RespUnknownCommand:      ParseBaseDgram,
@@ -33,4 +51,6 @@ var RespMessageParsers = map[byte]MessagePayloadParser{
 	RespInvalidNode:         ParseKeyValueDgram,
 	RespTimeout:             ParseBaseDgram,
 	RespOkTimestamp:         ParseValueDgram,
+	RespTxAborted:           ParseBaseDgram,
+	RespStale:               ParseBaseDgram,
 }
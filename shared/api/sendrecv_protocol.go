@@ -2,6 +2,7 @@ package api
 
 import (
 	"errors"
+	"fmt"
 	"github.com/tsiemens/kvstore/shared/log"
 	"github.com/tsiemens/kvstore/shared/util"
 	"net"
@@ -24,6 +25,9 @@ func ResponseError(msg Message) error {
 	case RespOutOfSpace:
 		return errors.New("Response out of space")
 	case RespSysOverload:
+		if retryAfter := RetryAfter(msg); retryAfter > 0 {
+			return fmt.Errorf("System overload. Retry after %v", retryAfter)
+		}
 		return errors.New("System overload")
 	case RespInternalError:
 		return errors.New("Internal KVStore failure")
@@ -31,6 +35,10 @@ func ResponseError(msg Message) error {
 		return errors.New("Internal KVStore failure")
 	case RespUnknownCommand:
 		return errors.New("Unrecognized command")
+	case RespTxAborted:
+		return errors.New("Transaction aborted")
+	case RespStale:
+		return errors.New("No replica is as up to date as the session")
 	default:
 		return nil
 	}
@@ -63,7 +71,15 @@ func SendRecv(url string, buildMsg MessageBuilder) (Message, error) {
 	timeout := initialTimeout
 	if msgToSend.Command() == CmdIntraGet ||
 		msgToSend.Command() == CmdIntraPut ||
-		msgToSend.Command() == CmdIntraRemove {
+		msgToSend.Command() == CmdIntraRemove ||
+		msgToSend.Command() == CmdIntraHintedWrite ||
+		msgToSend.Command() == CmdRaftRequestVote ||
+		msgToSend.Command() == CmdRaftAppendEntries ||
+		msgToSend.Command() == CmdRaftInstallSnapshot ||
+		msgToSend.Command() == CmdIntraTxPrepare ||
+		msgToSend.Command() == CmdIntraTxDecision ||
+		msgToSend.Command() == CmdIntraTxStatus ||
+		msgToSend.Command() == CmdPing {
 		timeout = intraNodeTimeout
 	}
 
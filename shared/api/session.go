@@ -0,0 +1,32 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The values of session commands, and of their replies, are prefixed with a
+// session token: the newest version of the key the client has seen.
+const sessionTokenLen = 8
+
+func NewSessionValue(token int64, value []byte) []byte {
+	data := make([]byte, sessionTokenLen, sessionTokenLen+len(value))
+	binary.BigEndian.PutUint64(data, uint64(token))
+	return append(data, value...)
+}
+
+// Replies to session commands on absent keys carry the updated token too.
+// Replies without a payload, to other commands, parse as before.
+func ParseInvalidKeyDgram(uid [16]byte, cmd byte, payload []byte) (Message, error) {
+	if len(payload) == 0 {
+		return NewBaseDgram(uid, cmd), nil
+	}
+	return ParseValueDgram(uid, cmd, payload)
+}
+
+func ParseSessionValue(data []byte) (token int64, value []byte, err error) {
+	if len(data) < sessionTokenLen {
+		return 0, nil, errors.New("Session value too short")
+	}
+	return int64(binary.BigEndian.Uint64(data)), data[sessionTokenLen:], nil
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"encoding/json"
+)
+
+// Operation codes within a transaction
+const TxOpPut = CmdPut
+const TxOpRemove = CmdRemove
+const TxOpCheckEquals = 0x10 // The key's value must equal Value
+const TxOpCheckExists = 0x11 // The key must have a value
+const TxOpCheckAbsent = 0x12 // The key must not have a value
+
+type TxOp struct {
+	Op    byte
+	Key   string // Hex of the 32 byte key
+	Value []byte
+}
+
+// A transaction, sent as the value of a CmdTransaction datagram.
+// Either all its puts and removes are applied, or none are. They are only
+// applied if all of its checks hold.
+type Transaction struct {
+	Ops []TxOp
+}
+
+func NewTxOp(op byte, key [32]byte, value []byte) TxOp {
+	return TxOp{Op: op, Key: KeyHex(key), Value: value}
+}
+
+func (tx *Transaction) Bytes() ([]byte, error) {
+	return json.Marshal(tx)
+}
+
+func ParseTransaction(data []byte) (*Transaction, error) {
+	tx := &Transaction{}
+	err := json.Unmarshal(data, tx)
+	return tx, err
+}
@@ -0,0 +1,84 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+/* Limits the rate of requests from each client with a token bucket.
+ * A client may send up to burst requests at once, and then rate per second.
+ * Clients are identified by any string, eg. their IP.
+ */
+type RateLimiter struct {
+	rate      float64 // requests per second. 0 means unlimited
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+/* Takes a token from the client's bucket. If the bucket is empty,
+ * returns false and how long until the client may try again.
+ */
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// Returns the tokens in b at time now
+func (l *RateLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		return l.burst
+	}
+	return tokens
+}
+
+// Forgets the clients whose buckets have refilled, since a new bucket is
+// the same. Runs at most once per time to refill, so that this is cheap.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep).Seconds() < l.burst/l.rate {
+		return
+	}
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestRateLimiterPerClient(t *testing.T) {
+	limiter := NewRateLimiter(1, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatal("Request within the burst limited")
+		}
+	}
+	ok, retryAfter := limiter.Allow("a")
+	if ok {
+		t.Fatal("Request over the burst allowed")
+	}
+	if retryAfter <= 0 || retryAfter.Seconds() > 1 {
+		t.Fatal("Bad retry after", retryAfter)
+	}
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Fatal("Other client limited")
+	}
+
+	unlimited := NewRateLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if ok, _ := unlimited.Allow("a"); !ok {
+			t.Fatal("Unlimited limiter limited")
+		}
+	}
+}
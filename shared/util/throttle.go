@@ -0,0 +1,30 @@
+package util
+
+import "time"
+
+// Limits a stream of bytes to a rate, shared by all its senders
+type Throttle struct {
+	rate int // bytes per second. 0 means unlimited
+	next time.Time
+	lock Semaphore
+}
+
+func NewThrottle(bytesPerSec int) *Throttle {
+	return &Throttle{rate: bytesPerSec, lock: NewSemaphore()}
+}
+
+// Blocks until bytes more may be sent without exceeding the rate
+func (t *Throttle) Wait(bytes int) {
+	if t.rate <= 0 {
+		return
+	}
+	t.lock.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(bytes) * time.Second / time.Duration(t.rate))
+	t.lock.Unlock()
+	time.Sleep(wait)
+}
@@ -0,0 +1,25 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottleLimitsRate(t *testing.T) {
+	throttle := NewThrottle(1000)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		throttle.Wait(50)
+	}
+	// The first 100 bytes are sent after 100ms, so the last 50 may go
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatal("Throttle did not wait, elapsed", elapsed)
+	}
+
+	unlimited := NewThrottle(0)
+	start = time.Now()
+	unlimited.Wait(1000000)
+	if time.Since(start) > 10*time.Millisecond {
+		t.Fatal("Unlimited throttle waited")
+	}
+}
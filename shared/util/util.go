@@ -4,11 +4,30 @@ import (
 	"errors"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 )
 
-// To be used for convenience as the random source throughout the app
-var Rand = rand.New(rand.NewSource(UnixMilliTimestamp()))
+// To be used for convenience as the random source throughout the app.
+// Safe to use from several goroutines.
+var Rand = rand.New(&lockedSource{src: rand.NewSource(UnixMilliTimestamp())})
+
+type lockedSource struct {
+	src  rand.Source
+	lock sync.Mutex
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.src.Seed(seed)
+}
 
 // Makes a new UDP socket on the primary network connection
 // If port is 0, it will select one automatically